@@ -0,0 +1,6 @@
+#!/bin/bash
+
+# the log search needs SQLite with FTS5, which go-sqlite3 only builds with the
+# sqlite_fts5 tag
+set -e
+go build -tags sqlite_fts5 "$@" .
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// User facing groups of logs, in the order they are shown, so the logs of
+// the many subsystems of lnd and domains of Tor can be filtered by what they
+// are about
+const (
+	CATEGORY_NODE       = "node"
+	CATEGORY_WALLET     = "wallet"
+	CATEGORY_NEUTRINO   = "neutrino"
+	CATEGORY_NETWORK    = "network"
+	CATEGORY_GOSSIP     = "gossip"
+	CATEGORY_CHANNELS   = "channels"
+	CATEGORY_HTLC       = "htlc"
+	CATEGORY_WATCHTOWER = "watchtower"
+	CATEGORY_TOR        = "tor"
+)
+
+var Categories = []string{
+	CATEGORY_NODE, CATEGORY_WALLET, CATEGORY_NEUTRINO, CATEGORY_NETWORK, CATEGORY_GOSSIP,
+	CATEGORY_CHANNELS, CATEGORY_HTLC, CATEGORY_WATCHTOWER, CATEGORY_TOR,
+}
+
+// Category of each lnd subsystem, the code before the message of its logs
+var lndSubsystems = map[string]string{
+	"LTND": CATEGORY_NODE,
+	"RPCS": CATEGORY_NODE,
+	"RPCP": CATEGORY_NODE,
+	"CHDB": CATEGORY_NODE,
+	"HLCK": CATEGORY_NODE,
+	"PROM": CATEGORY_NODE,
+	"LNWL": CATEGORY_WALLET,
+	"BTWL": CATEGORY_WALLET,
+	"WLKT": CATEGORY_WALLET,
+	"KCHN": CATEGORY_WALLET,
+	"SGNR": CATEGORY_WALLET,
+	"SWPR": CATEGORY_WALLET,
+	"UTXN": CATEGORY_WALLET,
+	"CHNF": CATEGORY_WALLET,
+	"BTCN": CATEGORY_NEUTRINO,
+	"NTFN": CATEGORY_NEUTRINO,
+	"CHRE": CATEGORY_NEUTRINO,
+	"PEER": CATEGORY_NETWORK,
+	"SRVR": CATEGORY_NETWORK,
+	"CMGR": CATEGORY_NETWORK,
+	"TORC": CATEGORY_NETWORK,
+	"PRNF": CATEGORY_NETWORK,
+	"CHFT": CATEGORY_NETWORK,
+	"DISC": CATEGORY_GOSSIP,
+	"GRPH": CATEGORY_GOSSIP,
+	"NANN": CATEGORY_GOSSIP,
+	"FNDG": CATEGORY_CHANNELS,
+	"CNCT": CATEGORY_CHANNELS,
+	"BRAR": CATEGORY_CHANNELS,
+	"CHBU": CATEGORY_CHANNELS,
+	"CHAC": CATEGORY_CHANNELS,
+	"ATPL": CATEGORY_CHANNELS,
+	"HSWC": CATEGORY_HTLC,
+	"CRTR": CATEGORY_HTLC,
+	"RRPC": CATEGORY_HTLC,
+	"INVC": CATEGORY_HTLC,
+	"IRPC": CATEGORY_HTLC,
+	"WTCL": CATEGORY_WATCHTOWER,
+	"WTWR": CATEGORY_WATCHTOWER,
+}
+
+// Category of the Tor log domains that are not just about Tor itself, as
+// printed with LogMessageDomains
+var torDomains = map[string]string{
+	"NET":       CATEGORY_NETWORK,
+	"OR":        CATEGORY_NETWORK,
+	"CHANNEL":   CATEGORY_NETWORK,
+	"HANDSHAKE": CATEGORY_NETWORK,
+	"EDGE":      CATEGORY_NETWORK,
+	"DOS":       CATEGORY_NETWORK,
+}
+
+// The category of the logs of a subsystem of a service: the one of the
+// taxonomy of lnd and Tor or of the manifest of the service. Lnd logs of
+// unknown subsystems are about the node, the rest of the logs are in the
+// category named after their service.
+func logCategory(service string, subsystem string) string {
+	subsystem = strings.ToUpper(subsystem)
+	switch {
+	case strings.EqualFold(service, "Lnd"):
+		if category, ok := lndSubsystems[subsystem]; ok {
+			return category
+		}
+		return CATEGORY_NODE
+	case strings.EqualFold(service, "Tor"):
+		if category, ok := torDomains[subsystem]; ok {
+			return category
+		}
+		return CATEGORY_TOR
+	}
+	if m, ok := Manifests[service]; ok {
+		for name, category := range m.Log.Categories {
+			if strings.EqualFold(name, subsystem) {
+				return strings.ToLower(category)
+			}
+		}
+	}
+	return strings.ToLower(service)
+}
+
+// The categories to filter the logs of some services by: the ones of lnd and
+// Tor, then for every other service the ones of its manifest and its own
+func LogCategories(services []string) []string {
+	categories := slices.Clone(Categories)
+	add := func(category string) {
+		if !slices.Contains(categories, category) {
+			categories = append(categories, category)
+		}
+	}
+	for _, service := range services {
+		if strings.EqualFold(service, "Lnd") || strings.EqualFold(service, "Tor") {
+			continue
+		}
+		if m, ok := Manifests[service]; ok {
+			names := make([]string, 0, len(m.Log.Categories))
+			for name := range m.Log.Categories {
+				names = append(names, name)
+			}
+			slices.Sort(names)
+			for _, name := range names {
+				add(strings.ToLower(m.Log.Categories[name]))
+			}
+		}
+		add(strings.ToLower(service))
+	}
+	return categories
+}
+
+// The category of a log
+func (l *Log) category() string {
+	return logCategory(l.service, l.subsystem)
+}
+
+// The fields of a log as stored in the db, empty when it has none
+func (l *Log) fieldsJSON() (string, error) {
+	if len(l.fields) == 0 {
+		return "", nil
+	}
+	b, err := json.Marshal(l.fields)
+	return string(b), err
+}
+
+func parseFields(stored string) (map[string]string, error) {
+	if stored == "" {
+		return nil, nil
+	}
+	var fields map[string]string
+	if err := json.Unmarshal([]byte(stored), &fields); err != nil {
+		return nil, fmt.Errorf("invalid log fields %q: %w", stored, err)
+	}
+	return fields, nil
+}
+
+// Migration of the log table to version 2: the subsystem, category and
+// fields columns. The lnd logs stored with their subsystem as service get
+// Lnd back, and every log its category.
+func logCategoriesMigration() string {
+	codes := make([]string, 0, len(lndSubsystems))
+	for code := range lndSubsystems {
+		codes = append(codes, code)
+	}
+	slices.Sort(codes)
+	var migration strings.Builder
+	migration.WriteString(`
+ALTER TABLE log ADD COLUMN subsystem TEXT NOT NULL DEFAULT '' COLLATE NOCASE;
+ALTER TABLE log ADD COLUMN category TEXT NOT NULL DEFAULT '' COLLATE NOCASE;
+ALTER TABLE log ADD COLUMN fields TEXT NOT NULL DEFAULT '';
+CREATE INDEX log_category_idx ON log (category COLLATE NOCASE, timestamp);
+UPDATE log SET subsystem = service, service = 'Lnd' WHERE service IN ('` + strings.Join(codes, "', '") + `');
+UPDATE log SET category = CASE
+`)
+	for _, code := range codes {
+		fmt.Fprintf(&migration, "    WHEN service = 'Lnd' AND subsystem = '%v' THEN '%v'\n", code, lndSubsystems[code])
+	}
+	migration.WriteString("    WHEN service = 'Lnd' THEN 'node'\n    ELSE lower(service)\nEND;\n")
+	return migration.String()
+}
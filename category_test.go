@@ -0,0 +1,89 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLogCategory(t *testing.T) {
+	m, err := ParseManifest([]byte(testManifest), "sidecar.yaml")
+	assert.NoError(t, err)
+	Manifests[m.Name] = m
+	t.Cleanup(func() { delete(Manifests, m.Name) })
+
+	for _, tt := range []struct {
+		service   string
+		subsystem string
+		category  string
+	}{
+		{"Lnd", "HSWC", CATEGORY_HTLC},
+		{"Lnd", "btcn", CATEGORY_NEUTRINO},
+		{"Lnd", "LNWL", CATEGORY_WALLET},
+		{"Lnd", "NEWW", CATEGORY_NODE},
+		{"Lnd", "", CATEGORY_NODE},
+		{"Tor", "NET", CATEGORY_NETWORK},
+		{"Tor", "GENERAL", CATEGORY_TOR},
+		{"Sidecar", "HTTP", "network"},
+		{"Sidecar", "DB", "sidecar"},
+		{"LNBits", "", "lnbits"},
+	} {
+		assert.Equal(t, tt.category, logCategory(tt.service, tt.subsystem), "%v %v", tt.service, tt.subsystem)
+	}
+
+	categories := LogCategories([]string{"Tor", "Lnd", "Sidecar", "LNBank"})
+	assert.Equal(t, append(Categories, "sidecar", "lnbank"), categories)
+	assert.Len(t, Categories, 9, "Categories is not changed")
+}
+
+func TestLogFields(t *testing.T) {
+	l := &Log{service: "Sidecar"}
+	stored, err := l.fieldsJSON()
+	assert.NoError(t, err)
+	assert.Empty(t, stored)
+	fields, err := parseFields(stored)
+	assert.NoError(t, err)
+	assert.Nil(t, fields)
+
+	l.fields = map[string]string{"request": "a1", "peer": "03ab"}
+	stored, err = l.fieldsJSON()
+	assert.NoError(t, err)
+	fields, err = parseFields(stored)
+	assert.NoError(t, err)
+	assert.Equal(t, l.fields, fields)
+
+	_, err = parseFields("{")
+	assert.Error(t, err)
+}
+
+func TestQueryLogCategory(t *testing.T) {
+	t.Cleanup(func() {
+		_, err := DB.Exec("DELETE FROM log WHERE desc LIKE 'category test%'")
+		assert.NoError(t, err)
+	})
+	now := time.Now()
+	for _, l := range []*Log{
+		{date: now, logType: INFO, service: "Lnd", subsystem: "HSWC", desc: "category test htlc",
+			fields: map[string]string{"htlc": "12"}},
+		{date: now, logType: INFO, service: "Lnd", subsystem: "DISC", desc: "category test gossip"},
+		{date: now, logType: INFO, service: "Tor", subsystem: "NET", desc: "category test network"},
+	} {
+		errs, fatal := LogToDb(l)
+		assert.False(t, fatal, "%v", errs)
+	}
+
+	q, err := QueryLog(time.Hour, nil, nil, []string{CATEGORY_HTLC, CATEGORY_NETWORK}, "category test", 0)
+	assert.NoError(t, err)
+	defer q.close()
+	logs, err := q.getn(10)
+	assert.NoError(t, err)
+	if assert.Len(t, logs, 2) {
+		assert.Equal(t, "category test network", logs[0].desc)
+		assert.Equal(t, "NET", logs[0].subsystem)
+		assert.Equal(t, "Lnd", logs[1].service)
+		assert.Equal(t, "HSWC", logs[1].subsystem)
+		assert.Equal(t, map[string]string{"htlc": "12"}, logs[1].fields)
+		assert.Equal(t, "Lnd HSWC", logs[1].source())
+	}
+}
@@ -1,5 +1,11 @@
 package main
 
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
 const ConfigTable = `
 CREATE TABLE IF NOT EXISTS config (
  name VARCHAR NOT NULL, 
@@ -39,3 +45,39 @@ func ReadConfig(name string, service string, defaultvalue any) (any, error) {
 	}
 	return value, nil
 }
+
+// Read a duration such as "30s" or "1h", storing the default when missing
+func ReadDurationConfig(name string, service string, defaultvalue time.Duration) (time.Duration, error) {
+	value, err := ReadConfig(name, service, defaultvalue.String())
+	if err != nil {
+		return defaultvalue, err
+	}
+	d, err := time.ParseDuration(fmt.Sprint(value))
+	if err != nil {
+		return defaultvalue, fmt.Errorf("%v of %v: %w", name, service, err)
+	}
+	return d, nil
+}
+
+// Read a duration that must be positive, such as the interval of a ticker.
+// The default is returned instead of a duration of 0 or less.
+func ReadIntervalConfig(name string, service string, defaultvalue time.Duration) (time.Duration, error) {
+	d, err := ReadDurationConfig(name, service, defaultvalue)
+	if err == nil && d <= 0 {
+		return defaultvalue, fmt.Errorf("%v of %v must be positive, not %v", name, service, d)
+	}
+	return d, err
+}
+
+// Read an integer, storing the default when missing
+func ReadIntConfig(name string, service string, defaultvalue int) (int, error) {
+	value, err := ReadConfig(name, service, defaultvalue)
+	if err != nil {
+		return defaultvalue, err
+	}
+	i, err := strconv.Atoi(fmt.Sprint(value))
+	if err != nil {
+		return defaultvalue, fmt.Errorf("%v of %v: %w", name, service, err)
+	}
+	return i, nil
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -24,3 +25,19 @@ func TestReadConfig(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, "testing_value", c)
 }
+
+func TestReadDurationConfig(t *testing.T) {
+	_, err := DB.Exec("DELETE FROM config WHERE service='test_duration_config'")
+	assert.NoError(t, err)
+	d, err := ReadDurationConfig("timeout", "test_duration_config", time.Minute)
+	assert.NoError(t, err)
+	assert.Equal(t, time.Minute, d)
+	assert.NoError(t, SetConfig("timeout", "test_duration_config", "90s"))
+	d, err = ReadDurationConfig("timeout", "test_duration_config", time.Minute)
+	assert.NoError(t, err)
+	assert.Equal(t, time.Second*90, d)
+	assert.NoError(t, SetConfig("timeout", "test_duration_config", "soon"))
+	d, err = ReadDurationConfig("timeout", "test_duration_config", time.Minute)
+	assert.Error(t, err)
+	assert.Equal(t, time.Minute, d)
+}
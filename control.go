@@ -0,0 +1,524 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Local API to query and control the services. Every request must carry the
+// token stored in ControlTokenFile as "Authorization: Bearer <token>".
+//
+//	GET  /services                 state of all services
+//	GET  /services/{name}          state of one service
+//	POST /services/{name}/start    start it and its dependencies
+//	POST /services/{name}/stop     stop it and its dependents
+//	POST /services/{name}/restart  restart it and its running dependents
+//	GET  /services/{name}/resources?last=1h  CPU, memory and I/O samples
+//	GET  /services/{name}/availability?last=24h  time in each state and transitions
+//	GET  /services/{name}/versions  versions seen, oldest first
+//	GET  /logs?last=1h&type=ERROR&service=Tor&category=htlc&desc=text&limit=100
+//	GET  /logs?from=2024-07-01T00:00:00Z&to=...&order=asc&cursor=...  the Next-Cursor header gives the next page
+//	GET  /logs/count?last=24h&type=ERROR  how many logs there are, with the filters of /logs
+//	GET  /logs/search?q=text&last=1h&type=ERROR&service=Tor&category=htlc&limit=100  best matches first
+//	GET  /logs/export?format=csv&redact=true&last=24h  the same filters as /logs, all logs unless limited
+//	GET  /logs/sinks               logs written, dropped and failed by each sink
+const DefaultControlAddress = "localhost:9747"
+
+var (
+	ControlTokenFile  string
+	ControlSocketFile string
+)
+
+type controlStatus struct {
+	Name         string         `json:"name"`
+	Version      string         `json:"version,omitempty"`
+	State        string         `json:"state"`
+	Since        time.Time      `json:"since"`
+	Reason       string         `json:"reason,omitempty"`
+	Uptime       string         `json:"uptime,omitempty"`
+	Dependencies []string       `json:"dependencies"`
+	Restarts     int            `json:"restarts"`
+	Ports        map[string]int `json:"ports,omitempty"`
+}
+
+func newControlStatus(st ServiceStatus) controlStatus {
+	cs := controlStatus{
+		Name:         st.name,
+		Version:      ServiceVersion(st.name),
+		State:        st.state.Name(),
+		Since:        st.since,
+		Reason:       st.reason,
+		Dependencies: st.dependencies,
+		Restarts:     st.restarts,
+	}
+	for _, ps := range Ports {
+		if ps.service == st.name {
+			if cs.Ports == nil {
+				cs.Ports = make(map[string]int)
+			}
+			cs.Ports[ps.name] = PortOf(ps.service, ps.name)
+		}
+	}
+	if cs.Dependencies == nil {
+		cs.Dependencies = []string{}
+	}
+	if st.state == READY || st.state == DEGRADED {
+		cs.Uptime = time.Since(st.upSince).Round(time.Second).String()
+	}
+	return cs
+}
+
+// Read the control token, creating a new random one the first time
+func ControlToken() (string, error) {
+	token, err := os.ReadFile(ControlTokenFile)
+	if err == nil {
+		return strings.TrimSpace(string(token)), nil
+	}
+	if !os.IsNotExist(err) {
+		return "", err
+	}
+	random := make([]byte, 32)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+	t := hex.EncodeToString(random)
+	return t, os.WriteFile(ControlTokenFile, []byte(t+"\n"), 0600)
+}
+
+// The duration of the "last" query parameter, or def when missing
+func lastParam(r *http.Request, def time.Duration) (time.Duration, error) {
+	if !r.URL.Query().Has("last") {
+		return def, nil
+	}
+	return time.ParseDuration(r.URL.Query().Get("last"))
+}
+
+// The last, type and limit parameters of the log queries
+func logParams(r *http.Request) (time.Duration, []LogType, uint, error) {
+	query := r.URL.Query()
+	last, err := lastParam(r, time.Hour*24)
+	if err != nil {
+		return 0, nil, 0, err
+	}
+	var logtypes []LogType
+	for _, name := range query["type"] {
+		lt, err := ParseLogType(name)
+		if err != nil {
+			return 0, nil, 0, err
+		}
+		logtypes = append(logtypes, lt)
+	}
+	limit := uint64(100)
+	if query.Has("limit") {
+		if limit, err = strconv.ParseUint(query.Get("limit"), 10, 32); err != nil {
+			return 0, nil, 0, err
+		}
+	}
+	return last, logtypes, uint(limit), nil
+}
+
+// The query of the logs of the parameters of /logs: those of logParams,
+// a range of from and to times instead of last, service, category, desc,
+// order=asc and the cursor of a previous page. It returns the limit apart,
+// as it is the size of the page.
+func logSelectParams(r *http.Request) (*LogSelect, uint, error) {
+	query := r.URL.Query()
+	last, logtypes, limit, err := logParams(r)
+	if err != nil {
+		return nil, 0, err
+	}
+	s := SelectLogs().Since(last).Types(logtypes...).Services(query["service"]...).
+		Categories(query["category"]...).Search(query.Get("desc"))
+	if query.Has("from") || query.Has("to") {
+		var from, to time.Time
+		if query.Has("from") {
+			if from, err = time.Parse(time.RFC3339, query.Get("from")); err != nil {
+				return nil, 0, err
+			}
+		}
+		if query.Has("to") {
+			if to, err = time.Parse(time.RFC3339, query.Get("to")); err != nil {
+				return nil, 0, err
+			}
+		}
+		s.Between(from, to)
+	}
+	switch query.Get("order") {
+	case "", "desc":
+	case "asc":
+		s.Ascending()
+	default:
+		return nil, 0, fmt.Errorf("invalid order %q, it must be asc or desc", query.Get("order"))
+	}
+	cursor, err := ParseLogCursor(query.Get("cursor"))
+	if err != nil {
+		return nil, 0, err
+	}
+	s.After(cursor)
+	// the search is checked before answering
+	if _, _, err := s.where(); err != nil {
+		return nil, 0, err
+	}
+	return s, limit, nil
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, code int, err error) {
+	writeJSON(w, code, map[string]string{"error": err.Error()})
+}
+
+// The control API for the services of sup
+func controlHandler(sup *Supervisor, token string) http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("GET /services", func(w http.ResponseWriter, r *http.Request) {
+		statuses := make([]controlStatus, 0)
+		for _, st := range sup.status() {
+			statuses = append(statuses, newControlStatus(st))
+		}
+		writeJSON(w, http.StatusOK, statuses)
+	})
+	mux.HandleFunc("GET /services/{name}", func(w http.ResponseWriter, r *http.Request) {
+		st, ok := sup.statusOf(r.PathValue("name"))
+		if !ok {
+			writeError(w, http.StatusNotFound, fmt.Errorf("unknown service %v", r.PathValue("name")))
+			return
+		}
+		writeJSON(w, http.StatusOK, newControlStatus(st))
+	})
+
+	mux.HandleFunc("GET /services/{name}/resources", func(w http.ResponseWriter, r *http.Request) {
+		last, err := lastParam(r, time.Hour)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		samples, err := QueryResources(r.PathValue("name"), last)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		type sample struct {
+			Time       time.Time `json:"time"`
+			Pid        int       `json:"pid"`
+			Cpu        float64   `json:"cpu"`
+			Rss        uint64    `json:"rss"`
+			Fds        int       `json:"fds"`
+			ReadBytes  uint64    `json:"read_bytes"`
+			WriteBytes uint64    `json:"write_bytes"`
+		}
+		result := make([]sample, 0, len(samples))
+		for _, ps := range samples {
+			result = append(result, sample{ps.date, ps.pid, ps.cpu, ps.rss, ps.fds, ps.readBytes, ps.writeBytes})
+		}
+		writeJSON(w, http.StatusOK, result)
+	})
+
+	mux.HandleFunc("GET /services/{name}/availability", func(w http.ResponseWriter, r *http.Request) {
+		last, err := lastParam(r, time.Hour*24)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		name := r.PathValue("name")
+		to := time.Now()
+		a, err := QueryAvailability(name, to.Add(-last), to)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		transitions, err := QueryTransitions(name, to.Add(-last), to)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		type transition struct {
+			Time   time.Time `json:"time"`
+			From   string    `json:"from"`
+			To     string    `json:"to"`
+			Reason string    `json:"reason"`
+		}
+		result := struct {
+			Availability float64           `json:"availability"`
+			Crashes      int               `json:"crashes"`
+			States       map[string]string `json:"states"`
+			Transitions  []transition      `json:"transitions"`
+		}{a.ratio(), a.crashes, make(map[string]string), make([]transition, 0, len(transitions))}
+		for state, d := range a.states {
+			result.States[state.Name()] = d.Round(time.Second).String()
+		}
+		for _, t := range transitions {
+			result.Transitions = append(result.Transitions, transition{t.since, t.from.Name(), t.state.Name(), t.reason})
+		}
+		writeJSON(w, http.StatusOK, result)
+	})
+
+	mux.HandleFunc("GET /services/{name}/versions", func(w http.ResponseWriter, r *http.Request) {
+		records, err := QueryVersions(r.PathValue("name"))
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		type version struct {
+			Time    time.Time `json:"time"`
+			Version string    `json:"version"`
+			Sha256  string    `json:"sha256,omitempty"`
+		}
+		result := make([]version, 0, len(records))
+		for _, vr := range records {
+			result = append(result, version{vr.date, vr.version, vr.sha256})
+		}
+		writeJSON(w, http.StatusOK, result)
+	})
+
+	actions := map[string]func(string) error{
+		"start":   sup.start,
+		"stop":    sup.stop,
+		"restart": sup.restart,
+	}
+	for action, do := range actions {
+		mux.HandleFunc("POST /services/{name}/"+action, func(w http.ResponseWriter, r *http.Request) {
+			name := r.PathValue("name")
+			st, ok := sup.statusOf(name)
+			if !ok {
+				writeError(w, http.StatusNotFound, fmt.Errorf("unknown service %v", name))
+				return
+			}
+			sup.log(&Log{
+				date:    time.Now(),
+				logType: INFO,
+				service: "LNBank",
+				desc:    fmt.Sprintf("control API: %v %v", action, name),
+			})
+			if err := do(name); err != nil {
+				writeError(w, http.StatusConflict, err)
+				return
+			}
+			st, _ = sup.statusOf(name)
+			writeJSON(w, http.StatusOK, newControlStatus(st))
+		})
+	}
+
+	mux.HandleFunc("GET /logs/sinks", func(w http.ResponseWriter, r *http.Request) {
+		type sink struct {
+			Name     string `json:"name"`
+			Policy   string `json:"policy"`
+			Buffered int    `json:"buffered"`
+			Written  uint64 `json:"written"`
+			Dropped  uint64 `json:"dropped"`
+			Failed   uint64 `json:"failed"`
+		}
+		result := []sink{}
+		if Logs != nil {
+			for _, ss := range Logs.stats() {
+				result = append(result, sink{ss.name, ss.policy.String(), ss.buffered, ss.written, ss.dropped, ss.failed})
+			}
+		}
+		writeJSON(w, http.StatusOK, result)
+	})
+
+	mux.HandleFunc("GET /logs", func(w http.ResponseWriter, r *http.Request) {
+		s, limit, err := logSelectParams(r)
+		if err == nil && limit == 0 {
+			err = errEmptyPage
+		}
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		logs, cursor, err := s.Page(r.Context(), limit)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		if logs == nil {
+			logs = []Log{}
+		}
+		if !cursor.IsZero() {
+			w.Header().Set("Next-Cursor", cursor.String())
+		}
+		writeJSON(w, http.StatusOK, logs)
+	})
+
+	mux.HandleFunc("GET /logs/count", func(w http.ResponseWriter, r *http.Request) {
+		s, _, err := logSelectParams(r)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		n, err := s.Count(r.Context())
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]int{"count": n})
+	})
+
+	mux.HandleFunc("GET /logs/export", func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		s, limit, err := logSelectParams(r)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		// all of them unless limited
+		if query.Has("limit") {
+			s.Limit(limit)
+		}
+		format := EXPORT_JSONL
+		if query.Has("format") {
+			if format, err = ParseExportFormat(query.Get("format")); err != nil {
+				writeError(w, http.StatusBadRequest, err)
+				return
+			}
+		}
+		var redactor *Redactor
+		if query.Has("redact") {
+			redact, err := strconv.ParseBool(query.Get("redact"))
+			if err != nil {
+				writeError(w, http.StatusBadRequest, err)
+				return
+			}
+			if redact {
+				redactor = NewRedactor()
+			}
+		}
+		contentTypes := map[ExportFormat]string{
+			EXPORT_JSONL: "application/jsonl",
+			EXPORT_CSV:   "text/csv",
+			EXPORT_TEXT:  "text/plain",
+		}
+		w.Header().Set("Content-Type", contentTypes[format]+"; charset=utf-8")
+		w.Header().Set("Content-Disposition",
+			`attachment; filename="`+ExportFileName(time.Now(), format)+`"`)
+		// once the logs are being sent, an error can only cut them short
+		_, _ = ExportLogs(w, s.All(r.Context()), format, redactor)
+	})
+
+	mux.HandleFunc("GET /logs/search", func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		last, logtypes, limit, err := logParams(r)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		sq, err := ParseSearch(query.Get("q"))
+		if err == nil && sq == nil {
+			err = errors.New("nothing to search for")
+		}
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		results, err := SearchLog(query.Get("q"), last, logtypes, query["service"], query["category"], limit)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		if results == nil {
+			results = []SearchResult{}
+		}
+		writeJSON(w, http.StatusOK, results)
+	})
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth, bearer := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !bearer || subtle.ConstantTimeCompare([]byte(auth), []byte(token)) != 1 {
+			writeError(w, http.StatusUnauthorized, errors.New("missing or wrong token"))
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// Serve the control API of sup on localhost and on a unix socket under
+// ServiceRootDir until ctx is done
+func ServeControl(ctx context.Context, sup *Supervisor) error {
+	token, err := ControlToken()
+	if err != nil {
+		return fmt.Errorf("cannot create control token: %w", err)
+	}
+	def := DefaultControlAddress
+	if PortOffset != 0 {
+		host, port, _ := net.SplitHostPort(DefaultControlAddress)
+		p, _ := strconv.Atoi(port)
+		def = net.JoinHostPort(host, strconv.Itoa(p+PortOffset))
+	}
+	value, err := ReadConfig("address", "control", def)
+	if err != nil {
+		return err
+	}
+
+	var listeners []net.Listener
+	tcp, err := net.Listen("tcp", fmt.Sprint(value))
+	if err != nil {
+		return fmt.Errorf("cannot listen for the control API: %w", err)
+	}
+	listeners = append(listeners, tcp)
+	// a socket left by a previous run would make Listen fail
+	_ = os.Remove(ControlSocketFile)
+	if unix, err := net.Listen("unix", ControlSocketFile); err == nil {
+		if err := os.Chmod(ControlSocketFile, 0600); err != nil {
+			unix.Close()
+			tcp.Close()
+			return err
+		}
+		listeners = append(listeners, unix)
+	} else {
+		sup.log(&Log{
+			date:    time.Now(),
+			logType: WARNING,
+			service: "LNBank",
+			desc:    "control API not available on unix socket: " + err.Error(),
+		})
+	}
+
+	server := &http.Server{
+		Handler:           controlHandler(sup, token),
+		ReadHeaderTimeout: time.Second * 10,
+	}
+	for _, listener := range listeners {
+		go func() {
+			if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				sup.log(&Log{
+					date:    time.Now(),
+					logType: ERROR,
+					service: "LNBank",
+					desc:    "control API stopped: " + err.Error(),
+				})
+			}
+		}()
+	}
+	for _, listener := range listeners {
+		sup.log(&Log{
+			date:    time.Now(),
+			logType: INFO,
+			service: "LNBank",
+			desc:    "control API listening on " + listener.Addr().String(),
+		})
+	}
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+		defer cancel()
+		_ = server.Shutdown(shutdownCtx)
+	}()
+	return nil
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func controlRequest(t *testing.T, handler http.Handler, method string, path string, token string, v any) int {
+	t.Helper()
+	req := httptest.NewRequest(method, path, nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if v != nil {
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), v), rec.Body.String())
+	}
+	return rec.Code
+}
+
+func TestControlServices(t *testing.T) {
+	s := newTestSupervisor(t,
+		fakeService{"lnd", []string{"tor"}},
+		fakeService{"tor", nil},
+	)
+	handler := controlHandler(s, "secret")
+
+	assert.Equal(t, http.StatusUnauthorized, controlRequest(t, handler, "GET", "/services", "wrong", nil))
+	// the bare token is not enough
+	req := httptest.NewRequest("GET", "/services", nil)
+	req.Header.Set("Authorization", "secret")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+
+	var statuses []controlStatus
+	assert.Equal(t, http.StatusOK, controlRequest(t, handler, "GET", "/services", "secret", &statuses))
+	assert.Len(t, statuses, 2)
+	assert.Equal(t, "tor", statuses[0].Name)
+	assert.Equal(t, "stopped", statuses[0].State)
+	assert.Equal(t, []string{"tor"}, statuses[1].Dependencies)
+
+	var status controlStatus
+	assert.Equal(t, http.StatusOK, controlRequest(t, handler, "POST", "/services/lnd/start", "secret", &status))
+	assertState(t, s, "lnd", READY)
+	assert.Equal(t, http.StatusOK, controlRequest(t, handler, "GET", "/services/tor", "secret", &status))
+	assert.Equal(t, "ready", status.State)
+	assert.NotEmpty(t, status.Uptime)
+
+	assert.Equal(t, http.StatusOK, controlRequest(t, handler, "POST", "/services/tor/stop", "secret", &status))
+	assertState(t, s, "lnd", STOPPED)
+	assert.Equal(t, http.StatusNotFound, controlRequest(t, handler, "POST", "/services/lndg/start", "secret", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, controlRequest(t, handler, "GET", "/services/tor/stop", "secret", nil))
+}
+
+func TestControlLogs(t *testing.T) {
+	_, fatal := LogToDb(&Log{
+		date:    time.Now(),
+		logType: ERROR,
+		service: "test_control",
+		desc:    "control api log",
+	})
+	assert.False(t, fatal)
+	handler := controlHandler(newTestSupervisor(t), "secret")
+
+	var logs []map[string]any
+	assert.Equal(t, http.StatusOK, controlRequest(t, handler, "GET",
+		"/logs?last=1m&type=error&service=test_control&limit=1", "secret", &logs))
+	if assert.Len(t, logs, 1) {
+		assert.Equal(t, "control api log", logs[0]["desc"])
+		assert.Equal(t, "ERROR", logs[0]["type"])
+		assert.NotZero(t, logs[0]["seq"])
+	}
+
+	assert.Equal(t, http.StatusBadRequest, controlRequest(t, handler, "GET",
+		"/logs?type=verbose", "secret", nil))
+	assert.Equal(t, http.StatusBadRequest, controlRequest(t, handler, "GET",
+		"/logs?cursor=nope", "secret", nil))
+	assert.Equal(t, http.StatusBadRequest, controlRequest(t, handler, "GET",
+		"/logs?order=sideways", "secret", nil))
+}
+
+func TestControlLogPages(t *testing.T) {
+	service := insertServiceLogs(t, 5, time.Now().Add(-time.Minute))
+	handler := controlHandler(newTestSupervisor(t), "secret")
+	from := url.QueryEscape(time.Now().Add(-time.Hour).Format(time.RFC3339))
+
+	var count map[string]int
+	assert.Equal(t, http.StatusOK, controlRequest(t, handler, "GET",
+		"/logs/count?service="+service, "secret", &count))
+	assert.Equal(t, 5, count["count"])
+
+	var descs []any
+	cursor := ""
+	for range 3 {
+		req := httptest.NewRequest("GET", "/logs?order=asc&limit=2&from="+from+"&service="+service+"&cursor="+cursor, nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+		var logs []map[string]any
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &logs))
+		for _, l := range logs {
+			descs = append(descs, l["desc"])
+		}
+		cursor = rec.Header().Get("Next-Cursor")
+	}
+	assert.Equal(t, []any{"0", "1", "2", "3", "4"}, descs)
+	assert.Empty(t, cursor)
+
+	assert.Equal(t, http.StatusBadRequest, controlRequest(t, handler, "GET",
+		"/logs?limit=0&service="+service, "secret", nil))
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// lnbank daemon: run all the services without a window until SIGINT or
+// SIGTERM, logging to the db and to stdout
+func daemon(args []string) int {
+	flags := flag.NewFlagSet("daemon", flag.ContinueOnError)
+	asJSON := flags.Bool("json", false, "print the logs as JSON lines")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	if ActiveNetwork != MAINNET {
+		fmt.Fprintln(os.Stderr, "Running on "+strings.ToUpper(ActiveNetwork.String())+": coins without value")
+	}
+
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	return serve(Services, Logs, os.Stdout, *asJSON, signals, true)
+}
+
+// Print a log to out as text or as a JSON line
+func printLog(out io.Writer, l *Log, asJSON bool) error {
+	if asJSON {
+		line, err := json.Marshal(l)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(out, "%s\n", line)
+		return err
+	}
+	_, err := fmt.Fprintf(out, "%v %v %v: %v\n",
+		l.date.Format(time.DateTime), l.logType.Name(), l.source(), l.desc)
+	return err
+}
+
+// Start all services of the supervisor and keep them running until a signal
+// arrives, then stop them in order. A second signal stops waiting for them.
+// The logs go through bus, which also prints them to out. With control, the
+// control API is served while running.
+func serve(sup *Supervisor, bus *LogBus, out io.Writer, asJSON bool, signals <-chan os.Signal, control bool) int {
+	sup.setOnLog(bus.publish)
+	// stdout is not worth stopping the services for
+	bus.register("stdout", writerSink{out, asJSON}, 1000, DROP_NEWEST)
+
+	if control {
+		ctx, cancel := context.WithCancel(ServicesContext)
+		defer cancel()
+		if err := ServeControl(ctx, sup); err != nil {
+			bus.publish(&Log{
+				date:    time.Now(),
+				logType: WARNING,
+				service: "LNBank",
+				desc:    err.Error(),
+			})
+		}
+	}
+
+	code := 0
+	if err := sup.startAll(); err != nil {
+		bus.publish(&Log{
+			date:    time.Now(),
+			logType: FATAL,
+			service: "LNBank",
+			desc:    "cannot start services: " + err.Error(),
+		})
+		code = 1
+	} else {
+		sig := <-signals
+		bus.publish(&Log{
+			date:    time.Now(),
+			logType: WARNING,
+			service: "LNBank",
+			desc:    fmt.Sprintf("%v received, closing all services", sig),
+		})
+		ctx, cancel := context.WithTimeout(context.Background(), ShutdownTimeout)
+		go func() {
+			select {
+			case <-signals:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+		if err := sup.stopAll(ctx); err != nil {
+			bus.publish(&Log{
+				date:    time.Now(),
+				logType: ERROR,
+				service: "LNBank",
+				desc:    "closing without all services stopped: " + err.Error(),
+			})
+			code = 1
+		}
+		cancel()
+	}
+
+	// the last logs of the services
+	ctx, cancel := context.WithTimeout(context.Background(), ShutdownTimeout)
+	defer cancel()
+	if err := bus.close(ctx); err != nil {
+		fmt.Fprintln(os.Stderr, "Error closing the logs:", err)
+	}
+	return code
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPrintLog(t *testing.T) {
+	l := &Log{
+		date:    time.Date(2024, 7, 1, 10, 30, 0, 0, time.UTC),
+		logType: WARNING,
+		service: "Tor",
+		desc:    "a \"quoted\" warning",
+	}
+	var out bytes.Buffer
+	assert.NoError(t, printLog(&out, l, false))
+	assert.Equal(t, "2024-07-01 10:30:00 WARNING Tor: a \"quoted\" warning\n", out.String())
+
+	out.Reset()
+	assert.NoError(t, printLog(&out, l, true))
+	var parsed map[string]string
+	assert.NoError(t, json.Unmarshal(out.Bytes(), &parsed))
+	assert.Equal(t, map[string]string{
+		"time":     "2024-07-01T10:30:00Z",
+		"type":     "WARNING",
+		"service":  "Tor",
+		"category": "tor",
+		"desc":     "a \"quoted\" warning",
+	}, parsed)
+}
+
+func TestServe(t *testing.T) {
+	s := newTestSupervisor(t,
+		fakeService{"test_daemon_lnd", []string{"test_daemon_tor"}},
+		fakeService{"test_daemon_tor", nil},
+	)
+	signals := make(chan os.Signal, 1)
+	go func() {
+		assertState(t, s, "test_daemon_lnd", READY)
+		signals <- syscall.SIGTERM
+	}()
+	var out bytes.Buffer
+	assert.Equal(t, 0, serve(s, NewLogBus(), &out, true, signals, false))
+
+	var descs []string
+	scanner := bufio.NewScanner(&out)
+	for scanner.Scan() {
+		var l map[string]string
+		assert.NoError(t, json.Unmarshal(scanner.Bytes(), &l), scanner.Text())
+		descs = append(descs, l["service"]+": "+l["desc"])
+	}
+	all := strings.Join(descs, "\n")
+	assert.Contains(t, all, "test_daemon_lnd: test_daemon_lnd is ready to accept connections")
+	assert.Contains(t, all, "LNBank: terminated received, closing all services")
+	assert.Contains(t, all, "test_daemon_tor: test_daemon_tor is stopped")
+	for _, st := range s.status() {
+		assert.Equal(t, STOPPED, st.state, st.name)
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// The options of the db of LNBank: WAL so the log writer does not block the
+// readers, and a busy timeout so writers wait for each other instead of
+// failing
+const DbOptions = "?_journal_mode=WAL&_busy_timeout=5000&_synchronous=NORMAL"
+
+// Logs written in a transaction at most
+const DefaultDbBatch = 500
+
+// How long a log may wait for the others of its transaction
+const DefaultDbFlushEvery = time.Millisecond * 200
+
+// Returned by a sink for a log it drops on purpose, which the bus counts
+// as dropped rather than failed
+var errLogDropped = errors.New("log dropped")
+
+const insertLogQuery = "INSERT INTO log (timestamp, type_id, desc, service, subsystem, category, fields) VALUES (?, ?, ?, ?, ?, ?, ?)"
+
+// Insert the logs in a single transaction
+func execLogs(ctx context.Context, db *sql.DB, logs []*Log) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	stmt, err := tx.PrepareContext(ctx, insertLogQuery)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for _, l := range logs {
+		fields, err := l.fieldsJSON()
+		if err != nil {
+			return err
+		}
+		_, err = stmt.ExecContext(ctx, l.date.UnixNano(), l.logType, l.desc, l.service,
+			l.subsystem, l.category(), fields)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// The warning stored after a log with the errors errs found by Validate
+func invalidLog(l *Log, errs []error) *Log {
+	return &Log{
+		date:    time.Now(),
+		service: "LNBank",
+		desc:    fmt.Sprintf("Service %v provided an incorrect log: %v", l.service, errs),
+		logType: WARNING,
+	}
+}
+
+// Writes the logs to the db in a goroutine of its own, batching them in
+// transactions of up to batch logs or flushEvery, which is much faster than
+// a transaction per log. When its buffer is more than 3/4 full, DEBUG logs
+// are dropped; when it is full, write waits.
+type DbWriter struct {
+	db         *sql.DB
+	logs       chan *Log
+	batch      int
+	flushEvery time.Duration
+	// logs to flush now, answered once they are written
+	flushes chan chan error
+	done    chan struct{}
+	onError func(err error)
+
+	written atomic.Uint64
+	dropped atomic.Uint64
+	failed  atomic.Uint64
+}
+
+func NewDbWriter(db *sql.DB, buffer int, batch int, flushEvery time.Duration, onError func(err error)) *DbWriter {
+	w := &DbWriter{
+		db:         db,
+		logs:       make(chan *Log, max(buffer, 1)),
+		batch:      max(batch, 1),
+		flushEvery: flushEvery,
+		flushes:    make(chan chan error),
+		done:       make(chan struct{}),
+		onError:    onError,
+	}
+	go w.run()
+	return w
+}
+
+func (w *DbWriter) write(l *Log) error {
+	if l.logType == DEBUG && len(w.logs) > cap(w.logs)*3/4 {
+		w.dropped.Add(1)
+		return errLogDropped
+	}
+	w.logs <- l
+	return nil
+}
+
+// Write the logs buffered, returning once they are in the db
+func (w *DbWriter) flush() error {
+	answer := make(chan error)
+	select {
+	case w.flushes <- answer:
+		return <-answer
+	case <-w.done:
+		return nil
+	}
+}
+
+// Write the logs buffered and stop
+func (w *DbWriter) close() error {
+	close(w.logs)
+	<-w.done
+	return nil
+}
+
+func (w *DbWriter) run() {
+	defer close(w.done)
+	pending := make([]*Log, 0, w.batch)
+	timer := time.NewTimer(w.flushEvery)
+	timer.Stop()
+	commit := func() error {
+		if len(pending) == 0 {
+			return nil
+		}
+		timer.Stop()
+		// Validate corrects the log, which the other sinks may be reading
+		batch := make([]*Log, 0, len(pending))
+		for _, l := range pending {
+			c := *l
+			batch = append(batch, &c)
+			if errs := c.Validate(); errs != nil {
+				batch = append(batch, invalidLog(&c, errs))
+			}
+		}
+		// the logs are written even after the services are done
+		err := execLogs(context.Background(), w.db, batch)
+		if err != nil {
+			w.failed.Add(uint64(len(pending)))
+			w.onError(err)
+		} else {
+			w.written.Add(uint64(len(pending)))
+		}
+		pending = pending[:0]
+		return err
+	}
+	for {
+		select {
+		case l, ok := <-w.logs:
+			if !ok {
+				commit()
+				return
+			}
+			if len(pending) == 0 {
+				timer.Reset(w.flushEvery)
+			}
+			pending = append(pending, l)
+			if len(pending) >= w.batch {
+				commit()
+			}
+		case <-timer.C:
+			commit()
+		case answer := <-w.flushes:
+			// the logs already sent come first
+			for len(w.logs) > 0 {
+				l, ok := <-w.logs
+				if !ok {
+					break
+				}
+				pending = append(pending, l)
+			}
+			answer <- commit()
+		}
+	}
+}
+
+// The logs written to the db, dropped and failed, which the bus shows
+// instead of its own as the logs it hands over may still be buffered here
+func (w *DbWriter) counts() (written uint64, dropped uint64, failed uint64) {
+	return w.written.Load(), w.dropped.Load(), w.failed.Load()
+}
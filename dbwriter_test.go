@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func countDbLogs(t *testing.T, db *sql.DB) int {
+	t.Helper()
+	var n int
+	assert.NoError(t, db.QueryRow("SELECT count(*) FROM log").Scan(&n))
+	return n
+}
+
+func TestDbWriter(t *testing.T) {
+	db := retentionDb(t)
+	w := NewDbWriter(db, 100, 3, time.Millisecond*50, func(err error) { t.Error(err) })
+	for i := range 7 {
+		assert.NoError(t, w.write(&Log{date: time.Now(), logType: INFO, service: "writer", desc: fmt.Sprint(i)}))
+	}
+	assert.NoError(t, w.flush())
+	assert.Equal(t, 7, countDbLogs(t, db))
+
+	// a log alone waits at most flushEvery
+	assert.NoError(t, w.write(&Log{date: time.Now(), logType: INFO, service: "writer", desc: "alone"}))
+	assert.Eventually(t, func() bool { return countDbLogs(t, db) == 8 }, time.Second, time.Millisecond*10)
+
+	// an invalid log is stored corrected, with a warning, and is not changed
+	// for the other sinks
+	invalid := &Log{date: time.Now(), logType: 99, service: "writer", desc: "invalid"}
+	assert.NoError(t, w.write(invalid))
+	assert.NoError(t, w.flush())
+	assert.Equal(t, LogType(99), invalid.logType)
+	var lt LogType
+	assert.NoError(t, db.QueryRow("SELECT type_id FROM log WHERE desc='invalid'").Scan(&lt))
+	assert.Equal(t, LogType(NORMAL), lt)
+	var warning string
+	assert.NoError(t, db.QueryRow("SELECT desc FROM log WHERE service='LNBank'").Scan(&warning))
+	assert.Equal(t, "Service writer provided an incorrect log: [incorrect log type 99]", warning)
+
+	// closing writes what is left
+	for i := range 2 {
+		assert.NoError(t, w.write(&Log{date: time.Now(), logType: INFO, service: "writer", desc: fmt.Sprint("last", i)}))
+	}
+	assert.NoError(t, w.close())
+	assert.Equal(t, 12, countDbLogs(t, db))
+	written, dropped, failed := w.counts()
+	assert.Equal(t, uint64(11), written)
+	assert.Zero(t, dropped)
+	assert.Zero(t, failed)
+	assert.NoError(t, w.flush(), "nothing to flush once closed")
+}
+
+func TestDbWriterPressure(t *testing.T) {
+	db := retentionDb(t)
+	// while the only connection is taken, nothing is written
+	db.SetMaxOpenConns(1)
+	conn, err := db.Conn(context.Background())
+	assert.NoError(t, err)
+	bus := NewLogBus()
+	w := NewDbWriter(db, 4, 1, time.Millisecond, func(err error) { t.Error(err) })
+	bus.register("db", w, 1, BLOCK)
+
+	assert.NoError(t, w.write(&Log{date: time.Now(), logType: INFO, service: "writer", desc: "taken"}))
+	assert.Eventually(t, func() bool { return len(w.logs) == 0 }, time.Second, time.Millisecond)
+	for i := range 4 {
+		assert.NoError(t, w.write(&Log{date: time.Now(), logType: INFO, service: "writer", desc: fmt.Sprint(i)}))
+	}
+	bus.publish(&Log{date: time.Now(), logType: DEBUG, service: "writer", desc: "dropped"})
+	assert.Eventually(t, func() bool {
+		stats := bus.stats()
+		return len(stats) == 1 && stats[0].dropped == 1
+	}, time.Second, time.Millisecond)
+
+	assert.NoError(t, conn.Close())
+	assert.NoError(t, bus.close(context.Background()))
+	assert.Equal(t, 5, countDbLogs(t, db))
+	written, dropped, failed := w.counts()
+	assert.Equal(t, uint64(5), written)
+	assert.Equal(t, uint64(1), dropped)
+	assert.Zero(t, failed)
+}
+
+// A db as the one of LNBank, with its options
+func benchmarkDb(b *testing.B) *sql.DB {
+	db, err := sql.Open("sqlite3", filepath.Join(b.TempDir(), "bench.sqlite3")+DbOptions)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { db.Close() })
+	if _, err := db.Exec(LogTable); err != nil {
+		b.Fatal(err)
+	}
+	return db
+}
+
+func benchmarkLog(i int) *Log {
+	return &Log{date: time.Now(), logType: INFO, service: "Lnd", subsystem: "BTCN",
+		desc: fmt.Sprintf("Fetching filter for height=%v, hash=000000000000000000021b7ba7b4a8bd8ae3c5b0e8d2b2f1c4d5e6f7a8b9c0d1", i)}
+}
+
+// A transaction per log, as LogToDb does
+func BenchmarkLogEach(b *testing.B) {
+	db := benchmarkDb(b)
+	b.ResetTimer()
+	for i := range b.N {
+		if err := execLogs(context.Background(), db, []*Log{benchmarkLog(i)}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDbWriter(b *testing.B) {
+	db := benchmarkDb(b)
+	w := NewDbWriter(db, 10000, DefaultDbBatch, DefaultDbFlushEvery, func(err error) { b.Fatal(err) })
+	b.ResetTimer()
+	for i := range b.N {
+		if err := w.write(benchmarkLog(i)); err != nil {
+			b.Fatal(err)
+		}
+	}
+	if err := w.close(); err != nil {
+		b.Fatal(err)
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"iter"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Format of exported logs
+type ExportFormat int
+
+const (
+	// one JSON object per line, as lnbank daemon -json prints them
+	EXPORT_JSONL ExportFormat = iota
+	// a header and a row per log, with the fields as a JSON object
+	EXPORT_CSV
+	// a line per log, as lnbank daemon prints them
+	EXPORT_TEXT
+)
+
+var ExportFormats = []ExportFormat{EXPORT_JSONL, EXPORT_CSV, EXPORT_TEXT}
+
+func (ef ExportFormat) String() string {
+	switch ef {
+	case EXPORT_CSV:
+		return "csv"
+	case EXPORT_TEXT:
+		return "text"
+	}
+	return "jsonl"
+}
+
+// The extension of a file of the format
+func (ef ExportFormat) extension() string {
+	if ef == EXPORT_TEXT {
+		return ".txt"
+	}
+	return "." + ef.String()
+}
+
+func ParseExportFormat(name string) (ExportFormat, error) {
+	switch strings.ToLower(name) {
+	case "jsonl", "json":
+		return EXPORT_JSONL, nil
+	case "csv":
+		return EXPORT_CSV, nil
+	case "text", "txt":
+		return EXPORT_TEXT, nil
+	}
+	return EXPORT_JSONL, fmt.Errorf("unknown export format %q, it must be jsonl, csv or text", name)
+}
+
+// Name of a file of logs exported at a time
+func ExportFileName(at time.Time, format ExportFormat) string {
+	return "lnbank-logs-" + at.Format("20060102-150405") + format.extension()
+}
+
+// Write the logs to out one by one, so any number of them can be exported,
+// redacting them first with r when it is not nil. It returns how many logs
+// were written.
+func ExportLogs(out io.Writer, logs iter.Seq2[Log, error], format ExportFormat, r *Redactor) (int, error) {
+	bw := bufio.NewWriter(out)
+	var cw *csv.Writer
+	if format == EXPORT_CSV {
+		cw = csv.NewWriter(bw)
+		if err := cw.Write([]string{"time", "type", "service", "subsystem", "category", "desc", "fields"}); err != nil {
+			return 0, err
+		}
+	}
+	n := 0
+	for l, err := range logs {
+		if err != nil {
+			return n, err
+		}
+		if r != nil {
+			l = r.redactLog(l)
+		}
+		switch format {
+		case EXPORT_CSV:
+			fields, err := l.fieldsJSON()
+			if err != nil {
+				return n, err
+			}
+			err = cw.Write([]string{l.date.Format(time.RFC3339Nano), l.logType.Name(), l.service,
+				l.subsystem, l.category(), l.desc, fields})
+			if err != nil {
+				return n, err
+			}
+		default:
+			if err := printLog(bw, &l, format == EXPORT_JSONL); err != nil {
+				return n, err
+			}
+		}
+		n++
+	}
+	if cw != nil {
+		cw.Flush()
+		if err := cw.Error(); err != nil {
+			return n, err
+		}
+	}
+	return n, bw.Flush()
+}
+
+// What a redaction rule finds in the logs, and whether a match is kept
+// as it is, such as the loopback addresses
+type redactRule struct {
+	kind string
+	re   *regexp.Regexp
+	keep func(match string) bool
+}
+
+// Replaces what identifies a node or its owner in the logs, such as keys,
+// addresses, invoices and hashes, by placeholders like <pubkey-1>. The same
+// value gets the same placeholder, so the logs can still be followed.
+type Redactor struct {
+	rules []redactRule
+	home  string
+	// placeholder of each value, and values of each kind
+	seen  map[string]string
+	kinds map[string]int
+}
+
+// The most specific rules go first, so a pubkey is not taken for a hash
+var redactRules = []redactRule{
+	{"invoice", regexp.MustCompile(`(?i)\bln(?:bcrt|bc|tbs|tb|sb)[0-9a-z]{20,}\b`), nil},
+	{"address", regexp.MustCompile(`(?i)\b(?:bc|tb|bcrt)1[02-9ac-hj-np-z]{8,87}\b`), nil},
+	{"onion", regexp.MustCompile(`(?i)\b[a-z2-7]{56}\.onion\b`), nil},
+	{"pubkey", regexp.MustCompile(`\b0[23][0-9a-fA-F]{64}\b`), nil},
+	{"secret", regexp.MustCompile(`\b[0-9a-fA-F]{100,}\b`), nil},
+	{"hash", regexp.MustCompile(`\b[0-9a-fA-F]{64}\b`), nil},
+	{"ip", regexp.MustCompile(`\b(?:\d{1,3}\.){3}\d{1,3}\b`), keepIP},
+	{"ip", regexp.MustCompile(`(?i)(?:[0-9a-f]{0,4}:){2,7}[0-9a-f]{0,4}`), keepIP},
+}
+
+// Loopback and unspecified addresses say nothing about the node, and what
+// is not an address, such as a time, is not one to redact
+func keepIP(match string) bool {
+	ip := net.ParseIP(match)
+	return ip == nil || ip.IsLoopback() || ip.IsUnspecified()
+}
+
+func NewRedactor() *Redactor {
+	home, _ := os.UserHomeDir()
+	return &Redactor{
+		rules: redactRules,
+		home:  home,
+		seen:  make(map[string]string),
+		kinds: make(map[string]int),
+	}
+}
+
+// The text with what it has to hide replaced, and the home directory by ~
+func (r *Redactor) redact(text string) string {
+	for _, rule := range r.rules {
+		text = rule.re.ReplaceAllStringFunc(text, func(match string) string {
+			if rule.keep != nil && rule.keep(match) {
+				return match
+			}
+			placeholder, ok := r.seen[match]
+			if !ok {
+				r.kinds[rule.kind]++
+				placeholder = "<" + rule.kind + "-" + strconv.Itoa(r.kinds[rule.kind]) + ">"
+				r.seen[match] = placeholder
+			}
+			return placeholder
+		})
+	}
+	if len(r.home) > 1 {
+		text = strings.ReplaceAll(text, r.home, "~")
+	}
+	return text
+}
+
+// A copy of the log with its description and fields redacted
+func (r *Redactor) redactLog(l Log) Log {
+	l.desc = r.redact(l.desc)
+	if l.fields != nil {
+		fields := make(map[string]string, len(l.fields))
+		for name, value := range l.fields {
+			fields[name] = r.redact(value)
+		}
+		l.fields = fields
+	}
+	return l
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseExportFormat(t *testing.T) {
+	for _, ef := range ExportFormats {
+		parsed, err := ParseExportFormat(strings.ToUpper(ef.String()))
+		assert.NoError(t, err)
+		assert.Equal(t, ef, parsed)
+	}
+	_, err := ParseExportFormat("xml")
+	assert.Error(t, err)
+	assert.Equal(t, "lnbank-logs-20240701-103000.txt",
+		ExportFileName(time.Date(2024, 7, 1, 10, 30, 0, 0, time.UTC), EXPORT_TEXT))
+}
+
+func TestExportLogs(t *testing.T) {
+	service := "export" + time.Now().Format("150405.000000000")
+	t.Cleanup(func() {
+		_, err := DB.Exec("DELETE FROM log WHERE service=?", service)
+		assert.NoError(t, err)
+	})
+	now := time.Now()
+	pubkey := "02" + strings.Repeat("ab", 32)
+	for i, desc := range []string{"first, \"quoted\"", "peer " + pubkey + " connected", "peer " + pubkey + " gone"} {
+		errs, fatal := LogToDb(&Log{date: now.Add(time.Duration(i) * time.Millisecond), logType: INFO,
+			service: service, subsystem: "PEER", desc: desc, fields: map[string]string{"n": "1"}})
+		assert.False(t, fatal, "%v", errs)
+	}
+	export := func(format ExportFormat, r *Redactor) string {
+		var out bytes.Buffer
+		n, err := ExportLogs(&out, SelectLogs().Since(time.Hour).Services(service).All(context.Background()), format, r)
+		assert.NoError(t, err)
+		assert.Equal(t, 3, n)
+		return out.String()
+	}
+
+	lines := strings.Split(strings.TrimSpace(export(EXPORT_JSONL, nil)), "\n")
+	if assert.Len(t, lines, 3) {
+		var l map[string]any
+		assert.NoError(t, json.Unmarshal([]byte(lines[2]), &l))
+		assert.Equal(t, "first, \"quoted\"", l["desc"])
+		assert.Equal(t, "PEER", l["subsystem"])
+		assert.Equal(t, map[string]any{"n": "1"}, l["fields"])
+	}
+
+	records, err := csv.NewReader(strings.NewReader(export(EXPORT_CSV, nil))).ReadAll()
+	assert.NoError(t, err)
+	if assert.Len(t, records, 4) {
+		assert.Equal(t, []string{"time", "type", "service", "subsystem", "category", "desc", "fields"}, records[0])
+		assert.Equal(t, []string{"INFO", service, "PEER", strings.ToLower(service), "first, \"quoted\"", `{"n":"1"}`},
+			records[3][1:])
+		date, err := time.Parse(time.RFC3339Nano, records[3][0])
+		assert.NoError(t, err)
+		assert.True(t, now.Equal(date))
+	}
+
+	text := export(EXPORT_TEXT, NewRedactor())
+	assert.NotContains(t, text, pubkey)
+	assert.Contains(t, text, "INFO "+service+" PEER: peer <pubkey-1> gone\n")
+	assert.Contains(t, text, "INFO "+service+" PEER: peer <pubkey-1> connected\n")
+}
+
+func TestRedactor(t *testing.T) {
+	r := NewRedactor()
+	pubkey := "03" + strings.Repeat("0f", 32)
+	hash := strings.Repeat("9c", 32)
+	for _, tt := range []struct {
+		text     string
+		redacted string
+	}{
+		{"peer " + pubkey + "@203.0.113.7:9735 connected", "peer <pubkey-1>@<ip-1>:9735 connected"},
+		{"payment " + hash + " settled", "payment <hash-1> settled"},
+		{"again " + pubkey + " and " + hash, "again <pubkey-1> and <hash-1>"},
+		{"sent to bc1qar0srrr7xfkvy5l643lydnw9re59gtzzwf5mdq", "sent to <address-1>"},
+		{"invoice lnbc2500u1pvjluezpp5qqqsyqcyq5rqwzqfqqqsyqcyq5rqwzqfqqqsyqcyq5rqwzqfqypq", "invoice <invoice-1>"},
+		{"onion " + strings.Repeat("a", 56) + ".onion:9735", "onion <onion-1>:9735"},
+		{"listening on 127.0.0.1:10009 and [::1]:8080, at 10:00:00", "listening on 127.0.0.1:10009 and [::1]:8080, at 10:00:00"},
+		{"peer at [2001:db8::7]:9735", "peer at [<ip-2>]:9735"},
+		{"macaroon " + strings.Repeat("0201", 30), "macaroon <secret-1>"},
+	} {
+		assert.Equal(t, tt.redacted, r.redact(tt.text))
+	}
+
+	home, err := os.UserHomeDir()
+	if err == nil && len(home) > 1 {
+		assert.Equal(t, "reading ~/LNBank/lnd/lnd.conf", r.redact("reading "+filepath.Join(home, "LNBank", "lnd", "lnd.conf")))
+	}
+
+	l := r.redactLog(Log{desc: "to " + pubkey, fields: map[string]string{"peer": pubkey}})
+	assert.Equal(t, "to <pubkey-1>", l.desc)
+	assert.Equal(t, map[string]string{"peer": "<pubkey-1>"}, l.fields)
+}
+
+func TestControlExport(t *testing.T) {
+	_, fatal := LogToDb(&Log{date: time.Now(), logType: ERROR, service: "test_export", desc: "export api log"})
+	assert.False(t, fatal)
+	t.Cleanup(func() {
+		_, err := DB.Exec("DELETE FROM log WHERE service='test_export'")
+		assert.NoError(t, err)
+	})
+	handler := controlHandler(newTestSupervisor(t), "secret")
+
+	req := httptest.NewRequest("GET", "/logs/export?format=csv&redact=true&last=1m&service=test_export", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Header().Get("Content-Type"), "text/csv")
+	assert.Contains(t, rec.Header().Get("Content-Disposition"), ".csv")
+	records, err := csv.NewReader(rec.Body).ReadAll()
+	assert.NoError(t, err)
+	if assert.Len(t, records, 2) {
+		assert.Equal(t, "export api log", records[1][5])
+	}
+
+	assert.Equal(t, http.StatusBadRequest, controlRequest(t, handler, "GET", "/logs/export?format=xml", "secret", nil))
+	assert.Equal(t, http.StatusBadRequest, controlRequest(t, handler, "GET", "/logs/export?redact=maybe", "secret", nil))
+}
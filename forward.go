@@ -0,0 +1,317 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Sockets of the local syslog daemon, the first one found is used
+var SyslogSockets = []string{"/dev/log", "/var/run/syslog", "/var/run/log"}
+
+// Socket of the native protocol of journald
+const JournalSocket = "/run/systemd/journal/socket"
+
+// Identifies LNBank in syslog and the journal
+const SyslogAppName = "lnbank"
+
+// Structured data id of the logs in syslog. 32473 is the enterprise number
+// reserved for examples, until LNBank has one.
+const SyslogDataId = "lnbank@32473"
+
+// The syslog facility of the logs, daemon
+const syslogFacility = 3
+
+// Severity of the logs for syslog and the journal, NORMAL being notice
+func syslogSeverity(lt LogType) int {
+	switch lt {
+	case FATAL:
+		return 2 // crit
+	case ERROR:
+		return 3 // err
+	case WARNING:
+		return 4 // warning
+	case INFO:
+		return 6 // info
+	case DEBUG:
+		return 7 // debug
+	}
+	return 5 // notice
+}
+
+// Which logs are forwarded: those at least as important as level, or as the
+// level of their service when it has one, FATAL being the most important.
+// The services of muted have none forwarded.
+type forwardFilter struct {
+	level    LogType
+	services map[string]LogType
+	muted    map[string]bool
+}
+
+// NORMAL logs count as INFO ones
+func forwardSeverity(lt LogType) LogType {
+	if lt == NORMAL {
+		return INFO
+	}
+	return lt
+}
+
+func (ff forwardFilter) forwards(l *Log) bool {
+	if ff.muted[l.service] {
+		return false
+	}
+	level, ok := ff.services[l.service]
+	if !ok {
+		level = ff.level
+	}
+	return forwardSeverity(l.logType) <= forwardSeverity(level)
+}
+
+// Read the filter of a forwarding sink such as "syslog" from the config
+// table: <name>_level of the "log" service, INFO by default, and
+// <name>_level of any other service for its own logs, "none" for none of
+// them
+func readForwardFilter(name string) (forwardFilter, error) {
+	ff := forwardFilter{level: INFO, services: make(map[string]LogType), muted: make(map[string]bool)}
+	var errs []error
+	value, err := ReadConfig(name+"_level", "log", strings.ToLower(LogType(INFO).Name()))
+	errs = append(errs, err)
+	if lt, err := ParseLogType(fmt.Sprint(value)); err != nil {
+		errs = append(errs, fmt.Errorf("%v_level of log: %w", name, err))
+	} else {
+		ff.level = lt
+	}
+
+	rows, err := DB.QueryContext(ServicesContext,
+		"SELECT service, value FROM config WHERE name = ? AND service != 'log'", name+"_level")
+	if err != nil {
+		return ff, errors.Join(append(errs, err)...)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var service, value string
+		if err := rows.Scan(&service, &value); err != nil {
+			return ff, errors.Join(append(errs, err)...)
+		}
+		if strings.EqualFold(value, "none") {
+			ff.muted[service] = true
+			continue
+		}
+		lt, err := ParseLogType(value)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%v_level of %v: %w", name, service, err))
+			continue
+		}
+		ff.services[service] = lt
+	}
+	errs = append(errs, rows.Err())
+	return ff, errors.Join(errs...)
+}
+
+// Sends the logs passing its filter as datagrams to a unix socket, such as
+// the one of syslog, dialing it again when it fails as the daemon behind it
+// may have been restarted
+type socketSink struct {
+	socket string
+	filter forwardFilter
+	format func(l *Log) []byte
+	conn   net.Conn
+}
+
+func newSocketSink(socket string, filter forwardFilter, format func(l *Log) []byte) (*socketSink, error) {
+	ss := &socketSink{socket: socket, filter: filter, format: format}
+	return ss, ss.dial()
+}
+
+func (ss *socketSink) dial() error {
+	conn, err := net.Dial("unixgram", ss.socket)
+	if err != nil {
+		return err
+	}
+	ss.conn = conn
+	return nil
+}
+
+func (ss *socketSink) write(l *Log) error {
+	if !ss.filter.forwards(l) {
+		return nil
+	}
+	message := ss.format(l)
+	if ss.conn != nil {
+		if _, err := ss.conn.Write(message); err == nil {
+			return nil
+		}
+		ss.conn.Close()
+		ss.conn = nil
+	}
+	if err := ss.dial(); err != nil {
+		return err
+	}
+	_, err := ss.conn.Write(message)
+	return err
+}
+
+func (ss *socketSink) close() error {
+	if ss.conn == nil {
+		return nil
+	}
+	return ss.conn.Close()
+}
+
+// A log as an RFC 5424 syslog message, with the service as message id and
+// the service, subsystem, category and fields as structured data
+func syslogMessage(l *Log, hostname string, pid int) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "<%d>1 %v %v %v %d %v [%v",
+		syslogFacility*8+syslogSeverity(l.logType), l.date.UTC().Format(time.RFC3339Nano),
+		syslogName(hostname, 255), SyslogAppName, pid, syslogName(l.service, 32), SyslogDataId)
+	param := func(name string, value string) {
+		fmt.Fprintf(&b, ` %v="%v"`, syslogParamName(name), syslogParamValue.Replace(value))
+	}
+	param("service", l.service)
+	if l.subsystem != "" {
+		param("subsystem", l.subsystem)
+	}
+	param("category", l.category())
+	names := make([]string, 0, len(l.fields))
+	for name := range l.fields {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		param(name, l.fields[name])
+	}
+	b.WriteString("] ")
+	b.WriteString(l.desc)
+	return b.Bytes()
+}
+
+// A header field of printable ASCII without spaces, "-" when empty
+func syslogName(name string, max int) string {
+	name = strings.Map(func(r rune) rune {
+		if r <= ' ' || r > '~' {
+			return '_'
+		}
+		return r
+	}, name)
+	if name == "" {
+		return "-"
+	}
+	if len(name) > max {
+		return name[:max]
+	}
+	return name
+}
+
+// A parameter name is a syslog name without "=", "]", '"' nor spaces
+func syslogParamName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '=' || r == ']' || r == '"' {
+			return '_'
+		}
+		return r
+	}, syslogName(name, 32))
+}
+
+var syslogParamValue = strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`)
+
+// A log in the native protocol of journald: MESSAGE, PRIORITY,
+// SYSLOG_IDENTIFIER, SERVICE, SUBSYSTEM, CATEGORY and a FIELD_<NAME> for
+// each of its fields
+func journalMessage(l *Log) []byte {
+	var b bytes.Buffer
+	field := func(name string, value string) {
+		if !strings.Contains(value, "\n") {
+			b.WriteString(name + "=" + value + "\n")
+			return
+		}
+		// values of several lines go with their size before them
+		b.WriteString(name + "\n")
+		_ = binary.Write(&b, binary.LittleEndian, uint64(len(value)))
+		b.WriteString(value + "\n")
+	}
+	field("MESSAGE", l.desc)
+	field("PRIORITY", fmt.Sprint(syslogSeverity(l.logType)))
+	field("SYSLOG_IDENTIFIER", SyslogAppName)
+	field("SYSLOG_FACILITY", fmt.Sprint(syslogFacility))
+	field("SERVICE", l.service)
+	if l.subsystem != "" {
+		field("SUBSYSTEM", l.subsystem)
+	}
+	field("CATEGORY", l.category())
+	names := make([]string, 0, len(l.fields))
+	for name := range l.fields {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		field("FIELD_"+journalName(name), l.fields[name])
+	}
+	return b.Bytes()
+}
+
+// A journal field name has only uppercase letters, digits and underscores
+func journalName(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+// Register the syslog and journald sinks enabled by setting syslog or
+// journald to true for the "log" service in the config table. syslog_socket
+// and journald_socket change where they send the logs.
+func registerForwardSinks(bus *LogBus) error {
+	hostname, _ := os.Hostname()
+	pid := os.Getpid()
+	var errs []error
+	for _, fw := range []struct {
+		name    string
+		sockets []string
+		format  func(l *Log) []byte
+	}{
+		{"syslog", SyslogSockets, func(l *Log) []byte { return syslogMessage(l, hostname, pid) }},
+		{"journald", []string{JournalSocket}, journalMessage},
+	} {
+		enabled, err := ReadConfig(fw.name, "log", "false")
+		errs = append(errs, err)
+		if on, _ := strconv.ParseBool(fmt.Sprint(enabled)); !on {
+			continue
+		}
+		filter, err := readForwardFilter(fw.name)
+		errs = append(errs, err)
+		socket, err := ReadConfig(fw.name+"_socket", "log", "")
+		errs = append(errs, err)
+		sockets := fw.sockets
+		if s := fmt.Sprint(socket); s != "" {
+			sockets = []string{s}
+		}
+		i := slices.IndexFunc(sockets, func(s string) bool {
+			_, err := os.Stat(s)
+			return err == nil
+		})
+		if i < 0 {
+			errs = append(errs, fmt.Errorf("cannot forward the logs to %v: no socket in %v", fw.name, strings.Join(sockets, ", ")))
+			continue
+		}
+		sink, err := newSocketSink(sockets[i], filter, fw.format)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("cannot forward the logs to %v: %w", fw.name, err))
+			continue
+		}
+		bus.register(fw.name, sink, 1000, DROP_NEWEST)
+	}
+	return errors.Join(errs...)
+}
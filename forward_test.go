@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSyslogMessage(t *testing.T) {
+	l := &Log{
+		date:      time.Date(2024, 3, 1, 12, 30, 0, 5000, time.UTC),
+		logType:   WARNING,
+		service:   "Lnd",
+		subsystem: "HSWC",
+		desc:      "link failed",
+		fields:    map[string]string{"peer": `a"b]c\d`},
+	}
+	assert.Equal(t, `<28>1 2024-03-01T12:30:00.000005Z my_host lnbank 42 Lnd [lnbank@32473 service="Lnd" `+
+		`subsystem="HSWC" category="htlc" peer="a\"b\]c\\d"] link failed`,
+		string(syslogMessage(l, "my host", 42)))
+
+	l = &Log{date: l.date, logType: FATAL, service: "", desc: "down"}
+	assert.Contains(t, string(syslogMessage(l, "", 1)), "<26>1 2024-03-01T12:30:00.000005Z - lnbank 1 - [")
+}
+
+func TestJournalMessage(t *testing.T) {
+	l := &Log{
+		logType:   ERROR,
+		service:   "Lnd",
+		subsystem: "HSWC",
+		desc:      "link failed",
+		fields:    map[string]string{"chan-id": "123", "trace": "a\nb"},
+	}
+	var multiline bytes.Buffer
+	multiline.WriteString("FIELD_TRACE\n")
+	binary.Write(&multiline, binary.LittleEndian, uint64(3))
+	multiline.WriteString("a\nb\n")
+	assert.Equal(t, "MESSAGE=link failed\nPRIORITY=3\nSYSLOG_IDENTIFIER=lnbank\nSYSLOG_FACILITY=3\n"+
+		"SERVICE=Lnd\nSUBSYSTEM=HSWC\nCATEGORY=htlc\nFIELD_CHAN_ID=123\n"+multiline.String(),
+		string(journalMessage(l)))
+}
+
+func TestForwardFilter(t *testing.T) {
+	ff := forwardFilter{
+		level:    WARNING,
+		services: map[string]LogType{"Lnd": DEBUG, "Tor": ERROR},
+		muted:    map[string]bool{"Bitcoind": true},
+	}
+	assert.True(t, ff.forwards(&Log{logType: WARNING, service: "LNBank"}))
+	assert.True(t, ff.forwards(&Log{logType: FATAL, service: "LNBank"}))
+	assert.False(t, ff.forwards(&Log{logType: INFO, service: "LNBank"}))
+	assert.False(t, ff.forwards(&Log{logType: NORMAL, service: "LNBank"}))
+	assert.True(t, ff.forwards(&Log{logType: DEBUG, service: "Lnd"}))
+	assert.True(t, ff.forwards(&Log{logType: NORMAL, service: "Lnd"}))
+	assert.False(t, ff.forwards(&Log{logType: WARNING, service: "Tor"}))
+	assert.False(t, ff.forwards(&Log{logType: FATAL, service: "Bitcoind"}))
+	// NORMAL logs go with INFO ones
+	assert.True(t, forwardFilter{level: INFO}.forwards(&Log{logType: NORMAL}))
+	assert.True(t, forwardFilter{level: NORMAL}.forwards(&Log{logType: INFO}))
+	assert.False(t, forwardFilter{level: NORMAL}.forwards(&Log{logType: DEBUG}))
+}
+
+func TestReadForwardFilter(t *testing.T) {
+	const name = "test_forward"
+	defer func() {
+		_, err := DB.Exec("DELETE FROM config WHERE name=?", name+"_level")
+		assert.NoError(t, err)
+	}()
+	ff, err := readForwardFilter(name)
+	assert.NoError(t, err)
+	assert.Equal(t, LogType(INFO), ff.level)
+	assert.Empty(t, ff.services)
+
+	assert.NoError(t, SetConfig(name+"_level", "log", "error"))
+	assert.NoError(t, SetConfig(name+"_level", "test_forward_lnd", "debug"))
+	assert.NoError(t, SetConfig(name+"_level", "test_forward_tor", "none"))
+	assert.NoError(t, SetConfig(name+"_level", "test_forward_bad", "loud"))
+	ff, err = readForwardFilter(name)
+	assert.ErrorContains(t, err, "test_forward_level of test_forward_bad")
+	assert.Equal(t, LogType(ERROR), ff.level)
+	assert.Equal(t, map[string]LogType{"test_forward_lnd": DEBUG}, ff.services)
+	assert.Equal(t, map[string]bool{"test_forward_tor": true}, ff.muted)
+}
+
+func TestSocketSink(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("no unix datagram sockets")
+	}
+	// the path of a unix socket must be short
+	dir, err := os.MkdirTemp("", "lnbank")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "log")
+	listen := func() *net.UnixConn {
+		conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socket, Net: "unixgram"})
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		return conn
+	}
+	read := func(conn *net.UnixConn) string {
+		conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+		buf := make([]byte, 4096)
+		n, err := conn.Read(buf)
+		assert.NoError(t, err)
+		return string(buf[:n])
+	}
+
+	server := listen()
+	sink, err := newSocketSink(socket, forwardFilter{level: WARNING}, func(l *Log) []byte { return []byte(l.desc) })
+	assert.NoError(t, err)
+	defer sink.close()
+	assert.NoError(t, sink.write(&Log{logType: INFO, desc: "quiet"}))
+	assert.NoError(t, sink.write(&Log{logType: ERROR, desc: "loud"}))
+	assert.Equal(t, "loud", read(server))
+
+	// the daemon restarted
+	server.Close()
+	os.Remove(socket)
+	server = listen()
+	defer server.Close()
+	assert.NoError(t, sink.write(&Log{logType: WARNING, desc: "again"}))
+	assert.Equal(t, "again", read(server))
+
+	_, err = newSocketSink(filepath.Join(dir, "none"), forwardFilter{}, journalMessage)
+	assert.Error(t, err)
+}
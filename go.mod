@@ -1,12 +1,13 @@
 module github.com/JaviLib/LNBank
 
-go 1.22.4
+go 1.23.0
 
 require (
 	fyne.io/fyne/v2 v2.4.5
 	github.com/mattn/go-sqlite3 v1.14.22
 	github.com/stretchr/testify v1.8.4
 	golang.org/x/exp v0.0.0-20200224162631-6cc2880d07d6
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
@@ -34,6 +35,5 @@ require (
 	golang.org/x/net v0.17.0 // indirect
 	golang.org/x/sys v0.13.0 // indirect
 	golang.org/x/text v0.13.0 // indirect
-	gopkg.in/yaml.v3 v3.0.1 // indirect
 	honnef.co/go/js/dom v0.0.0-20210725211120-f030747120f2 // indirect
 )
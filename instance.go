@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Held while LNBank runs, so only one instance uses ServiceRootDir
+var instanceLock *os.File
+
+// Lock the directory of a profile for this process. It fails if another
+// LNBank is running with the same directory.
+func LockInstance(dir string) error {
+	file := filepath.Join(dir, "lnbank.lock")
+	f, err := os.OpenFile(file, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	content, _ := io.ReadAll(f)
+	other, _ := strconv.Atoi(strings.TrimSpace(string(content)))
+	if err := lockFile(f, other); err != nil {
+		f.Close()
+		if other != 0 {
+			return fmt.Errorf("LNBank is already running with pid %v on %v", other, dir)
+		}
+		return fmt.Errorf("LNBank is already running on %v: %w", dir, err)
+	}
+	if err := f.Truncate(0); err != nil {
+		f.Close()
+		return err
+	}
+	if _, err := f.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0); err != nil {
+		f.Close()
+		return err
+	}
+	instanceLock = f
+	return nil
+}
+
+// What to do at startup with a process left running by a previous LNBank
+type OrphanPolicy int8
+
+const (
+	// shut it down cleanly and start a new one
+	ORPHAN_STOP OrphanPolicy = iota
+	// keep it running, following its log file and monitoring it
+	ORPHAN_ADOPT
+)
+
+func (op OrphanPolicy) String() string {
+	if op == ORPHAN_ADOPT {
+		return "adopt"
+	}
+	return "stop"
+}
+
+func ParseOrphanPolicy(policy string) (OrphanPolicy, error) {
+	switch policy {
+	case "stop":
+		return ORPHAN_STOP, nil
+	case "adopt":
+		return ORPHAN_ADOPT, nil
+	}
+	return ORPHAN_STOP, fmt.Errorf("unknown orphan policy %q", policy)
+}
+
+// Read the orphan policy of a service from the config table
+func ReadOrphanPolicy(service string) (OrphanPolicy, error) {
+	value, err := ReadConfig("orphans", service, ORPHAN_STOP.String())
+	if err != nil {
+		return ORPHAN_STOP, err
+	}
+	return ParseOrphanPolicy(fmt.Sprint(value))
+}
+
+// Services that write their logs to a file too, so they can be followed when
+// adopted
+type logFileService interface {
+	logFile() string
+}
+
+// File with the pid and the executable of the running process of a service
+func PidFile(service string) string {
+	return filepath.Join(ServiceRootDir, "run", service+".pid")
+}
+
+func WritePidFile(service string, pid int, exe string) error {
+	if err := os.MkdirAll(filepath.Dir(PidFile(service)), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(PidFile(service), []byte(fmt.Sprintf("%v\n%v\n", pid, exe)), 0644)
+}
+
+func RemovePidFile(service string) error {
+	err := os.Remove(PidFile(service))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// The process of a service left running by a previous LNBank, or nil. Stale
+// pid files are removed.
+func FindOrphan(service string) *os.Process {
+	content, err := os.ReadFile(PidFile(service))
+	if err != nil {
+		return nil
+	}
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	pid, err := strconv.Atoi(lines[0])
+	if err != nil || pid <= 0 || !processAlive(pid) {
+		_ = RemovePidFile(service)
+		return nil
+	}
+	// the pid may have been reused by something else
+	if exe, err := processExe(pid); err == nil && len(lines) > 1 && !sameFile(exe, lines[1]) {
+		_ = RemovePidFile(service)
+		return nil
+	}
+	proc, err := os.FindProcess(pid)
+	if err != nil {
+		return nil
+	}
+	return proc
+}
+
+func sameFile(a string, b string) bool {
+	sa, err1 := os.Stat(a)
+	sb, err2 := os.Stat(b)
+	if err1 != nil || err2 != nil {
+		return a == b
+	}
+	return os.SameFile(sa, sb)
+}
+
+// Closed when a process that is not our child exits
+func watchProcess(pid int) <-chan struct{} {
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		for processAlive(pid) {
+			time.Sleep(time.Millisecond * 500)
+		}
+	}()
+	return exited
+}
+
+// Deal with the process of service left running by a previous LNBank, if
+// any, following its orphan policy. It must be called from the start method
+// of the service, before checking its ports. When the process is adopted it
+// returns its exit log once it exits or ctx is done, and true.
+func HandleOrphan(ctx context.Context, service Service) (*Log, bool) {
+	name := service.name()
+	onLog := service.onLogHook()
+	proc := FindOrphan(name)
+	if proc == nil {
+		return nil, false
+	}
+	policy, err := ReadOrphanPolicy(name)
+	if err != nil {
+		onLog(service.fmtLog(WARNING, "cannot read orphans policy of "+name+": "+err.Error()))
+	}
+	if policy == ORPHAN_ADOPT {
+		return AdoptProcess(ctx, service, proc), true
+	}
+	onLog(service.fmtLog(WARNING, fmt.Sprintf("%v was left running with pid %v, stopping it", name, proc.Pid)))
+	exited := watchProcess(proc.Pid)
+	StopCommand(service, &exec.Cmd{Process: proc}, exited)
+	<-exited
+	_ = RemovePidFile(name)
+	return nil, false
+}
+
+// Supervise a process left by a previous LNBank as if it had been started by
+// this one: follow its log file, monitor its resources and stop it when ctx
+// is done. It returns the log of its exit, like ScanCommand.
+func AdoptProcess(ctx context.Context, service Service, proc *os.Process) *Log {
+	name := service.name()
+	onLog := service.onLogHook()
+	exited := watchProcess(proc.Pid)
+	go MonitorProcess(ctx, service, proc.Pid, exited)
+	if lfs, ok := service.(logFileService); ok {
+		// only what it logs from now on
+		f, err := os.Open(lfs.logFile())
+		if err == nil {
+			_, err = f.Seek(0, io.SeekEnd)
+		}
+		if err != nil {
+			onLog(service.fmtLog(WARNING, "cannot follow the log file of "+name+": "+err.Error()))
+		} else {
+			go tailLogFile(f, service, onLog, exited)
+		}
+	}
+	onLog(service.fmtLog(INFO, fmt.Sprintf("adopted %v left running with pid %v", name, proc.Pid)))
+	// it was running before, so it is ready
+	service.onReadyHook()()
+
+	select {
+	case <-exited:
+		_ = RemovePidFile(name)
+		return service.fmtLog(FATAL, name+" exited")
+	case <-ctx.Done():
+		StopCommand(service, &exec.Cmd{Process: proc}, exited)
+		<-exited
+		_ = RemovePidFile(name)
+		return service.fmtLog(INFO, "exit")
+	}
+}
+
+// Send the lines appended to a log file to onLog until exited is closed
+func tailLogFile(f *os.File, service Service, onLog func(*Log), exited <-chan struct{}) {
+	defer f.Close()
+	reader := bufio.NewReader(f)
+	ticker := time.NewTicker(time.Millisecond * 500)
+	defer ticker.Stop()
+	var partial string
+	for {
+		line, err := reader.ReadString('\n')
+		partial += line
+		if err == nil {
+			l, err := service.parseLogEntry(strings.TrimRight(partial, "\r\n"))
+			if err == nil {
+				onLog(&l)
+			}
+			partial = ""
+			continue
+		}
+		if !errors.Is(err, io.EOF) {
+			onLog(service.fmtLog(WARNING, "cannot follow "+f.Name()+": "+err.Error()))
+			return
+		}
+		select {
+		case <-exited:
+			return
+		case <-ticker.C:
+		}
+	}
+}
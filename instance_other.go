@@ -0,0 +1,26 @@
+//go:build !unix
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+// Without flock, trust the pid stored in the lock file by the other instance
+func lockFile(f *os.File, other int) error {
+	if other != 0 && other != os.Getpid() && processAlive(other) {
+		return errors.New("locked")
+	}
+	return nil
+}
+
+// TODO check it properly on Windows, where FindProcess opens the process
+func processAlive(pid int) bool {
+	proc, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	proc.Release()
+	return true
+}
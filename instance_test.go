@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOrphanPolicy(t *testing.T) {
+	for _, op := range []OrphanPolicy{ORPHAN_STOP, ORPHAN_ADOPT} {
+		parsed, err := ParseOrphanPolicy(op.String())
+		assert.NoError(t, err)
+		assert.Equal(t, op, parsed)
+	}
+	_, err := ParseOrphanPolicy("ignore")
+	assert.Error(t, err)
+}
+
+// A service whose hooks are set, as they are inside its start method
+type hookedService struct {
+	fakeService
+	onReady func()
+	onLog   func(*Log)
+	file    string
+}
+
+func (hs hookedService) onLogHook() func(*Log) { return hs.onLog }
+func (hs hookedService) onReadyHook() func()   { return hs.onReady }
+func (hs hookedService) logFile() string       { return hs.file }
+func (hs hookedService) shutdown(*exec.Cmd) error {
+	return fmt.Errorf("no clean shutdown")
+}
+
+// Start a process that stays running, as the process of a crashed LNBank
+func startOrphan(t *testing.T, service string) *exec.Cmd {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("needs sleep")
+	}
+	cmd := exec.Command("sleep", "30")
+	assert.NoError(t, cmd.Start())
+	// reap it, as init would do with a real orphan
+	go cmd.Wait()
+	t.Cleanup(func() { _ = cmd.Process.Kill() })
+	assert.NoError(t, WritePidFile(service, cmd.Process.Pid, cmd.Path))
+	t.Cleanup(func() { _ = RemovePidFile(service) })
+	return cmd
+}
+
+func TestFindOrphan(t *testing.T) {
+	service := fmt.Sprintf("orphantest%v", time.Now().UnixNano())
+	assert.Nil(t, FindOrphan(service))
+
+	// a stale pid file is removed
+	assert.NoError(t, WritePidFile(service, 999999999, "/bin/sh"))
+	assert.Nil(t, FindOrphan(service))
+	_, err := os.Stat(PidFile(service))
+	assert.True(t, os.IsNotExist(err))
+
+	cmd := startOrphan(t, service)
+	if proc := FindOrphan(service); assert.NotNil(t, proc) {
+		assert.Equal(t, cmd.Process.Pid, proc.Pid)
+	}
+}
+
+func TestHandleOrphan(t *testing.T) {
+	service := fmt.Sprintf("orphantest%v", time.Now().UnixNano())
+	var mutex sync.Mutex
+	var logs []string
+	hs := hookedService{
+		fakeService: fakeService{n: service},
+		onLog: func(l *Log) {
+			mutex.Lock()
+			logs = append(logs, l.desc)
+			mutex.Unlock()
+		},
+		file: filepath.Join(t.TempDir(), "orphan.log"),
+	}
+	assert.NoError(t, os.WriteFile(hs.file, []byte("old line\n"), 0644))
+
+	// stopped by default
+	startOrphan(t, service)
+	_, adopted := HandleOrphan(context.Background(), hs)
+	assert.False(t, adopted)
+	assert.Nil(t, FindOrphan(service))
+
+	// adopted: its log file is followed until it is stopped
+	assert.NoError(t, SetConfig("orphans", service, "adopt"))
+	startOrphan(t, service)
+	ready := make(chan struct{})
+	hs.onReady = func() { close(ready) }
+	ctx, cancel := context.WithCancel(context.Background())
+	exit := make(chan *Log)
+	go func() {
+		l, adopted := HandleOrphan(ctx, hs)
+		assert.True(t, adopted)
+		exit <- l
+	}()
+	<-ready
+	f, err := os.OpenFile(hs.file, os.O_APPEND|os.O_WRONLY, 0644)
+	assert.NoError(t, err)
+	_, err = f.WriteString("new line\n")
+	assert.NoError(t, err)
+	f.Close()
+	assert.Eventually(t, func() bool {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return slices.Contains(logs, "new line")
+	}, time.Second*5, time.Millisecond*50)
+
+	cancel()
+	l := <-exit
+	assert.Equal(t, LogType(INFO), l.logType)
+	assert.Nil(t, FindOrphan(service))
+	mutex.Lock()
+	assert.NotContains(t, logs, "old line")
+	mutex.Unlock()
+}
+
+func TestLockInstance(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the lock is per process there")
+	}
+	if instanceLock == nil {
+		assert.NoError(t, LockInstance(ServiceRootDir))
+	}
+	// another process cannot take it
+	cmd := exec.Command(os.Args[0], "-test.run=TestLockInstanceHelper")
+	// each test process has a root of its own
+	cmd.Env = append(os.Environ(), "LNBANK_LOCK_HELPER="+ServiceRootDir)
+	output, err := cmd.CombinedOutput()
+	assert.NoError(t, err, string(output))
+	assert.Contains(t, string(output), "already running")
+}
+
+func TestLockInstanceHelper(t *testing.T) {
+	dir := os.Getenv("LNBANK_LOCK_HELPER")
+	if dir == "" {
+		t.Skip("run by TestLockInstance")
+	}
+	err := LockInstance(dir)
+	assert.Error(t, err)
+	if err != nil {
+		fmt.Println(err)
+	}
+}
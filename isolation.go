@@ -0,0 +1,159 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// How a service process is run so it does not disturb the rest of the
+// computer: its priority, limits, environment and directory
+type Isolation struct {
+	// 0 to 19, the higher the less CPU it gets when the computer is busy
+	nice int
+	// I/O priority as "idle", "best-effort:0" to "best-effort:7" or "" to
+	// inherit it
+	ionice string
+	// limits of open files and of data memory in MB, 0 inherits them
+	maxFiles    uint64
+	maxMemoryMB uint64
+	// names of the environment variables the process gets from LNBank
+	env []string
+	// working directory, when the command doesn't set one
+	workDir string
+	umask   uint32
+	// on Linux, run it in its own cgroup with systemd-run --user, with the
+	// given CPUQuota and MemoryMax when not empty
+	cgroup    bool
+	cpuQuota  string
+	memoryMax string
+}
+
+var DefaultIsolation = Isolation{
+	nice:     10,
+	ionice:   "best-effort:7",
+	maxFiles: 8192,
+	env: []string{
+		"PATH", "HOME", "USER", "LOGNAME", "LANG", "LC_ALL", "LC_CTYPE", "TZ",
+		"TMPDIR", "TEMP", "TMP", "XDG_RUNTIME_DIR", "DBUS_SESSION_BUS_ADDRESS",
+		"SYSTEMROOT", "WINDIR", "APPDATA", "LOCALAPPDATA", "USERPROFILE",
+	},
+	umask: 0077,
+}
+
+// Read the isolation of a service from the config table. Its default working
+// directory is the one with its name under ServiceRootDir.
+func ReadIsolation(service string) (Isolation, error) {
+	iso := DefaultIsolation
+	iso.workDir = filepath.Join(ServiceRootDir, strings.ToLower(service))
+	var errs []error
+	var err error
+
+	iso.nice, err = ReadIntConfig("nice", service, iso.nice)
+	errs = append(errs, err)
+	if iso.nice < 0 || iso.nice > 19 {
+		errs = append(errs, fmt.Errorf("nice of %v must be between 0 and 19", service))
+		iso.nice = DefaultIsolation.nice
+	}
+
+	value, err := ReadConfig("ionice", service, iso.ionice)
+	errs = append(errs, err)
+	iso.ionice = fmt.Sprint(value)
+	if _, _, err := parseIonice(iso.ionice); err != nil {
+		errs = append(errs, fmt.Errorf("ionice of %v: %w", service, err))
+		iso.ionice = DefaultIsolation.ionice
+	}
+
+	files, err := ReadIntConfig("max_open_files", service, int(iso.maxFiles))
+	errs = append(errs, err)
+	iso.maxFiles = uint64(max(files, 0))
+	memory, err := ReadIntConfig("max_memory_mb", service, int(iso.maxMemoryMB))
+	errs = append(errs, err)
+	iso.maxMemoryMB = uint64(max(memory, 0))
+
+	value, err = ReadConfig("env_allow", service, strings.Join(iso.env, ","))
+	errs = append(errs, err)
+	iso.env = nil
+	for _, name := range strings.Split(fmt.Sprint(value), ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			iso.env = append(iso.env, name)
+		}
+	}
+
+	value, err = ReadConfig("workdir", service, iso.workDir)
+	errs = append(errs, err)
+	iso.workDir = fmt.Sprint(value)
+
+	value, err = ReadConfig("umask", service, fmt.Sprintf("%04o", iso.umask))
+	errs = append(errs, err)
+	if umask, err := strconv.ParseUint(fmt.Sprint(value), 8, 32); err != nil || umask > 0777 {
+		errs = append(errs, fmt.Errorf("umask of %v must be octal like 0077", service))
+	} else {
+		iso.umask = uint32(umask)
+	}
+
+	value, err = ReadConfig("cgroup", service, strconv.FormatBool(iso.cgroup))
+	errs = append(errs, err)
+	if iso.cgroup, err = strconv.ParseBool(fmt.Sprint(value)); err != nil {
+		errs = append(errs, fmt.Errorf("cgroup of %v: %w", service, err))
+	}
+	value, err = ReadConfig("cgroup_cpu_quota", service, iso.cpuQuota)
+	errs = append(errs, err)
+	iso.cpuQuota = fmt.Sprint(value)
+	value, err = ReadConfig("cgroup_memory_max", service, iso.memoryMax)
+	errs = append(errs, err)
+	iso.memoryMax = fmt.Sprint(value)
+
+	return iso, errors.Join(errs...)
+}
+
+// Split "best-effort:7" into its class and level
+func parseIonice(ionice string) (class string, level int, err error) {
+	class, lvl, found := strings.Cut(ionice, ":")
+	switch class {
+	case "":
+		return "", 0, nil
+	case "idle":
+		return class, 0, nil
+	case "best-effort", "realtime":
+		if !found {
+			return class, 4, nil
+		}
+		level, err = strconv.Atoi(lvl)
+		if err != nil || level < 0 || level > 7 {
+			return class, 0, fmt.Errorf("level of %q must be between 0 and 7", ionice)
+		}
+		return class, level, nil
+	}
+	return "", 0, fmt.Errorf("unknown class %q", class)
+}
+
+// Only the allowed variables of environ
+func scrubEnv(environ []string, allow []string) []string {
+	env := make([]string, 0, len(allow))
+	for _, kv := range environ {
+		name, _, _ := strings.Cut(kv, "=")
+		if slices.Contains(allow, name) {
+			env = append(env, kv)
+		}
+	}
+	return env
+}
+
+// Apply the isolation to a command before starting it. The variables already
+// in cmd.Env are kept, after the allowed ones from the environment of LNBank.
+func Isolate(cmd *exec.Cmd, service string, iso Isolation) error {
+	cmd.Env = append(scrubEnv(os.Environ(), iso.env), cmd.Env...)
+	if cmd.Dir == "" && iso.workDir != "" {
+		if err := os.MkdirAll(iso.workDir, 0755); err != nil {
+			return err
+		}
+		cmd.Dir = iso.workDir
+	}
+	return wrapCommand(cmd, service, iso)
+}
@@ -0,0 +1,10 @@
+//go:build !unix
+
+package main
+
+import "os/exec"
+
+// TODO set the priority and limits on Windows with a job object
+func wrapCommand(cmd *exec.Cmd, service string, iso Isolation) error {
+	return nil
+}
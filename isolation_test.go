@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseIonice(t *testing.T) {
+	class, level, err := parseIonice("best-effort:7")
+	assert.NoError(t, err)
+	assert.Equal(t, "best-effort", class)
+	assert.Equal(t, 7, level)
+	class, _, err = parseIonice("idle")
+	assert.NoError(t, err)
+	assert.Equal(t, "idle", class)
+	_, _, err = parseIonice("best-effort:9")
+	assert.Error(t, err)
+	_, _, err = parseIonice("fast")
+	assert.Error(t, err)
+}
+
+func TestReadIsolation(t *testing.T) {
+	service := fmt.Sprintf("isotest%v", time.Now().UnixNano())
+	iso, err := ReadIsolation(service)
+	assert.NoError(t, err)
+	assert.Equal(t, DefaultIsolation.nice, iso.nice)
+	assert.Equal(t, DefaultIsolation.env, iso.env)
+	assert.Equal(t, uint32(0077), iso.umask)
+
+	assert.NoError(t, SetConfig("nice", service, 19))
+	assert.NoError(t, SetConfig("env_allow", service, "PATH, HOME"))
+	assert.NoError(t, SetConfig("umask", service, "0022"))
+	assert.NoError(t, SetConfig("ionice", service, "fast"))
+	iso, err = ReadIsolation(service)
+	assert.ErrorContains(t, err, "ionice")
+	assert.Equal(t, 19, iso.nice)
+	assert.Equal(t, []string{"PATH", "HOME"}, iso.env)
+	assert.Equal(t, uint32(0022), iso.umask)
+	assert.Equal(t, DefaultIsolation.ionice, iso.ionice)
+}
+
+func TestIsolate(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("needs sh")
+	}
+	t.Setenv("LNBANK_SECRET", "do not leak")
+	t.Setenv("LNBANK_ALLOWED", "fine")
+	dir := t.TempDir()
+	iso := Isolation{
+		nice:     5,
+		maxFiles: 512,
+		env:      []string{"PATH", "LNBANK_ALLOWED"},
+		workDir:  dir,
+		umask:    0027,
+	}
+	cmd := exec.Command("sh", "-c", `umask; ulimit -n; pwd; echo "$LNBANK_ALLOWED $LNBANK_SECRET $EXTRA"`)
+	cmd.Env = []string{"EXTRA=extra"}
+	assert.NoError(t, Isolate(cmd, "isotest", iso))
+	output, err := cmd.CombinedOutput()
+	assert.NoError(t, err, string(output))
+	lines := strings.Split(strings.TrimSpace(string(output)), "\n")
+	if assert.Len(t, lines, 4, string(output)) {
+		assert.Equal(t, "0027", lines[0])
+		assert.Equal(t, "512", lines[1])
+		assert.True(t, sameFile(dir, lines[2]), lines[2])
+		assert.Equal(t, "fine  extra", lines[3])
+	}
+}
+
+func TestIsolateLimitFailed(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("needs sh")
+	}
+	// more open files than any system allows
+	iso := Isolation{maxFiles: 1 << 40, env: []string{"PATH"}, workDir: t.TempDir(), umask: 0077}
+	cmd := exec.Command("sh", "-c", "echo started")
+	assert.NoError(t, Isolate(cmd, "isotest", iso))
+	var stdout, stderr strings.Builder
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	assert.NoError(t, cmd.Run(), stderr.String())
+	// the output of the service is left alone
+	assert.Equal(t, "started\n", stdout.String())
+	assert.Contains(t, stderr.String(), "warning: cannot limit open files")
+	assert.Equal(t, LogType(WARNING), stderrType("warning: cannot limit open files to 1099511627776"))
+}
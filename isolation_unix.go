@@ -0,0 +1,88 @@
+//go:build unix
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Run the command through sh to set its umask and limits, and through nice
+// and ionice to set its priorities. On Linux it can be put in its own scope
+// of lnbank.slice with systemd-run.
+func wrapCommand(cmd *exec.Cmd, service string, iso Isolation) error {
+	sh, err := exec.LookPath("sh")
+	if err != nil {
+		return err
+	}
+	script := []string{fmt.Sprintf("umask %04o", iso.umask)}
+	// the limits that cannot be set are told on stderr, where the lines that
+	// are not logs of the service are warnings
+	if iso.maxFiles > 0 {
+		script = append(script, fmt.Sprintf(`ulimit -n %d || echo "warning: cannot limit open files to %d" >&2`,
+			iso.maxFiles, iso.maxFiles))
+	}
+	if iso.maxMemoryMB > 0 {
+		script = append(script, fmt.Sprintf(`ulimit -d %d || echo "warning: cannot limit memory to %d MB" >&2`,
+			iso.maxMemoryMB*1024, iso.maxMemoryMB))
+	}
+	run := []string{"exec"}
+	if nice, err := exec.LookPath("nice"); err == nil && iso.nice > 0 {
+		run = append(run, nice, "-n", fmt.Sprint(iso.nice))
+	}
+	class, level, _ := parseIonice(iso.ionice)
+	if ionice, err := exec.LookPath("ionice"); err == nil && class != "" && runtime.GOOS == "linux" {
+		// -t runs it anyway when the priority cannot be set
+		switch class {
+		case "idle":
+			run = append(run, ionice, "-t", "-c", "3")
+		case "best-effort":
+			run = append(run, ionice, "-t", "-c", "2", "-n", fmt.Sprint(level))
+		case "realtime":
+			run = append(run, ionice, "-t", "-c", "1", "-n", fmt.Sprint(level))
+		}
+	}
+	run = append(run, `"$0" "$@"`)
+	script = append(script, strings.Join(run, " "))
+
+	args := append([]string{sh, "-c", strings.Join(script, "; "), cmd.Path}, cmd.Args[1:]...)
+	if iso.cgroup && runtime.GOOS == "linux" && cgroupAvailable() {
+		systemdRun, _ := exec.LookPath("systemd-run")
+		scope := []string{systemdRun, "--user", "--scope", "--quiet", "--collect",
+			"--slice=lnbank.slice",
+			fmt.Sprintf("--unit=lnbank-%v-%v", strings.ToLower(service), time.Now().UnixNano())}
+		if iso.cpuQuota != "" {
+			scope = append(scope, "-p", "CPUQuota="+iso.cpuQuota)
+		}
+		if iso.memoryMax != "" {
+			scope = append(scope, "-p", "MemoryMax="+iso.memoryMax)
+		}
+		args = append(append(scope, "--"), args...)
+	}
+	cmd.Path = args[0]
+	cmd.Args = args
+	return nil
+}
+
+var (
+	cgroupOnce      sync.Once
+	cgroupSupported bool
+)
+
+// true if systemd-run can create scopes in the user session
+func cgroupAvailable() bool {
+	cgroupOnce.Do(func() {
+		if _, err := exec.LookPath("systemd-run"); err != nil {
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+		defer cancel()
+		cgroupSupported = exec.CommandContext(ctx, "systemd-run", "--user", "--scope", "--quiet", "true").Run() == nil
+	})
+	return cgroupSupported
+}
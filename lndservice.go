@@ -9,6 +9,8 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
 	"time"
 
@@ -41,6 +43,108 @@ func (l LndService) fmtLog(lt LogType, desc string) *Log {
 	return log
 }
 
+// Install the lnd executable and create its default configuration
+func (ts LndService) install(onLog func(*Log)) error {
+	LndExePath = filepath.Join(ServiceRootDir, "embed", "lnd", "lnd")
+	if err := InstallExe(embededLnd, LndExePath, onLog); err != nil && err.Error() != "installed" {
+		return err
+	} else if err != nil {
+		onLog(ts.fmtLog(INFO, "lnd executable installed under "+LndExePath))
+	}
+
+	LndConfigPath = filepath.Join(ServiceRootDir, "lnd")
+	// make sure the log directory exists
+	if err := os.MkdirAll(LndConfigPath, 0755); err != nil {
+		return fmt.Errorf("cannot create lnd directory: %w", err)
+	}
+
+	// TODO check that lnd.conf contains the proper path, in case that the user migrated to another computer
+	LndConfigFile = filepath.Join(LndConfigPath, "lnd.conf")
+	if _, err := os.Stat(LndConfigFile); os.IsNotExist(err) {
+		if err := os.WriteFile(LndConfigFile, []byte(defaultLndConfig), 0644); err != nil {
+			return fmt.Errorf("cannot create lnd configuration file: %w", err)
+		}
+	}
+	return nil
+}
+
+// lnd writes its logs to this file too, used to follow it when adopted
+func (ts LndService) logFile() string {
+	return filepath.Join(LndConfigPath, "logs", "bitcoin", ActiveNetwork.String(), "lnd.log")
+}
+
+// lnd keeps the wallet of each network apart
+func (ts LndService) walletFile() string {
+	return filepath.Join(LndConfigPath, "data", "chain", "bitcoin", ActiveNetwork.String(), "wallet.db")
+}
+
+// lncli talking to this lnd on its network
+func lncli(ctx context.Context, args ...string) *exec.Cmd {
+	args = append([]string{"--lnddir=" + LndConfigPath, "--network=" + ActiveNetwork.String(),
+		"--rpcserver=" + AddressOf("Lnd", "rpc_port")}, args...)
+	return exec.CommandContext(ctx, filepath.Join(ServiceRootDir, "embed", "lnd", "lncli"), args...)
+}
+
+// Write the network settings into lnd.conf when it is set up for no network
+// or another one. Otherwise it is left alone, with any peer added by the user.
+func (ts LndService) configureNetwork(onLog func(*Log)) error {
+	values, err := ConfigFileValues(LndConfigFile, "=", "bitcoin."+ActiveNetwork.String())
+	if err != nil {
+		return err
+	}
+	if slices.Contains(values, "true") || slices.Contains(values, "1") {
+		return nil
+	}
+	// a fresh lnd.conf has no network yet, only a change of it is worth a warning
+	var level LogType = INFO
+	for _, n := range []Network{MAINNET, TESTNET, SIGNET, REGTEST} {
+		values, err := ConfigFileValues(LndConfigFile, "=", "bitcoin."+n.String())
+		if err != nil {
+			return err
+		}
+		if slices.Contains(values, "true") || slices.Contains(values, "1") {
+			level = WARNING
+		}
+	}
+	onLog(ts.fmtLog(level, "setting up lnd.conf for "+ActiveNetwork.String()))
+	return ReplaceConfigKeys(LndConfigFile, "=", lndNetworkKeys, ActiveNetwork.lndSettings())
+}
+
+// Check the ports of lnd and write them into lnd.conf, together with the
+// ports of tor that lnd uses
+func (ts LndService) configurePorts(onLog func(*Log)) error {
+	if err := PreflightPorts(ts.name(), onLog); err != nil {
+		return err
+	}
+	p2p := portSpec("Lnd", "p2p_port")
+	return RenderConfigFile(LndConfigFile, "=", [][2]string{
+		{"restlisten", AddressOf("Lnd", "rest_port")},
+		{"rpclisten", AddressOf("Lnd", "rpc_port")},
+		{"listen", p2p.address(PortOf("Lnd", "p2p_port"))},
+		{"tor.socks", strconv.Itoa(PortOf("Tor", "socks_port"))},
+		{"tor.control", AddressOf("Tor", "control_port")},
+	})
+}
+
+func (ts LndService) binary() (string, []byte) {
+	return LndExePath, embededLnd
+}
+
+func (ts LndService) binaryVersion(ctx context.Context) (string, error) {
+	return commandVersion(ctx, LndExePath, "--version")
+}
+
+// The version lnd tells through its GetInfo RPC
+func (ts LndService) runningVersion(ctx context.Context) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, VersionTimeout)
+	defer cancel()
+	output, err := lncli(ctx, "getinfo").Output()
+	if err != nil {
+		return "", fmt.Errorf("lncli getinfo: %w", err)
+	}
+	return getinfoVersion(output)
+}
+
 // Implement the Service interface
 func (ts LndService) start(ctx context.Context, onReady func(), onStop func(*Log), onLog func(*Log)) {
 	if onReady == nil || onStop == nil || onLog == nil {
@@ -51,38 +155,22 @@ func (ts LndService) start(ctx context.Context, onReady func(), onStop func(*Log
 	ts.onLog = onLog
 	ts.ctx = ctx
 
-	LndExePath = filepath.Join(ServiceRootDir, "embed", "lnd", "lnd")
-	if err := InstallExe(embededLnd, LndExePath, onLog); err != nil && err.Error() != "installed" {
-		log := ts.fmtLog(FATAL, err.Error())
-		go onLog(log)
-		go onStop(log)
+	if log, adopted := HandleOrphan(ctx, ts); adopted {
+		onStop(log)
 		return
-	} else if err != nil && err.Error() == "installed" {
-		go onLog(ts.fmtLog(INFO, "lnd executable installed under "+LndExePath))
 	}
 
-	LndConfigPath = filepath.Join(ServiceRootDir, "lnd")
-	err := os.MkdirAll(LndConfigPath, 0755) // make sure the log directory exists
+	err := ts.configureNetwork(onLog)
+	if err == nil {
+		err = ts.configurePorts(onLog)
+	}
 	if err != nil {
-		log := ts.fmtLog(FATAL, fmt.Sprintf("Cannot create lnd directory %v: ", err))
+		log := ts.fmtLog(FATAL, err.Error())
 		go onLog(log)
 		go onStop(log)
 		return
 	}
 
-	// TODO check that torrc contains the proper path, in case that the user migrated to another computer
-	LndConfigFile = filepath.Join(LndConfigPath, "lnd.conf")
-	if _, err := os.Stat(LndConfigFile); os.IsNotExist(err) {
-		err = os.WriteFile(LndConfigFile, []byte(defaultLndConfig), 0644)
-		if err != nil {
-			log := ts.fmtLog(FATAL,
-				fmt.Sprintf("Cannot create lnd configuration file %v: ", err))
-			go onLog(log)
-			go onStop(log)
-			return
-		}
-	}
-
 	cmd := exec.Command(LndExePath, "--lnddir="+LndConfigPath)
 	log := ScanCommand(ctx, ts, cmd)
 
@@ -105,6 +193,21 @@ func (ts LndService) name() string {
 	return "Lnd"
 }
 
+func (ts LndService) dependencies() []string {
+	return []string{"Tor"}
+}
+
+// Stop lnd with lncli, which calls the StopDaemon RPC
+func (ts LndService) shutdown(cmd *exec.Cmd) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	output, err := lncli(ctx, "stop").CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("lncli stop: %v %s", err, bytes.TrimSpace(output))
+	}
+	return nil
+}
+
 func createlndpass(length int) string {
 	charset := "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
 	b := make([]byte, length)
@@ -114,16 +217,26 @@ func createlndpass(length int) string {
 	return string(b)
 }
 
+// The REST API must answer before lnd is ready. While it runs, the gRPC
+// GetInfo through lncli must answer too.
+func (ts LndService) probes() ([]Probe, []Probe) {
+	rest := HttpProbe{func() string { return "https://" + AddressOf("Lnd", "rest_port") + "/v1/state" }}
+	getinfo := CommandProbe{"gRPC GetInfo", func(ctx context.Context) *exec.Cmd {
+		return lncli(ctx, "getinfo")
+	}}
+	return []Probe{rest}, []Probe{rest, getinfo}
+}
+
 func (ts LndService) isReady(text string, onLog func(*Log)) bool {
-	_, err := os.Stat(filepath.Join(ServiceRootDir, "lnd", "data", "chain", "mainnet", "bitcoin", "wallet.db"))
+	_, err := os.Stat(ts.walletFile())
 	if err != nil && strings.Contains(text, "Waiting for wallet encryption password") {
 		fmt.Println("Creating wallet ----------------------------------------")
 		pass := createlndpass(20)
-		err := SetConfig("pass", "lnd", pass)
+		err := SetConfig(ActiveNetwork.configName("pass"), "lnd", pass)
 		if err != nil {
 			onLog(ts.fmtLog(FATAL, "cannot write lnd password to db: "+err.Error()))
 		}
-		cmd := exec.Command(filepath.Join(ServiceRootDir, "embed", "lnd", "lncli"), "--lnddir="+LndConfigPath, "create", pass)
+		cmd := lncli(context.Background(), "create", pass)
 		var stdin bytes.Buffer
 		stdin.WriteString(pass + "\n" + pass + "\nn\n\n")
 		cmd.Stdin = &stdin
@@ -133,7 +246,7 @@ func (ts LndService) isReady(text string, onLog func(*Log)) bool {
 		if err != nil {
 			onLog(ts.fmtLog(FATAL, string(output)+err.Error()))
 		}
-		if err := SetConfig("CreateOutput", "lnd", string(output)); err != nil {
+		if err := SetConfig(ActiveNetwork.configName("CreateOutput"), "lnd", string(output)); err != nil {
 			onLog(ts.fmtLog(FATAL, "cannot write lnd wallet creation output to db"))
 		}
 	}
@@ -157,22 +270,31 @@ func (ts LndService) parseLogEntry(line string) (Log, error) {
 
 	var logtype LogType
 	switch parts[2] {
+	case "[CRT]":
+		logtype = FATAL
 	case "[ERR]":
 		logtype = ERROR
 	case "[WRN]":
 		logtype = WARNING
 	case "[INF]":
 		logtype = INFO
+	case "[DBG]", "[TRC]":
+		logtype = DEBUG
 	default:
 		logtype = NORMAL
 	}
 
-	fmt.Println(parts)
+	// the subsystem, such as "HSWC:"
+	subsystem, ok := strings.CutSuffix(parts[3], ":")
+	if !ok || len(parts) < 5 {
+		return *ts.fmtLog(logtype, line), fmt.Errorf("no subsystem in the log")
+	}
 	logEntry := Log{
-		date:    t,
-		logType: logtype,
-		desc:    parts[4],
-		service: parts[3][0:4],
+		date:      t,
+		logType:   logtype,
+		desc:      parts[4],
+		service:   ts.name(),
+		subsystem: subsystem,
 	}
 
 	errs := logEntry.Validate()
@@ -208,21 +330,13 @@ watchtower.active=true
 wtclient.active=true
 wtclient.sweep-fee-rate=25
 
-bitcoin.mainnet=true
+# the network, its neutrino peers and the fee estimator are written
+# before starting lnd, see network.go
 bitcoin.node=neutrino
-neutrino.connect=btcd1.lnolymp.us
-neutrino.connect=btcd2.lnolymp.us
-neutrino.connect=btcd-mainnet.lightning.computer
-neutrino.connect=node.blixtwallet.com
-neutrino.connect=node.eldamar.icu
-neutrino.connect=noad.sathoarder.com
-neutrino.connect=bb1.breez.technology
-neutrino.connect=bb2.breez.technology
 neutrino.persistfilters=true
 
 # https://github.com/LN-Zap/bitcoin-blended-fee-estimator
 # https://t.me/lightningd/32115
-feeurl=https://bitcoinchainfees.strike.me/v1/fee-estimates
 # alternative more conservative:
 #feeurl=https://nodes.lightning.computer/fees/v1/btc-fee-estimates.json
 
@@ -31,7 +31,29 @@ func TestLndStart(t *testing.T) {
 			fmt.Println(log)
 		}
 	}
+	if err := ts.install(onLog); err != nil {
+		t.Fatal(err)
+	}
 	ts.start(ctx, onReady, onStop, onLog)
 	time.Sleep(time.Second * 2)
 	assert.True(t, gotReady, "Lnd never got ready")
 }
+
+func TestLndParseLogEntry(t *testing.T) {
+	ts := LndService{}
+	l, err := ts.parseLogEntry("2024-05-01 10:00:00.123 [WRN] HSWC: unable to forward htlc")
+	assert.NoError(t, err)
+	assert.Equal(t, "Lnd", l.service)
+	assert.Equal(t, "HSWC", l.subsystem)
+	assert.Equal(t, "unable to forward htlc", l.desc)
+	assert.Equal(t, LogType(WARNING), l.logType)
+	assert.Equal(t, CATEGORY_HTLC, l.category())
+
+	l, err = ts.parseLogEntry("2024-05-01 10:00:00.123 [CRT] LTND: shutting down")
+	assert.NoError(t, err)
+	assert.Equal(t, LogType(FATAL), l.logType)
+	assert.Equal(t, CATEGORY_NODE, l.category())
+
+	_, err = ts.parseLogEntry("2024-05-01 10:00:00.123 [INF] no subsystem")
+	assert.Error(t, err)
+}
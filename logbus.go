@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"sync"
+	"sync/atomic"
+)
+
+// Where the logs of the services go: the db, the window, stdout, a file...
+// write is only called from the goroutine of the sink, so it may block
+// without holding back the services or the other sinks.
+type LogSink interface {
+	write(l *Log) error
+	close() error
+}
+
+// A sink counting the logs it writes itself, such as one buffering them
+type countingSink interface {
+	counts() (written uint64, dropped uint64, failed uint64)
+}
+
+// A function used as a LogSink
+type LogSinkFunc func(l *Log) error
+
+func (f LogSinkFunc) write(l *Log) error { return f(l) }
+func (f LogSinkFunc) close() error       { return nil }
+
+// What is done with a log when the buffer of a sink is full
+type DropPolicy int8
+
+const (
+	// the log is dropped
+	DROP_NEWEST DropPolicy = iota
+	// the oldest log in the buffer is dropped to make room for it
+	DROP_OLDEST
+	// the service logging waits for room, for sinks that must not lose logs
+	BLOCK
+)
+
+func (dp DropPolicy) String() string {
+	switch dp {
+	case DROP_OLDEST:
+		return "drop-oldest"
+	case BLOCK:
+		return "block"
+	}
+	return "drop-newest"
+}
+
+// Counters of a sink since it was registered
+type SinkStats struct {
+	name     string
+	policy   DropPolicy
+	buffered int
+	written  uint64
+	dropped  uint64
+	failed   uint64
+}
+
+type sinkRun struct {
+	name    string
+	sink    LogSink
+	policy  DropPolicy
+	logs    chan *Log
+	done    chan struct{}
+	written atomic.Uint64
+	dropped atomic.Uint64
+	failed  atomic.Uint64
+}
+
+// Fan out of logs to independent sinks, each one with its own buffer and
+// goroutine so a slow sink only delays itself
+type LogBus struct {
+	// publishers hold it for reading, registering and closing for writing
+	mutex  sync.RWMutex
+	sinks  []*sinkRun
+	closed bool
+	// called when a sink fails to write a log. It has its own mutex as the
+	// sinks call it while publishers may be waiting for them.
+	onError      func(sink string, l *Log, err error)
+	onErrorMutex sync.Mutex
+}
+
+// The bus of the services, created by Setup
+var Logs *LogBus
+
+func NewLogBus() *LogBus {
+	return &LogBus{
+		onError: func(sink string, l *Log, err error) {
+			fmt.Fprintln(os.Stderr, "Error writing log to "+sink+":", err)
+		},
+	}
+}
+
+func (b *LogBus) setOnError(onError func(sink string, l *Log, err error)) {
+	b.onErrorMutex.Lock()
+	defer b.onErrorMutex.Unlock()
+	b.onError = onError
+}
+
+func (b *LogBus) failed(sink string, l *Log, err error) {
+	b.onErrorMutex.Lock()
+	onError := b.onError
+	b.onErrorMutex.Unlock()
+	onError(sink, l, err)
+}
+
+// Add a sink buffering up to buffer logs. A sink with the same name is
+// replaced, after writing the logs it has buffered.
+func (b *LogBus) register(name string, sink LogSink, buffer int, policy DropPolicy) {
+	b.unregister(name)
+	run := &sinkRun{
+		name:   name,
+		sink:   sink,
+		policy: policy,
+		logs:   make(chan *Log, max(buffer, 1)),
+		done:   make(chan struct{}),
+	}
+	go b.drain(run)
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.closed {
+		close(run.logs)
+		return
+	}
+	b.sinks = append(b.sinks, run)
+}
+
+// Write the logs of a sink until its channel is closed, then close the sink
+func (b *LogBus) drain(run *sinkRun) {
+	defer close(run.done)
+	for l := range run.logs {
+		err := run.sink.write(l)
+		if errors.Is(err, errLogDropped) {
+			run.dropped.Add(1)
+		} else if err != nil {
+			run.failed.Add(1)
+			b.failed(run.name, l, err)
+		} else {
+			run.written.Add(1)
+		}
+	}
+	if err := run.sink.close(); err != nil {
+		b.failed(run.name, nil, err)
+	}
+}
+
+// Remove a sink, waiting for the logs it has buffered to be written
+func (b *LogBus) unregister(name string) {
+	b.mutex.Lock()
+	i := slices.IndexFunc(b.sinks, func(run *sinkRun) bool { return run.name == name })
+	if i < 0 {
+		b.mutex.Unlock()
+		return
+	}
+	run := b.sinks[i]
+	b.sinks = slices.Delete(b.sinks, i, i+1)
+	close(run.logs)
+	b.mutex.Unlock()
+	<-run.done
+}
+
+// Send a log to every sink, following the policy of each one when it is full
+func (b *LogBus) publish(l *Log) {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	if b.closed {
+		return
+	}
+	for _, run := range b.sinks {
+		switch run.policy {
+		case BLOCK:
+			run.logs <- l
+		case DROP_OLDEST:
+			for sent := false; !sent; {
+				select {
+				case run.logs <- l:
+					sent = true
+				default:
+					select {
+					case <-run.logs:
+						run.dropped.Add(1)
+					default:
+					}
+				}
+			}
+		default:
+			select {
+			case run.logs <- l:
+			default:
+				run.dropped.Add(1)
+			}
+		}
+	}
+}
+
+// Counters of every sink
+func (b *LogBus) stats() []SinkStats {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	stats := make([]SinkStats, 0, len(b.sinks))
+	for _, run := range b.sinks {
+		ss := SinkStats{
+			name:     run.name,
+			policy:   run.policy,
+			buffered: len(run.logs),
+			written:  run.written.Load(),
+			dropped:  run.dropped.Load(),
+			failed:   run.failed.Load(),
+		}
+		if cs, ok := run.sink.(countingSink); ok {
+			ss.written, ss.dropped, ss.failed = cs.counts()
+		}
+		stats = append(stats, ss)
+	}
+	return stats
+}
+
+// Stop accepting logs and wait until every sink has written the logs it has
+// buffered, or until ctx is done
+func (b *LogBus) close(ctx context.Context) error {
+	b.mutex.Lock()
+	if b.closed {
+		b.mutex.Unlock()
+		return nil
+	}
+	b.closed = true
+	sinks := b.sinks
+	b.sinks = nil
+	for _, run := range sinks {
+		close(run.logs)
+	}
+	b.mutex.Unlock()
+	for _, run := range sinks {
+		select {
+		case <-run.done:
+		case <-ctx.Done():
+			return errors.New("logs not written to " + run.name + ": " + ctx.Err().Error())
+		}
+	}
+	return nil
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testLog(i int) *Log {
+	return &Log{date: time.Now(), logType: INFO, service: "test_bus", desc: fmt.Sprint(i)}
+}
+
+// A sink that waits for release before writing anything
+type slowSink struct {
+	release chan struct{}
+	mutex   sync.Mutex
+	descs   []string
+}
+
+func (ss *slowSink) write(l *Log) error {
+	<-ss.release
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+	ss.descs = append(ss.descs, l.desc)
+	return nil
+}
+
+func (ss *slowSink) close() error { return nil }
+
+func (ss *slowSink) written() []string {
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+	return ss.descs
+}
+
+func TestLogBusPolicies(t *testing.T) {
+	bus := NewLogBus()
+	newest := &slowSink{release: make(chan struct{})}
+	oldest := &slowSink{release: make(chan struct{})}
+	var fast []string
+	bus.register("newest", newest, 2, DROP_NEWEST)
+	bus.register("oldest", oldest, 2, DROP_OLDEST)
+	bus.register("fast", LogSinkFunc(func(l *Log) error {
+		fast = append(fast, l.desc)
+		return nil
+	}), 10, BLOCK)
+
+	// the slow sinks take the first log and buffer 2, so 3 are dropped
+	for i := range 6 {
+		bus.publish(testLog(i))
+		time.Sleep(time.Millisecond * 10)
+	}
+	stats := bus.stats()
+	if assert.Len(t, stats, 3) {
+		assert.Equal(t, uint64(3), stats[0].dropped)
+		assert.Equal(t, uint64(3), stats[1].dropped)
+		assert.Equal(t, uint64(0), stats[2].dropped)
+		assert.Equal(t, uint64(6), stats[2].written)
+	}
+
+	close(newest.release)
+	close(oldest.release)
+	assert.NoError(t, bus.close(context.Background()))
+	assert.Equal(t, []string{"0", "1", "2"}, newest.written())
+	assert.Equal(t, []string{"0", "4", "5"}, oldest.written())
+	assert.Equal(t, []string{"0", "1", "2", "3", "4", "5"}, fast)
+
+	// closed, nothing more is written
+	bus.publish(testLog(6))
+	assert.Len(t, fast, 6)
+	assert.Empty(t, bus.stats())
+}
+
+func TestLogBusBlock(t *testing.T) {
+	bus := NewLogBus()
+	sink := &slowSink{release: make(chan struct{})}
+	bus.register("db", sink, 1, BLOCK)
+	published := make(chan struct{})
+	go func() {
+		for i := range 3 {
+			bus.publish(testLog(i))
+		}
+		close(published)
+	}()
+	select {
+	case <-published:
+		t.Fatal("published without room in the sink")
+	case <-time.After(time.Millisecond * 100):
+	}
+	close(sink.release)
+	<-published
+	bus.unregister("db")
+	assert.Equal(t, []string{"0", "1", "2"}, sink.written())
+}
+
+func TestLogBusErrors(t *testing.T) {
+	bus := NewLogBus()
+	failures := make(chan string, 10)
+	bus.setOnError(func(sink string, l *Log, err error) {
+		failures <- sink + " " + l.desc + " " + err.Error()
+	})
+	bus.register("broken", LogSinkFunc(func(*Log) error {
+		return fmt.Errorf("disk full")
+	}), 10, DROP_NEWEST)
+	bus.publish(testLog(1))
+	assert.Equal(t, "broken 1 disk full", <-failures)
+	assert.Equal(t, uint64(1), bus.stats()[0].failed)
+	assert.NoError(t, bus.close(context.Background()))
+}
+
+func TestRotatingFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "logs", "lnbank.log")
+	rf, err := NewRotatingFile(file, 100, 2)
+	assert.NoError(t, err)
+	for i := range 10 {
+		assert.NoError(t, rf.write(testLog(i)))
+	}
+	assert.NoError(t, rf.close())
+
+	// every log is about 45 bytes, so there are 3 per file
+	var all []string
+	for _, name := range []string{file + ".2", file + ".1", file} {
+		content, err := os.ReadFile(name)
+		assert.NoError(t, err, name)
+		lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+		assert.LessOrEqual(t, len(lines), 3, name)
+		all = append(all, lines...)
+	}
+	_, err = os.Stat(file + ".3")
+	assert.ErrorIs(t, err, os.ErrNotExist)
+	assert.True(t, strings.HasSuffix(all[len(all)-1], "test_bus: 9"), all[len(all)-1])
+	assert.Less(t, len(all), 10)
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Returned by parseLogEntry, together with the line as a log, for lines that
+// continue the previous entry instead of starting one
+var errNotAnEntry = errors.New("not the start of a log entry")
+
+// Lines that always continue the previous entry: indented or empty lines,
+// the goroutines and calls of a Go stack trace and the end of a JSON blob
+var continuationLine = regexp.MustCompile(`^(\s|$|goroutine \d+ \[|created by |[\]})]|[\w./*()-]+\(.*\)$)`)
+
+// Lines that always start an entry, such as a Go panic
+var entryStartLine = regexp.MustCompile(`^(panic: |fatal error: )`)
+
+// How long a log entry waits for more lines before being logged
+const GroupTimeout = time.Millisecond * 200
+
+// Lines after which an entry is logged even if it continues
+const MaxGroupLines = 500
+
+// Lines of an output making one log entry, with its first line as parsed by
+// the service
+type lineGroup struct {
+	lines []string
+	first Log
+	err   error
+}
+
+// Group the lines of an output into entries of one or more lines. A line
+// starts an entry if parse understands it and it is not a continuation line.
+// Every line is parsed once at most. The entries are sent once the next one
+// starts, after GroupTimeout without more lines, or when lines is closed, then
+// entries is closed.
+func groupLines(lines <-chan string, parse func(string) (Log, error), entries chan<- lineGroup) {
+	defer close(entries)
+	var entry lineGroup
+	var timeout <-chan time.Time
+	flush := func() {
+		// blank lines are only kept between lines
+		for len(entry.lines) > 0 && strings.TrimSpace(entry.lines[len(entry.lines)-1]) == "" {
+			entry.lines = entry.lines[:len(entry.lines)-1]
+		}
+		if len(entry.lines) > 0 {
+			entries <- entry
+		}
+		entry = lineGroup{}
+	}
+	for {
+		select {
+		case line, ok := <-lines:
+			if !ok {
+				flush()
+				return
+			}
+			if len(entry.lines) == 0 && strings.TrimSpace(line) == "" {
+				continue
+			}
+			var first Log
+			var err error
+			parsed := false
+			if len(entry.lines) > 0 {
+				starts := len(entry.lines) >= MaxGroupLines || entryStartLine.MatchString(line)
+				if !starts && !continuationLine.MatchString(line) {
+					first, err = parse(line)
+					parsed, starts = true, err == nil
+				}
+				if starts {
+					flush()
+				}
+			}
+			if len(entry.lines) == 0 {
+				if !parsed {
+					first, err = parse(line)
+				}
+				entry.first, entry.err = first, err
+			}
+			entry.lines = append(entry.lines, line)
+			timeout = time.After(GroupTimeout)
+		case <-timeout:
+			timeout = nil
+			flush()
+		}
+	}
+}
+
+// The log of an entry of lines of a service, and whether the service
+// understood it. Its first line is the log and the rest is added to its
+// description. The entries of stderr that the service does not understand are
+// classified by their first line.
+func entryLog(service Service, entry lineGroup, stderr bool) (*Log, bool) {
+	l, err := entry.first, entry.err
+	if err != nil && !errors.Is(err, errNotAnEntry) {
+		text := strings.Join(entry.lines, "\n")
+		if stderr {
+			return service.fmtLog(stderrType(entry.lines[0]), text), false
+		}
+		return service.fmtLog(WARNING, "non-conventional "+service.name()+" log format "+err.Error()+": "+text), false
+	}
+	if len(entry.lines) > 1 {
+		l.desc += "\n" + strings.Join(entry.lines[1:], "\n")
+	}
+	return &l, true
+}
+
+// Whether any line of a log makes the service ready
+func entryReady(service Service, l *Log, onLog func(*Log)) bool {
+	for _, line := range strings.Split(l.desc, "\n") {
+		if service.isReady(line, onLog) {
+			return true
+		}
+	}
+	return false
+}
+
+// The type of a line of stderr that is not a log of the service
+func stderrType(line string) LogType {
+	lower := strings.ToLower(line)
+	switch {
+	case strings.HasPrefix(lower, "panic:") || strings.HasPrefix(lower, "fatal"):
+		return FATAL
+	case strings.Contains(lower, "error") || strings.Contains(lower, "[err]"):
+		return ERROR
+	}
+	return WARNING
+}
+
+// The first line of a description, and how many more lines it has
+func firstLine(desc string) (string, int) {
+	first, rest, found := strings.Cut(desc, "\n")
+	if !found {
+		return desc, 0
+	}
+	return first, strings.Count(rest, "\n") + 1
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// A service whose log lines start with "LOG "
+type groupService struct {
+	scanService
+}
+
+func (gs groupService) parseLogEntry(line string) (Log, error) {
+	desc, found := strings.CutPrefix(line, "LOG ")
+	if !found {
+		return Log{}, errors.New("no LOG prefix")
+	}
+	return *gs.fmtLog(INFO, desc), nil
+}
+
+func TestGroupLines(t *testing.T) {
+	lines := make(chan string)
+	groups := make(chan lineGroup, 10)
+	var parsed []string
+	parse := func(line string) (Log, error) {
+		parsed = append(parsed, line)
+		return groupService{}.parseLogEntry(line)
+	}
+	go groupLines(lines, parse, groups)
+	entries := make(chan []string, 10)
+	go func() {
+		for group := range groups {
+			entries <- group.lines
+		}
+		close(entries)
+	}()
+
+	for _, line := range []string{
+		"LOG starting",
+		"LOG getinfo",
+		"{",
+		`    "alias": "LNBank"`,
+		"}",
+		"panic: runtime error: invalid memory address",
+		"",
+		"goroutine 1 [running]:",
+		"github.com/lightningnetwork/lnd.(*server).Start(0xc000)",
+		"\t/build/lnd/server.go:12 +0x1d",
+		"",
+		"LOG restarted",
+	} {
+		lines <- line
+	}
+	assert.Equal(t, []string{"LOG starting"}, <-entries)
+	assert.Equal(t, []string{"LOG getinfo", "{", `    "alias": "LNBank"`, "}"}, <-entries)
+	assert.Equal(t, []string{"panic: runtime error: invalid memory address", "", "goroutine 1 [running]:",
+		"github.com/lightningnetwork/lnd.(*server).Start(0xc000)", "\t/build/lnd/server.go:12 +0x1d"}, <-entries)
+
+	// the last entry is sent after a while without lines
+	select {
+	case entry := <-entries:
+		assert.Equal(t, []string{"LOG restarted"}, entry)
+	case <-time.After(GroupTimeout * 5):
+		t.Fatal("the last entry was never sent")
+	}
+	lines <- "  indented"
+	close(lines)
+	assert.Equal(t, []string{"  indented"}, <-entries)
+	_, open := <-entries
+	assert.False(t, open)
+	// every line is parsed once, and the continuation lines never
+	assert.Equal(t, []string{"LOG starting", "LOG getinfo", "{", "panic: runtime error: invalid memory address",
+		"LOG restarted", "  indented"}, parsed)
+}
+
+func TestScanCommandGroups(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("needs sh")
+	}
+	service := groupService{scanService{fakeService{n: "test_group"}, make(chan *Log, 100)}}
+	cmd := exec.Command("sh", "-c", `echo "LOG hello"; echo "  details"; echo "warning: deprecated" >&2; `+
+		`printf 'panic: boom\n\ngoroutine 1 [running]:\nmain.main()\n\t/x.go:5 +0x1d\n' >&2; `+
+		`echo "LOG unknown option" >&2`)
+	ScanCommand(context.Background(), service, cmd)
+	close(service.logs)
+	var logs []*Log
+	for l := range service.logs {
+		logs = append(logs, l)
+	}
+	if assert.Len(t, logs, 5) {
+		byDesc := map[string]*Log{}
+		for _, l := range logs {
+			first, _ := firstLine(l.desc)
+			byDesc[first] = l
+		}
+		assert.Equal(t, "hello\n  details", byDesc["hello"].desc)
+		if assert.Contains(t, byDesc, "panic: boom") {
+			assert.Equal(t, LogType(FATAL), byDesc["panic: boom"].logType)
+			_, more := firstLine(byDesc["panic: boom"].desc)
+			assert.Equal(t, 4, more)
+		}
+		assert.Equal(t, LogType(INFO), byDesc["unknown option"].logType)
+		assert.Equal(t, LogType(WARNING), byDesc["warning: deprecated"].logType)
+		assert.Equal(t, "exit", logs[4].desc)
+	}
+}
+
+func TestStderrType(t *testing.T) {
+	assert.Equal(t, LogType(FATAL), stderrType("panic: boom"))
+	assert.Equal(t, LogType(FATAL), stderrType("fatal error: all goroutines are asleep"))
+	assert.Equal(t, LogType(ERROR), stderrType("Error: cannot bind"))
+	assert.Equal(t, LogType(WARNING), stderrType("deprecated flag"))
+}
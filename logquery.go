@@ -0,0 +1,343 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"iter"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Returned by the next of a LogQuery after its last log
+var errEndOfLogs = errors.New("no more logs")
+
+var errInvalidCursor = errors.New("invalid log cursor")
+
+var errEmptyPage = errors.New("a page must have at least one log")
+
+// Position of a log in the order of the logs, from which a query goes on
+// with the logs after it. The zero cursor is the start.
+type LogCursor struct {
+	timestamp int64
+	id        int64
+}
+
+// The cursor of the position of a log read from the db
+func (l *Log) cursor() LogCursor {
+	return LogCursor{l.date.UnixNano(), l.seq}
+}
+
+func (c LogCursor) IsZero() bool {
+	return c.id == 0
+}
+
+// An opaque text for clients to give back, empty for the zero cursor
+func (c LogCursor) String() string {
+	if c.IsZero() {
+		return ""
+	}
+	return strconv.FormatInt(c.timestamp, 36) + "." + strconv.FormatInt(c.id, 36)
+}
+
+func ParseLogCursor(text string) (LogCursor, error) {
+	if text == "" {
+		return LogCursor{}, nil
+	}
+	timestamp, id, ok := strings.Cut(text, ".")
+	if !ok {
+		return LogCursor{}, errInvalidCursor
+	}
+	var c LogCursor
+	var err error
+	if c.timestamp, err = strconv.ParseInt(timestamp, 36, 64); err != nil {
+		return LogCursor{}, errInvalidCursor
+	}
+	if c.id, err = strconv.ParseInt(id, 36, 64); err != nil || c.id <= 0 {
+		return LogCursor{}, errInvalidCursor
+	}
+	return c, nil
+}
+
+// A query of the logs, built by chaining its methods:
+//
+//	logs := SelectLogs().Since(time.Hour).Types(ERROR, FATAL).Ascending()
+//	for l, err := range logs.All(ctx) {
+//
+// Without a range it takes every log, newest first.
+type LogSelect struct {
+	from, to   time.Time
+	logtypes   []LogType
+	services   []string
+	categories []string
+	desc       string
+	ascending  bool
+	after      LogCursor
+	limit      uint
+}
+
+func SelectLogs() *LogSelect {
+	return &LogSelect{}
+}
+
+// The logs from the time from on, and before to, when they are not zero
+func (s *LogSelect) Between(from time.Time, to time.Time) *LogSelect {
+	s.from, s.to = from, to
+	return s
+}
+
+// The logs of the last duration
+func (s *LogSelect) Since(duration time.Duration) *LogSelect {
+	s.from, s.to = time.Now().Add(-duration), time.Time{}
+	return s
+}
+
+func (s *LogSelect) Types(logtypes ...LogType) *LogSelect {
+	s.logtypes = logtypes
+	return s
+}
+
+func (s *LogSelect) Services(services ...string) *LogSelect {
+	s.services = services
+	return s
+}
+
+// The logs of the categories of logCategory
+func (s *LogSelect) Categories(categories ...string) *LogSelect {
+	s.categories = categories
+	return s
+}
+
+// The logs matching a search as parsed by ParseSearch
+func (s *LogSelect) Search(desc string) *LogSelect {
+	s.desc = desc
+	return s
+}
+
+// Oldest first instead of newest first
+func (s *LogSelect) Ascending() *LogSelect {
+	s.ascending = true
+	return s
+}
+
+// The logs after the one of the cursor, in the order of the query
+func (s *LogSelect) After(cursor LogCursor) *LogSelect {
+	s.after = cursor
+	return s
+}
+
+// At most limit logs, all of them with 0
+func (s *LogSelect) Limit(limit uint) *LogSelect {
+	s.limit = limit
+	return s
+}
+
+// The conditions of the query on the log table, "1" when there are none,
+// and their parameters
+func (s *LogSelect) where() (string, []any, error) {
+	var conditions []string
+	var params []any
+	in := func(column string, n int) {
+		conditions = append(conditions, "log."+column+" IN ("+strings.TrimSuffix(strings.Repeat("?,", n), ",")+")")
+	}
+	if !s.from.IsZero() {
+		conditions = append(conditions, "log.timestamp >= ?")
+		params = append(params, s.from.UnixNano())
+	}
+	if !s.to.IsZero() {
+		conditions = append(conditions, "log.timestamp < ?")
+		params = append(params, s.to.UnixNano())
+	}
+	if s.logtypes != nil {
+		in("type_id", len(s.logtypes))
+		for _, lt := range s.logtypes {
+			params = append(params, lt)
+		}
+	}
+	if s.services != nil {
+		in("service", len(s.services))
+		for _, service := range s.services {
+			params = append(params, service)
+		}
+	}
+	if s.categories != nil {
+		in("category", len(s.categories))
+		for _, category := range s.categories {
+			params = append(params, category)
+		}
+	}
+	if s.desc != "" {
+		sq, err := ParseSearch(s.desc)
+		if err != nil {
+			return "", nil, err
+		}
+		if sq != nil {
+			condition, args := sq.condition()
+			conditions = append(conditions, condition)
+			params = append(params, args...)
+		}
+	}
+	if !s.after.IsZero() {
+		// the logs of the same time in the order they were stored
+		if s.ascending {
+			conditions = append(conditions, "(log.timestamp > ? OR (log.timestamp = ? AND log.id > ?))")
+		} else {
+			conditions = append(conditions, "(log.timestamp < ? OR (log.timestamp = ? AND log.id < ?))")
+		}
+		params = append(params, s.after.timestamp, s.after.timestamp, s.after.id)
+	}
+	if len(conditions) == 0 {
+		return "1", nil, nil
+	}
+	return strings.Join(conditions, " AND "), params, nil
+}
+
+func (s *LogSelect) query() (string, []any, error) {
+	where, params, err := s.where()
+	if err != nil {
+		return "", nil, err
+	}
+	order := "DESC"
+	if s.ascending {
+		order = "ASC"
+	}
+	query := fmt.Sprintf("SELECT log.id, log.timestamp, log.type_id, log.service, log.subsystem, log.desc, log.fields "+
+		"FROM log WHERE %v ORDER BY log.timestamp %v, log.id %v", where, order, order)
+	if s.limit != 0 {
+		query += " LIMIT ?"
+		params = append(params, s.limit)
+	}
+	return query, params, nil
+}
+
+// The logs of the query one by one, read as they are iterated. It stops
+// after an error, such as the one of ctx when it is done.
+func (s *LogSelect) All(ctx context.Context) iter.Seq2[Log, error] {
+	return func(yield func(Log, error) bool) {
+		query, params, err := s.query()
+		if err != nil {
+			yield(Log{}, err)
+			return
+		}
+		rows, err := DB.QueryContext(ctx, query, params...)
+		if err != nil {
+			yield(Log{}, err)
+			return
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var l Log
+			if err := scanLog(rows, &l); err != nil {
+				yield(Log{}, fmt.Errorf("unable to scan from the db: %w", err))
+				return
+			}
+			if !yield(l, nil) {
+				return
+			}
+		}
+		if err := rows.Err(); err != nil {
+			yield(Log{}, err)
+			return
+		}
+		if err := ctx.Err(); err != nil {
+			yield(Log{}, err)
+		}
+	}
+}
+
+// The next n logs of the query and the cursor to go on after them with
+// After, which is the zero cursor once there are no more logs. n must be at
+// least 1.
+func (s *LogSelect) Page(ctx context.Context, n uint) ([]Log, LogCursor, error) {
+	if n == 0 {
+		return nil, LogCursor{}, errEmptyPage
+	}
+	page := *s
+	// one more tells whether there are more
+	page.limit = n + 1
+	var logs []Log
+	for l, err := range page.All(ctx) {
+		if err != nil {
+			return nil, LogCursor{}, err
+		}
+		logs = append(logs, l)
+	}
+	if uint(len(logs)) <= n {
+		return logs, LogCursor{}, nil
+	}
+	logs = logs[:n]
+	return logs, logs[n-1].cursor(), nil
+}
+
+// How many logs the query takes, regardless of its limit
+func (s *LogSelect) Count(ctx context.Context) (int, error) {
+	where, params, err := s.where()
+	if err != nil {
+		return 0, err
+	}
+	var n int
+	err = DB.QueryRowContext(ctx, "SELECT count(*) FROM log WHERE "+where, params...).Scan(&n)
+	return n, err
+}
+
+// Iterate over the logs of the query with next, until it returns
+// errEndOfLogs or another error, or get them n at a time with getn. close
+// must be called unless next returned an error.
+type LogQuery struct {
+	next  func() (Log, error)
+	close func()
+	getn  func(n uint) ([]Log, error)
+}
+
+// The logs of s pulled one by one
+func (s *LogSelect) Query(ctx context.Context) LogQuery {
+	next, stop := iter.Pull2(s.All(ctx))
+	var q LogQuery
+	q.next = func() (Log, error) {
+		l, err, ok := next()
+		if !ok {
+			stop()
+			return Log{}, errEndOfLogs
+		}
+		if err != nil {
+			stop()
+		}
+		return l, err
+	}
+	q.close = stop
+	q.getn = func(n uint) ([]Log, error) {
+		var logs []Log
+		for n == 0 || uint(len(logs)) < n {
+			l, err := q.next()
+			if errors.Is(err, errEndOfLogs) {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			logs = append(logs, l)
+		}
+		return logs, nil
+	}
+	return q
+}
+
+// Query the logs of the last duration, newest first. categories are those
+// of logCategory, desc is a search as parsed by ParseSearch and limit is the
+// maximum number of logs, all of them with 0.
+func QueryLog(duration time.Duration,
+	logtypes []LogType,
+	services []string,
+	categories []string,
+	desc string,
+	limit uint,
+) (LogQuery, error) {
+	s := SelectLogs().Since(duration).Types(logtypes...).Services(services...).
+		Categories(categories...).Search(desc).Limit(limit)
+	// the search is checked before anything is read
+	if _, _, err := s.where(); err != nil {
+		return LogQuery{}, err
+	}
+	return s.Query(ServicesContext), nil
+}
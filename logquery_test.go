@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// n logs of a new service a millisecond apart from start, with the desc
+// of their number
+func insertServiceLogs(t *testing.T, n int, start time.Time) string {
+	t.Helper()
+	service := "query" + time.Now().Format("150405.000000000")
+	t.Cleanup(func() {
+		_, err := DB.Exec("DELETE FROM log WHERE service=?", service)
+		assert.NoError(t, err)
+	})
+	for i := range n {
+		errs, fatal := LogToDb(&Log{date: start.Add(time.Duration(i) * time.Millisecond), logType: INFO,
+			service: service, desc: strconv.Itoa(i)})
+		assert.False(t, fatal, "%v", errs)
+	}
+	return service
+}
+
+func descs(logs []Log) []string {
+	var descs []string
+	for _, l := range logs {
+		descs = append(descs, l.desc)
+	}
+	return descs
+}
+
+func TestLogCursor(t *testing.T) {
+	c := LogCursor{time.Now().UnixNano(), 1234}
+	parsed, err := ParseLogCursor(c.String())
+	assert.NoError(t, err)
+	assert.Equal(t, c, parsed)
+
+	parsed, err = ParseLogCursor("")
+	assert.NoError(t, err)
+	assert.True(t, parsed.IsZero())
+	assert.Empty(t, parsed.String())
+
+	for _, invalid := range []string{"abc", "1.", ".1", "1.0", "zzzzzzzzzzzzzzzz.1"} {
+		_, err := ParseLogCursor(invalid)
+		assert.ErrorIs(t, err, errInvalidCursor, invalid)
+	}
+}
+
+func TestSelectLogs(t *testing.T) {
+	ctx := context.Background()
+	start := time.Now().Add(-time.Minute)
+	service := insertServiceLogs(t, 10, start)
+	logs := func(s *LogSelect) []string {
+		var all []Log
+		for l, err := range s.All(ctx) {
+			assert.NoError(t, err)
+			all = append(all, l)
+		}
+		return descs(all)
+	}
+
+	assert.Equal(t, []string{"9", "8", "7", "6", "5", "4", "3", "2", "1", "0"},
+		logs(SelectLogs().Services(service)))
+	assert.Equal(t, []string{"2", "3", "4"},
+		logs(SelectLogs().Services(service).Ascending().
+			Between(start.Add(2*time.Millisecond), start.Add(5*time.Millisecond))))
+	assert.Equal(t, []string{"6", "7", "8"},
+		logs(SelectLogs().Services(service).Ascending().Between(start.Add(6*time.Millisecond), time.Time{}).Limit(3)))
+	assert.Equal(t, []string{"1"}, logs(SelectLogs().Services(service).Search("1")))
+	assert.Empty(t, logs(SelectLogs().Services(service).Since(time.Second)))
+
+	n, err := SelectLogs().Services(service).Between(start, start.Add(4*time.Millisecond)).Limit(1).Count(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 4, n)
+
+	// an iteration can stop early
+	var first []string
+	for l, err := range SelectLogs().Services(service).All(ctx) {
+		assert.NoError(t, err)
+		first = append(first, l.desc)
+		if len(first) == 2 {
+			break
+		}
+	}
+	assert.Equal(t, []string{"9", "8"}, first)
+
+	_, err = SelectLogs().Search(`"open`).Count(ctx)
+	assert.Error(t, err)
+}
+
+func TestLogPages(t *testing.T) {
+	ctx := context.Background()
+	// all in the same nanosecond, so only the ids tell them apart
+	service := insertServiceLogs(t, 1, time.Now())
+	now := time.Now()
+	for i := 1; i < 7; i++ {
+		errs, fatal := LogToDb(&Log{date: now, logType: INFO, service: service, desc: strconv.Itoa(i)})
+		assert.False(t, fatal, "%v", errs)
+	}
+	for _, ascending := range []bool{false, true} {
+		s := SelectLogs().Services(service)
+		if ascending {
+			s.Ascending()
+		}
+		var all []string
+		var cursor LogCursor
+		pages := 0
+		for {
+			page, next, err := s.After(cursor).Page(ctx, 3)
+			assert.NoError(t, err)
+			all = append(all, descs(page)...)
+			pages++
+			if next.IsZero() || pages > 5 {
+				break
+			}
+			cursor = next
+		}
+		assert.Equal(t, 3, pages)
+		_, _, err := s.Page(ctx, 0)
+		assert.ErrorIs(t, err, errEmptyPage)
+		if ascending {
+			assert.Equal(t, []string{"0", "1", "2", "3", "4", "5", "6"}, all)
+		} else {
+			assert.Equal(t, []string{"6", "5", "4", "3", "2", "1", "0"}, all)
+		}
+	}
+}
+
+func TestLogQuery(t *testing.T) {
+	service := insertServiceLogs(t, 5, time.Now().Add(-time.Minute))
+	q := SelectLogs().Services(service).Query(context.Background())
+	logs, err := q.getn(2)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"4", "3"}, descs(logs))
+	l, err := q.next()
+	assert.NoError(t, err)
+	assert.Equal(t, "2", l.desc)
+	logs, err = q.getn(0)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"1", "0"}, descs(logs))
+	_, err = q.next()
+	assert.ErrorIs(t, err, errEndOfLogs)
+	q.close()
+
+	// a cancelled context ends the logs with its error
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var errs []error
+	for _, err := range SelectLogs().Services(service).All(ctx) {
+		cancel()
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if assert.NotEmpty(t, errs) {
+		assert.ErrorIs(t, errs[len(errs)-1], context.Canceled)
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// Prints the logs as text or JSON lines, as lnbank daemon does on stdout
+type writerSink struct {
+	out    io.Writer
+	asJSON bool
+}
+
+func (ws writerSink) write(l *Log) error {
+	return printLog(ws.out, l, ws.asJSON)
+}
+
+func (ws writerSink) close() error { return nil }
+
+// Writes the logs as text to a file that is rotated once it reaches maxSize
+// bytes, keeping the keep previous ones as file.1 (the newest) to file.N
+type RotatingFile struct {
+	path    string
+	maxSize int64
+	keep    int
+	f       *os.File
+	size    int64
+}
+
+func NewRotatingFile(path string, maxSize int64, keep int) (*RotatingFile, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	rf := &RotatingFile{path: path, maxSize: maxSize, keep: keep}
+	return rf, rf.open()
+}
+
+func (rf *RotatingFile) open() error {
+	f, err := os.OpenFile(rf.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	rf.f, rf.size = f, info.Size()
+	return nil
+}
+
+func (rf *RotatingFile) rotate() error {
+	if err := rf.f.Close(); err != nil {
+		return err
+	}
+	for i := rf.keep - 1; i >= 1; i-- {
+		old := rf.path + "." + strconv.Itoa(i)
+		if _, err := os.Stat(old); err == nil {
+			if err := os.Rename(old, rf.path+"."+strconv.Itoa(i+1)); err != nil {
+				return err
+			}
+		}
+	}
+	if rf.keep > 0 {
+		if err := os.Rename(rf.path, rf.path+".1"); err != nil {
+			return err
+		}
+	} else if err := os.Remove(rf.path); err != nil {
+		return err
+	}
+	return rf.open()
+}
+
+func (rf *RotatingFile) write(l *Log) error {
+	if rf.f == nil {
+		return errors.New("log file " + rf.path + " is closed")
+	}
+	if rf.maxSize > 0 && rf.size >= rf.maxSize {
+		if err := rf.rotate(); err != nil {
+			return fmt.Errorf("cannot rotate %v: %w", rf.path, err)
+		}
+	}
+	cw := countingWriter{w: rf.f}
+	err := printLog(&cw, l, false)
+	rf.size += cw.n
+	return err
+}
+
+func (rf *RotatingFile) close() error {
+	if rf.f == nil {
+		return nil
+	}
+	err := rf.f.Close()
+	rf.f = nil
+	return err
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
+
+// Register the sinks every LNBank has: the db, and the log file and the
+// notification rules when they are set up. The window and stdout register
+// their own.
+func RegisterLogSinks(bus *LogBus) error {
+	var errs []error
+	// the services wait for the db rather than losing logs, but DEBUG ones
+	batch, err := ReadIntConfig("db_batch", "log", DefaultDbBatch)
+	errs = append(errs, err)
+	flushEvery, err := ReadDurationConfig("db_flush_every", "log", DefaultDbFlushEvery)
+	errs = append(errs, err)
+	writer := NewDbWriter(DB, 10000, batch, flushEvery, func(err error) { bus.failed("db", nil, err) })
+	bus.register("db", writer, 100, BLOCK)
+
+	enabled, err := ReadConfig("file", "log", "false")
+	errs = append(errs, err)
+	if on, _ := strconv.ParseBool(fmt.Sprint(enabled)); on {
+		maxMB, err := ReadIntConfig("file_max_mb", "log", 10)
+		errs = append(errs, err)
+		keep, err := ReadIntConfig("file_keep", "log", 5)
+		errs = append(errs, err)
+		rf, err := NewRotatingFile(filepath.Join(ServiceRootDir, "logs", "lnbank.log"), int64(maxMB)<<20, keep)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("cannot open the log file: %w", err))
+		} else {
+			bus.register("file", rf, 1000, DROP_NEWEST)
+		}
+	}
+
+	rules, err := LoadNotifyRules(filepath.Join(ServiceRootDir, NotifyFile))
+	errs = append(errs, err)
+	if len(rules) > 0 {
+		bus.register("notify", &notifySink{rules: rules}, 100, DROP_NEWEST)
+	}
+	errs = append(errs, registerForwardSinks(bus))
+	return errors.Join(errs...)
+}
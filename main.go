@@ -1,13 +1,71 @@
 package main
 
 import (
+	"flag"
+	"fmt"
+	"os"
+
 	"fyne.io/fyne/v2/app"
 )
 
 func main() {
-	a := app.New()
-	w := a.NewWindow("LNBank")
-
 	defer ServicesCancelFunc()
+	flags := flag.NewFlagSet("lnbank", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: lnbank [-root dir] [-profile name] [-network name] [daemon [-json]]")
+		flags.PrintDefaults()
+	}
+	rootFlag := flags.String("root", "", "directory of LNBank, or $LNBANK_ROOT, or ~/LNBank")
+	profileFlag := flags.String("profile", "", "profile with its own db, tor, lnd and ports, or $LNBANK_PROFILE, or "+DefaultProfile)
+	networkFlag := flags.String("network", "", "bitcoin network of the profile from now on: mainnet, testnet, signet or regtest")
+	_ = flags.Parse(os.Args[1:])
+
+	if err := setup(*rootFlag, *profileFlag, *networkFlag); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if args := flags.Args(); len(args) > 0 && args[0] == "daemon" {
+		code := daemon(args[1:])
+		ServicesCancelFunc()
+		os.Exit(code)
+	}
+
+	a := app.New()
+	w := a.NewWindow(WindowTitle())
 	main_window(w)
 }
+
+// Set up the selected profile and lock it for this process. A network given
+// is stored in the profile.
+func setup(rootFlag string, profileFlag string, networkFlag string) error {
+	root, err := RootDir(rootFlag)
+	if err != nil {
+		return err
+	}
+	profile, err := ProfileName(profileFlag)
+	if err != nil {
+		return err
+	}
+	// before the db is opened, so a second instance leaves it alone
+	dir := ProfileDir(root, profile)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("cannot create LNBank root dir: %w", err)
+	}
+	if err := LockInstance(dir); err != nil {
+		return err
+	}
+	if err := Setup(root, profile); err != nil {
+		return err
+	}
+	if networkFlag != "" {
+		network, err := ParseNetwork(networkFlag)
+		if err != nil {
+			return err
+		}
+		if err := SetNetwork(network); err != nil {
+			return err
+		}
+		ActiveNetwork = network
+	}
+	return nil
+}
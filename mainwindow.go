@@ -2,7 +2,10 @@ package main
 
 import (
 	"context"
-	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
 	"sync"
 	"time"
 
@@ -18,21 +21,15 @@ import (
 var mw_mutex sync.Mutex
 
 func main_window(w fyne.Window) {
-	// When Tor is ready, pass the context to the next service (LND)
-	torIsReady := make(chan context.Context)
-	defer close(torIsReady)
-	// this channel should have a length equal to the number of services that
-	// depend on lnd, and lnd should call all of them checking its capacity:
-	lndIsReady := make(chan context.Context, 2)
-	defer close(lndIsReady)
-	logs := make(chan *Log, 1000)
-	defer close(logs)
-
-	left := container.New(
-		layout.NewVBoxLayout(),
-		tor_widgets(torIsReady, logs),
-		lnd_widgets(torIsReady, lndIsReady, logs),
-	)
+	// one card per service, each one after the services it depends on
+	left := container.New(layout.NewVBoxLayout())
+	for _, st := range Services.status() {
+		if card, ok := ServiceWidgets[st.name]; ok {
+			left.Add(card())
+		} else {
+			left.Add(service_widgets(st.name))
+		}
+	}
 
 	logwidget := widget.NewRichTextWithText("Session entries:\n")
 	logwidget.Wrapping = fyne.TextWrapWord
@@ -40,14 +37,16 @@ func main_window(w fyne.Window) {
 	logscroll := container.NewScroll(logwidget)
 	logscroll.SetMinSize(fyne.Size{Width: 640, Height: 480})
 
-	filterchecks := widget.NewCheckGroup(
-		[]string{"Tor", "lnd", "Neutrino", "HTCL", "gossip", "wallet", "LNBits", "lndG", "clearnet"},
-		func([]string) {},
-	)
+	var services []string
+	for _, st := range Services.status() {
+		services = append(services, st.name)
+	}
+	categories := LogCategories(append(services, "LNBank"))
+	filterchecks := widget.NewCheckGroup(categories, func([]string) {})
 	filterchecks.Horizontal = true
-	filterchecks.SetSelected([]string{"Tor", "lnd", "Neutrino", "HTCL", "gossip", "wallet", "LNBits", "lndG", "clearnet"})
+	filterchecks.SetSelected(slices.Clone(categories))
 	filterentry := widget.NewEntry()
-	filterentry.PlaceHolder = "description filter      "
+	filterentry.PlaceHolder = "search, Enter    "
 	filterentry.Scroll = container.ScrollNone
 	filterentry.Wrapping = fyne.TextWrapOff
 
@@ -64,72 +63,414 @@ func main_window(w fyne.Window) {
 	toggleonall := widget.NewButtonWithIcon("", theme.ConfirmIcon(), func() {})
 	toggleoffall := widget.NewButtonWithIcon("", theme.ContentClearIcon(), func() {})
 	copylogs := widget.NewButtonWithIcon("", theme.ContentCopyIcon(), func() {})
+	// the failures of the db, counted as they are not all shown
+	dberror := widget.NewLabel("")
+	dberror.Importance = widget.DangerImportance
+	dberror.Wrapping = fyne.TextWrapWord
+	dberror.Hide()
 	filtercheckboxes := container.NewVBox(
+		dberror,
 		container.NewHBox(toggleoffall, toggleonall, copylogs, filterchecks, filterentry),
 		container.NewHBox(filterchoices, filtererrors),
 	)
 
 	right := container.NewBorder(nil, filtercheckboxes, nil, nil, logscroll)
 
-	content := container.NewBorder(nil, nil, left, nil, right)
+	// nobody must mistake a test node for the real one
+	var top fyne.CanvasObject
+	if ActiveNetwork != MAINNET {
+		banner := widget.NewLabelWithStyle(strings.ToUpper(ActiveNetwork.String())+": coins without value",
+			fyne.TextAlignCenter, fyne.TextStyle{Bold: true})
+		banner.Importance = widget.WarningImportance
+		top = banner
+	}
 
+	content := container.NewBorder(top, nil, left, nil, right)
+
+	// the window only shows the latest logs if it cannot keep up, the db
+	// has all of them
 	sessionlogs := make([]*Log, 0)
-	done := make(chan bool)
-	go func() {
-		for {
-			select {
-			case l := <-logs:
-				bold := false
-				if l.logType == ERROR || l.logType == FATAL {
-					bold = true
+	sessionstart := time.Now()
+	// while the results of a search or the logs of another period are shown,
+	// the session logs are only kept
+	searching := false
+	// changed by every view, so a page loaded late does not replace the next
+	view := 0
+	// the log types checked, NORMAL always
+	selectedtypes := func() []LogType {
+		var logtypes []LogType
+		for lt := LogType(NORMAL); lt <= DEBUG; lt++ {
+			if lt == NORMAL || slices.ContainsFunc(filtererrors.Selected, func(s string) bool {
+				return strings.HasPrefix(s, lt.String())
+			}) {
+				logtypes = append(logtypes, lt)
+			}
+		}
+		return logtypes
+	}
+	// a copy of the categories and types checked, taken on the UI goroutine
+	// as the filters change and read with mw_mutex held, as the logs come
+	// from the bus
+	showncategories := slices.Clone(filterchecks.Selected)
+	showntypes := selectedtypes()
+	shown := func(l *Log) bool {
+		return slices.Contains(showncategories, l.category()) && slices.Contains(showntypes, l.logType)
+	}
+	showsession := func() {
+		segments := []widget.RichTextSegment{&widget.TextSegment{Text: "Session entries:"}}
+		mw_mutex.Lock()
+		for _, l := range sessionlogs {
+			if shown(l) {
+				segments = append(segments, log_segments(l, logwidget.Refresh)...)
+			}
+		}
+		searching = false
+		view++
+		logwidget.Segments = segments
+		logwidget.Refresh()
+		logscroll.ScrollToBottom()
+		mw_mutex.Unlock()
+	}
+	Logs.register("gui", LogSinkFunc(func(l *Log) error {
+		segments := log_segments(l, logwidget.Refresh)
+		// Fyne may have some race conditions, we need mutex
+		mw_mutex.Lock()
+		sessionlogs = append(sessionlogs, l)
+		if !searching && shown(l) {
+			logwidget.Segments = append(logwidget.Segments, segments...)
+			logwidget.Refresh()
+			logscroll.ScrollToBottom()
+		}
+		mw_mutex.Unlock()
+		return nil
+	}), 1000, DROP_OLDEST)
+
+	var refilter func()
+	filterentry.OnSubmitted = func(query string) {
+		if strings.TrimSpace(query) == "" {
+			refilter()
+			return
+		}
+		logtypes := selectedtypes()
+		last := filter_duration(filterchoices.Selected, sessionstart)
+		selected := slices.Clone(filterchecks.Selected)
+		mw_mutex.Lock()
+		view++
+		current := view
+		mw_mutex.Unlock()
+		go func() {
+			results, err := SearchLog(query, last, logtypes, nil, selected, SearchLimit)
+			if err != nil {
+				dialog.ShowError(err, w)
+				return
+			}
+			segments := []widget.RichTextSegment{
+				&widget.TextSegment{Text: fmt.Sprintf("%v results for %v, the best first:", len(results), query)},
+			}
+			for _, sr := range results {
+				segments = append(segments, search_segments(sr)...)
+			}
+			mw_mutex.Lock()
+			defer mw_mutex.Unlock()
+			if view != current {
+				return
+			}
+			searching = true
+			logwidget.Segments = segments
+			logwidget.Refresh()
+			logscroll.ScrollToTop()
+		}()
+	}
+	// the logs of the period chosen, LogPageSize at a time from the newest,
+	// with a link at the top to load the older ones
+	showhistory := func() {
+		logs := SelectLogs().Since(filter_duration(filterchoices.Selected, sessionstart)).
+			Types(selectedtypes()...).Categories(slices.Clone(filterchecks.Selected)...)
+		header := []widget.RichTextSegment{&widget.TextSegment{Text: filterchoices.Selected + " entries:"}}
+		mw_mutex.Lock()
+		view++
+		current := view
+		mw_mutex.Unlock()
+		var shownlogs []widget.RichTextSegment
+		var older func(cursor LogCursor)
+		older = func(cursor LogCursor) {
+			go func() {
+				page := *logs
+				pagelogs, next, err := page.After(cursor).Page(ServicesContext, LogPageSize)
+				if err != nil {
+					dialog.ShowError(err, w)
+					return
 				}
-				segment := widget.TextSegment{
-					Text: l.String(),
-					Style: widget.RichTextStyle{
-						TextStyle: fyne.TextStyle{
-							Bold: bold,
-						},
-					},
+				var segments []widget.RichTextSegment
+				for i := len(pagelogs) - 1; i >= 0; i-- {
+					segments = append(segments, log_segments(&pagelogs[i], logwidget.Refresh)...)
 				}
-				// Fyne may have some race conditions, we need mutex
 				mw_mutex.Lock()
-				logwidget.Segments = append(logwidget.Segments, &segment)
-				sessionlogs = append(sessionlogs, l)
+				defer mw_mutex.Unlock()
+				if view != current {
+					return
+				}
+				shownlogs = append(segments, shownlogs...)
+				top := header
+				if !next.IsZero() {
+					link := &widget.HyperlinkSegment{Text: "▴ older entries"}
+					link.OnTapped = func() { older(next) }
+					// the empty segment ends the line
+					top = []widget.RichTextSegment{link, &widget.TextSegment{}}
+				}
+				searching = true
+				logwidget.Segments = append(slices.Clone(top), shownlogs...)
 				logwidget.Refresh()
-				logscroll.ScrollToBottom()
-				mw_mutex.Unlock()
-				errs, fatal := LogToDb(l)
-				if errs != nil && fatal {
-					dialog.ShowError(errors.Join(errs...), w)
+				if cursor.IsZero() {
+					logscroll.ScrollToBottom()
 				}
-				// TODO remove once the dependencies are installed
-			case <-lndIsReady:
-				mw_mutex.Lock()
-				logwidget.Segments = append(logwidget.Segments, &widget.TextSegment{Text: "lnd is ready"})
-				// logwidget.Refresh()
-				logscroll.ScrollToBottom()
-				mw_mutex.Unlock()
-			case <-done:
-				return
-			}
+			}()
+		}
+		older(LogCursor{})
+	}
+	// a change of the filters shows the session or the period again, or
+	// searches again
+	refilter = func() {
+		switch {
+		case strings.TrimSpace(filterentry.Text) != "":
+			filterentry.OnSubmitted(filterentry.Text)
+		case filterchoices.Selected == "Session":
+			showsession()
+		default:
+			showhistory()
+		}
+	}
+	filterchecks.OnChanged = func(selected []string) {
+		mw_mutex.Lock()
+		showncategories = slices.Clone(selected)
+		mw_mutex.Unlock()
+		refilter()
+	}
+	filtererrors.OnChanged = func([]string) {
+		logtypes := selectedtypes()
+		mw_mutex.Lock()
+		showntypes = logtypes
+		mw_mutex.Unlock()
+		refilter()
+	}
+	filterchoices.OnChanged = func(string) { refilter() }
+	toggleonall.OnTapped = func() { filterchecks.SetSelected(slices.Clone(categories)) }
+	toggleoffall.OnTapped = func() { filterchecks.SetSelected(nil) }
+	// the logs of the filters and search shown, newest first
+	copylogs.OnTapped = func() {
+		logtypes := selectedtypes()
+		last := filter_duration(filterchoices.Selected, sessionstart)
+		selected := slices.Clone(filterchecks.Selected)
+		desc := filterentry.Text
+		export_dialog(w, SelectLogs().Since(last).Types(logtypes...).Categories(selected...).Search(desc))
+	}
+
+	dbfailures := 0
+	var dbshown time.Time
+	Logs.setOnError(func(sink string, l *Log, err error) {
+		if sink != "db" {
+			return
 		}
-	}()
+		mw_mutex.Lock()
+		dbfailures++
+		dberror.SetText(fmt.Sprintf("%v writes of logs to the db failed, the last one: %v", dbfailures, err))
+		dberror.Show()
+		show := time.Since(dbshown) >= DbErrorEvery
+		if show {
+			dbshown = time.Now()
+		}
+		mw_mutex.Unlock()
+		if show {
+			dialog.ShowError(err, w)
+		}
+	})
 
 	w.SetContent(content)
+	if err := ServeControl(ServicesContext, Services); err != nil {
+		Logs.publish(&Log{
+			date:    time.Now(),
+			logType: WARNING,
+			service: "LNBank",
+			desc:    err.Error(),
+		})
+	}
+	if err := Services.startAll(); err != nil {
+		dialog.ShowError(err, w)
+	}
 	w.SetCloseIntercept(func() {
 		// TODO in fact, hide it and minimize to systray
-		logs <- &Log{
+		Logs.publish(&Log{
 			date:    time.Now(),
 			logType: WARNING,
 			service: "LNBank",
 			desc:    "closing all services",
-		}
-		// wait for the last logs to happen
-		ServicesCancelFunc()
-		time.Sleep(time.Millisecond * 100)
-		done <- true
-		time.Sleep(time.Millisecond * 100)
-		w.Close()
+		})
+		go func() {
+			// wait for every service to exit, dependents first
+			ctx, cancel := context.WithTimeout(context.Background(), ShutdownTimeout)
+			defer cancel()
+			if err := Services.stopAll(ctx); err != nil {
+				Logs.publish(&Log{
+					date:    time.Now(),
+					logType: ERROR,
+					service: "LNBank",
+					desc:    "closing without all services stopped: " + err.Error(),
+				})
+			}
+			if err := Logs.close(ctx); err != nil {
+				fmt.Println("Error closing the logs:", err)
+			}
+			ServicesCancelFunc()
+			w.Close()
+		}()
 	})
 	w.ShowAndRun()
 }
+
+// The segments of a log in the log view. A log of several lines, such as a
+// stack trace, is collapsed to its first line with a link to expand it.
+func log_segments(l *Log, refresh func()) []widget.RichTextSegment {
+	style := widget.RichTextStyle{
+		TextStyle: fyne.TextStyle{
+			Bold: l.logType == ERROR || l.logType == FATAL,
+		},
+	}
+	text := l.String()
+	first, more := firstLine(text)
+	if more == 0 {
+		return []widget.RichTextSegment{&widget.TextSegment{Text: text, Style: style}}
+	}
+	style.Inline = true
+	head := &widget.TextSegment{Text: first, Style: style}
+	collapsed := fmt.Sprintf("  ▸ %v more lines", more)
+	link := &widget.HyperlinkSegment{Text: collapsed}
+	link.OnTapped = func() {
+		mw_mutex.Lock()
+		if link.Text == collapsed {
+			head.Text, link.Text = text, "  ▴ collapse"
+		} else {
+			head.Text, link.Text = first, collapsed
+		}
+		refresh()
+		mw_mutex.Unlock()
+	}
+	// the empty segment ends the line
+	return []widget.RichTextSegment{head, link, &widget.TextSegment{}}
+}
+
+// Logs copied at most to the clipboard, files take any number of them
+const ClipboardLimit = 5000
+
+// Export the logs to the clipboard or to a file, in the format chosen and
+// redacted unless unchecked
+func export_dialog(w fyne.Window, logs *LogSelect) {
+	var names []string
+	for _, ef := range ExportFormats {
+		names = append(names, ef.String())
+	}
+	formats := widget.NewRadioGroup(names, func(string) {})
+	formats.Horizontal = true
+	formats.Required = true
+	formats.SetSelected(EXPORT_TEXT.String())
+	redact := widget.NewCheck("hide keys, addresses, invoices and hashes", func(bool) {})
+	redact.SetChecked(true)
+	var d dialog.Dialog
+	export := func(out io.Writer, limit uint) (int, error) {
+		format, err := ParseExportFormat(formats.Selected)
+		if err != nil {
+			return 0, err
+		}
+		var r *Redactor
+		if redact.Checked {
+			r = NewRedactor()
+		}
+		limited := *logs
+		return ExportLogs(out, limited.Limit(limit).All(ServicesContext), format, r)
+	}
+	tocopy := widget.NewButtonWithIcon("Copy", theme.ContentCopyIcon(), func() {
+		d.Hide()
+		var text strings.Builder
+		n, err := export(&text, ClipboardLimit)
+		if err != nil {
+			dialog.ShowError(err, w)
+			return
+		}
+		w.Clipboard().SetContent(text.String())
+		dialog.ShowInformation("Logs copied", fmt.Sprintf("%v logs copied to the clipboard", n), w)
+	})
+	tofile := widget.NewButtonWithIcon("Save…", theme.DocumentSaveIcon(), func() {
+		d.Hide()
+		format, _ := ParseExportFormat(formats.Selected)
+		save := dialog.NewFileSave(func(file fyne.URIWriteCloser, err error) {
+			if err != nil || file == nil {
+				return
+			}
+			go func() {
+				n, err := export(file, 0)
+				if cerr := file.Close(); err == nil {
+					err = cerr
+				}
+				if err != nil {
+					dialog.ShowError(err, w)
+					return
+				}
+				dialog.ShowInformation("Logs exported", fmt.Sprintf("%v logs exported to %v", n, file.URI().Name()), w)
+			}()
+		}, w)
+		save.SetFileName(ExportFileName(time.Now(), format))
+		save.Show()
+	})
+	d = dialog.NewCustom("Export the logs shown", "Cancel",
+		container.NewVBox(formats, redact, container.NewHBox(layout.NewSpacer(), tocopy, tofile)), w)
+	d.Show()
+}
+
+// Logs loaded at a time in the log view for a period other than the session
+const LogPageSize = 200
+
+// Results shown by a search in the log view
+const SearchLimit = 500
+
+// A failing db fails every log, so its error is shown at most this often
+const DbErrorEvery = time.Minute * 10
+
+// How far back the logs are searched for a choice of the log view
+func filter_duration(choice string, sessionstart time.Time) time.Duration {
+	switch choice {
+	case "Session":
+		return time.Since(sessionstart)
+	case "Month":
+		return time.Hour * 24 * 30
+	case "Week":
+		return time.Hour * 24 * 7
+	case "Day":
+		return time.Hour * 24
+	case "Hour":
+		return time.Hour
+	}
+	return time.Since(time.Unix(0, 0))
+}
+
+// The segments of a search result in the log view, its snippet with the
+// terms found in bold
+func search_segments(sr SearchResult) []widget.RichTextSegment {
+	inline := widget.RichTextStyle{Inline: true}
+	found := widget.RichTextStyle{Inline: true, ColorName: theme.ColorNamePrimary, TextStyle: fyne.TextStyle{Bold: true}}
+	segments := []widget.RichTextSegment{&widget.TextSegment{
+		Text:  fmt.Sprintf("%v %v %v: ", sr.source(), sr.logType, sr.date.Format(time.Stamp)),
+		Style: inline,
+	}}
+	snippet := strings.ReplaceAll(sr.snippet, "\n", " ")
+	for snippet != "" {
+		before, rest, ok := strings.Cut(snippet, HighlightStart)
+		segments = append(segments, &widget.TextSegment{Text: before, Style: inline})
+		if !ok {
+			break
+		}
+		term, after, _ := strings.Cut(rest, HighlightEnd)
+		segments = append(segments, &widget.TextSegment{Text: term, Style: found})
+		snippet = after
+	}
+	// the empty segment ends the line
+	return append(segments, &widget.TextSegment{})
+}
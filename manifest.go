@@ -0,0 +1,463 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Directory under ServiceRootDir with the manifests of the services that
+// LNBank supervises besides the built in ones
+const ManifestDir = "services.d"
+
+// A program described by a YAML file in ManifestDir, for example:
+//
+//	name: LNDg
+//	version: v1.8.0
+//	exec: lndg/.venv/bin/python
+//	args: [manage.py, runserver, "localhost:8889"]
+//	dir: lndg
+//	env:
+//	  LND_DIR: ${LNBANK}/lnd
+//	depends: [Lnd]
+//	log:
+//	  pattern: '^\[(?P<time>[^\]]+)\] (?P<level>\w+) (?P<subsystem>\w+) (?P<message>.*)$'
+//	  time_format: 02/Jan/2006 15:04:05
+//	  categories:
+//	    rebalancer: channels
+//	ready:
+//	  tcp: localhost:8889
+//	liveness:
+//	  http: http://localhost:8889/
+//	restart:
+//	  policy: always
+//	  retries: 10
+//
+// Relative paths are relative to ServiceRootDir. ${LNBANK} is replaced by it
+// in every value, and so are the variables of env.
+type Manifest struct {
+	Name    string            `yaml:"name"`
+	Version string            `yaml:"version"`
+	Exec    string            `yaml:"exec"`
+	Args    []string          `yaml:"args"`
+	Dir     string            `yaml:"dir"`
+	Env     map[string]string `yaml:"env"`
+	Depends []string          `yaml:"depends"`
+	// command run to stop it cleanly, SIGTERM when empty
+	Stop []string `yaml:"stop"`
+
+	Log struct {
+		// regular expression with the named groups time, level, subsystem
+		// and message. Any other named group is kept as a field of the log.
+		// Lines not matching it are logged as they are.
+		Pattern    string `yaml:"pattern"`
+		TimeFormat string `yaml:"time_format"`
+		// names of its levels that LNBank does not know, to one it does
+		Levels map[string]string `yaml:"levels"`
+		// category of the logs of each subsystem, named after the service
+		// when missing
+		Categories map[string]string `yaml:"categories"`
+	} `yaml:"log"`
+
+	Ready struct {
+		// regular expression matched against the messages of its log
+		Log            string `yaml:"log"`
+		ManifestProbes `yaml:",inline"`
+	} `yaml:"ready"`
+	// checked periodically while it is ready
+	Liveness ManifestProbes `yaml:"liveness"`
+
+	Restart struct {
+		Policy     string        `yaml:"policy"`
+		Backoff    time.Duration `yaml:"backoff"`
+		MaxBackoff time.Duration `yaml:"max_backoff"`
+		Retries    int           `yaml:"retries"`
+		Window     time.Duration `yaml:"window"`
+	} `yaml:"restart"`
+
+	file    string
+	pattern *regexp.Regexp
+	ready   *regexp.Regexp
+}
+
+// Probes of a manifest, each one checked when not empty
+type ManifestProbes struct {
+	// host:port that accepts connections
+	Tcp string `yaml:"tcp"`
+	// host:port of a SOCKS5 proxy
+	Socks string `yaml:"socks"`
+	// url that answers a GET without a server error
+	Http string `yaml:"http"`
+}
+
+// Replace ${LNBANK}, the variables of env and the environment variables in
+// value
+func (m *Manifest) expand(value string) string {
+	return os.Expand(value, func(name string) string {
+		if name == "LNBANK" {
+			return ServiceRootDir
+		}
+		if value, ok := m.Env[name]; ok {
+			return value
+		}
+		return os.Getenv(name)
+	})
+}
+
+// Make a path from a manifest absolute
+func (m *Manifest) path(path string) string {
+	path = m.expand(path)
+	if strings.HasPrefix(path, "~/") {
+		if home, err := os.UserHomeDir(); err == nil {
+			path = filepath.Join(home, path[2:])
+		}
+	}
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(ServiceRootDir, path)
+	}
+	return path
+}
+
+// The name of a service is in the names of its files and its settings
+var manifestName = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// Services LNBank has already, whatever the case
+var reservedNames = []string{"tor", "lnd", "lnbank"}
+
+// Parse and check a manifest
+func ParseManifest(content []byte, file string) (*Manifest, error) {
+	m := &Manifest{file: file}
+	if err := yaml.Unmarshal(content, m); err != nil {
+		return nil, fmt.Errorf("%v: %w", file, err)
+	}
+	var errs []error
+	switch {
+	case m.Name == "":
+		errs = append(errs, errors.New("missing name"))
+	case !manifestName.MatchString(m.Name):
+		errs = append(errs, fmt.Errorf("name %q is not only letters, digits, _ and -", m.Name))
+	case slices.Contains(reservedNames, strings.ToLower(m.Name)):
+		errs = append(errs, fmt.Errorf("name %q is taken by LNBank", m.Name))
+	}
+	if m.Exec == "" {
+		errs = append(errs, errors.New("missing exec"))
+	}
+	var err error
+	if m.Log.Pattern != "" {
+		if m.pattern, err = regexp.Compile(m.Log.Pattern); err != nil {
+			errs = append(errs, fmt.Errorf("log pattern: %w", err))
+		} else if !slices.Contains(m.pattern.SubexpNames(), "message") {
+			errs = append(errs, errors.New("log pattern has no message group"))
+		}
+	}
+	if m.Ready.Log != "" {
+		if m.ready, err = regexp.Compile(m.Ready.Log); err != nil {
+			errs = append(errs, fmt.Errorf("ready log: %w", err))
+		}
+	}
+	if m.Restart.Policy != "" {
+		if _, err := ParseRestartPolicy(m.Restart.Policy); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	for level, name := range m.Log.Levels {
+		if _, err := ParseLogType(name); err != nil {
+			errs = append(errs, fmt.Errorf("level %v: %w", level, err))
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		return nil, fmt.Errorf("%v: %w", file, err)
+	}
+	return m, nil
+}
+
+// Read all the manifests in dir. A broken manifest doesn't prevent loading
+// the others.
+func LoadManifests(dir string) ([]*Manifest, error) {
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var manifests []*Manifest
+	var errs []error
+	for _, entry := range entries {
+		ext := filepath.Ext(entry.Name())
+		if entry.IsDir() || (ext != ".yaml" && ext != ".yml") {
+			continue
+		}
+		file := filepath.Join(dir, entry.Name())
+		content, err := os.ReadFile(file)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		m, err := ParseManifest(content, file)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		manifests = append(manifests, m)
+	}
+	return manifests, errors.Join(errs...)
+}
+
+// The restart configuration of the manifest, with the defaults for what it
+// doesn't set
+func (m *Manifest) restartConfig() RestartConfig {
+	rc := DefaultRestartConfig
+	if policy, err := ParseRestartPolicy(m.Restart.Policy); err == nil {
+		rc.policy = policy
+	}
+	if m.Restart.Backoff > 0 {
+		rc.backoff = m.Restart.Backoff
+	}
+	if m.Restart.MaxBackoff > 0 {
+		rc.maxBackoff = m.Restart.MaxBackoff
+	}
+	if m.Restart.Retries > 0 {
+		rc.maxRetries = m.Restart.Retries
+	}
+	if m.Restart.Window > 0 {
+		rc.window = m.Restart.Window
+	}
+	return rc
+}
+
+// Manifests of the registered services, by name
+var Manifests = make(map[string]*Manifest)
+
+// Generic Service for the programs described by a manifest
+type ManifestService struct {
+	manifest *Manifest
+	onReady  func()
+	onStop   func(*Log)
+	onLog    func(*Log)
+	ctx      context.Context
+}
+
+func (ms ManifestService) fmtLog(lt LogType, desc string) *Log {
+	return &Log{
+		date:    time.Now(),
+		desc:    desc,
+		logType: lt,
+		service: ms.manifest.Name,
+	}
+}
+
+// Check that the executable exists and create its working directory
+func (ms ManifestService) install(onLog func(*Log)) error {
+	m := ms.manifest
+	if _, err := ms.exePath(); err != nil {
+		return fmt.Errorf("executable of %v: %w", m.Name, err)
+	}
+	if m.Dir != "" {
+		if err := os.MkdirAll(m.path(m.Dir), 0755); err != nil {
+			return fmt.Errorf("cannot create the directory of %v: %w", m.Name, err)
+		}
+	}
+	return nil
+}
+
+// Path of the executable. A bare name is looked up in the PATH.
+func (ms ManifestService) exePath() (string, error) {
+	return ms.manifest.resolveExe(ms.manifest.Exec)
+}
+
+func (m *Manifest) resolveExe(exe string) (string, error) {
+	exe = m.expand(exe)
+	if !strings.ContainsAny(exe, `/\`) {
+		return exec.LookPath(exe)
+	}
+	exe = m.path(exe)
+	if _, err := os.Stat(exe); err != nil {
+		return "", err
+	}
+	return exe, nil
+}
+
+func (ms ManifestService) command(ctx context.Context, exe string, args []string) *exec.Cmd {
+	m := ms.manifest
+	expanded := make([]string, 0, len(args))
+	for _, arg := range args {
+		expanded = append(expanded, m.expand(arg))
+	}
+	cmd := exec.CommandContext(ctx, exe, expanded...)
+	if m.Dir != "" {
+		cmd.Dir = m.path(m.Dir)
+	}
+	// the allowed variables of LNBank are added when it is isolated
+	cmd.Env = make([]string, 0, len(m.Env))
+	for key, value := range m.Env {
+		cmd.Env = append(cmd.Env, key+"="+m.expand(value))
+	}
+	return cmd
+}
+
+// Implement the Service interface
+func (ms ManifestService) start(ctx context.Context, onReady func(), onStop func(*Log), onLog func(*Log)) {
+	ms.onReady = onReady
+	ms.onStop = onStop
+	ms.onLog = onLog
+	ms.ctx = ctx
+
+	if log, adopted := HandleOrphan(ctx, ms); adopted {
+		onStop(log)
+		return
+	}
+
+	exe, err := ms.exePath()
+	if err != nil {
+		log := ms.fmtLog(FATAL, "executable of "+ms.manifest.Name+": "+err.Error())
+		go onLog(log)
+		go onStop(log)
+		return
+	}
+	onStop(ScanCommand(ctx, ms, ms.command(context.Background(), exe, ms.manifest.Args)))
+}
+
+func (mp ManifestProbes) probes() []Probe {
+	var probes []Probe
+	if mp.Tcp != "" {
+		probes = append(probes, TcpProbe{func() string { return mp.Tcp }})
+	}
+	if mp.Socks != "" {
+		probes = append(probes, SocksProbe{func() string { return mp.Socks }})
+	}
+	if mp.Http != "" {
+		probes = append(probes, HttpProbe{func() string { return mp.Http }})
+	}
+	return probes
+}
+
+// Nothing in its log tells when it is ready, so it is as soon as it runs and
+// answers its readiness probes
+func (ms ManifestService) readyOnStart() bool {
+	return ms.manifest.ready == nil
+}
+
+func (ms ManifestService) probes() ([]Probe, []Probe) {
+	return ms.manifest.Ready.probes(), ms.manifest.Liveness.probes()
+}
+
+func (ms ManifestService) onLogHook() func(*Log) {
+	return ms.onLog
+}
+
+func (ms ManifestService) onReadyHook() func() {
+	return ms.onReady
+}
+
+func (ms ManifestService) getConfigFile() (string, error) {
+	return ms.manifest.file, nil
+}
+
+func (ms ManifestService) name() string {
+	return ms.manifest.Name
+}
+
+func (ms ManifestService) dependencies() []string {
+	return ms.manifest.Depends
+}
+
+// Run the stop command of the manifest, or send SIGTERM without one
+func (ms ManifestService) shutdown(cmd *exec.Cmd) error {
+	m := ms.manifest
+	if len(m.Stop) == 0 {
+		return cmd.Process.Signal(syscall.SIGTERM)
+	}
+	exe, err := m.resolveExe(m.Stop[0])
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	stop := ms.command(ctx, exe, m.Stop[1:])
+	if output, err := stop.CombinedOutput(); err != nil {
+		return fmt.Errorf("%v: %v %s", strings.Join(m.Stop, " "), err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// The level of a log line, using the level names of the manifest first
+func (ms ManifestService) logType(level string) LogType {
+	if name, ok := ms.manifest.Log.Levels[level]; ok {
+		level = name
+	}
+	if lt, err := ParseLogType(level); err == nil {
+		return lt
+	}
+	switch strings.ToUpper(level) {
+	case "CRIT", "CRITICAL", "CRT", "PANIC", "EMERG", "ALERT":
+		return FATAL
+	case "ERR":
+		return ERROR
+	case "WARN", "WRN":
+		return WARNING
+	case "INF", "NOTICE":
+		return INFO
+	case "DBG", "TRACE", "TRC":
+		return DEBUG
+	}
+	return NORMAL
+}
+
+// Split a line with the log pattern of the manifest
+func (ms ManifestService) parseLogEntry(line string) (Log, error) {
+	m := ms.manifest
+	l := Log{date: time.Now(), logType: NORMAL, desc: line, service: m.Name}
+	if m.pattern == nil {
+		return l, nil
+	}
+	match := m.pattern.FindStringSubmatch(line)
+	if match == nil {
+		// a continuation of the previous line, or something printed outside
+		// the logger
+		return l, errNotAnEntry
+	}
+	for i, group := range m.pattern.SubexpNames() {
+		switch group {
+		case "time":
+			if m.Log.TimeFormat == "" {
+				continue
+			}
+			t, err := time.ParseInLocation(m.Log.TimeFormat, match[i], time.Local)
+			if err != nil {
+				return l, fmt.Errorf("failed to parse timestamp: %v", err)
+			}
+			l.date = t
+		case "level":
+			l.logType = ms.logType(match[i])
+		case "subsystem":
+			l.subsystem = match[i]
+		case "message":
+			l.desc = match[i]
+		case "":
+		default:
+			if match[i] == "" {
+				continue
+			}
+			if l.fields == nil {
+				l.fields = make(map[string]string)
+			}
+			l.fields[group] = match[i]
+		}
+	}
+	errs := l.Validate()
+	return l, errors.Join(errs...)
+}
+
+func (ms ManifestService) isReady(text string, onLog func(*Log)) bool {
+	return ms.manifest.ready != nil && ms.manifest.ready.MatchString(text)
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testManifest = `
+name: Sidecar
+version: v1.0.0
+exec: sh
+args: [-c, 'echo "2024-05-01 10:00:00 [WRN] HTTP: slow start"; echo "listening on ${PORT}"; exec sleep 30']
+env:
+  PORT: "8889"
+depends: [Base]
+log:
+  pattern: '^(?P<time>\S+ \S+) \[(?P<level>\w+)\] (?P<subsystem>\w+):(?: req=(?P<request>\w+))? (?P<message>.*)$'
+  time_format: 2006-01-02 15:04:05
+  levels:
+    WRN: warning
+  categories:
+    http: Network
+ready:
+  log: '^listening on \d+$'
+restart:
+  policy: never
+  backoff: 2s
+`
+
+func TestParseManifest(t *testing.T) {
+	m, err := ParseManifest([]byte(testManifest), "sidecar.yaml")
+	assert.NoError(t, err)
+	assert.Equal(t, "Sidecar", m.Name)
+	assert.Equal(t, []string{"Base"}, m.Depends)
+	rc := m.restartConfig()
+	assert.Equal(t, RESTART_NEVER, rc.policy)
+	assert.Equal(t, time.Second*2, rc.backoff)
+	assert.Equal(t, DefaultRestartConfig.maxRetries, rc.maxRetries)
+
+	_, err = ParseManifest([]byte("exec: sh\nlog:\n  pattern: '(?P<level>\\w+)'\nrestart:\n  policy: sometimes\n"), "bad.yaml")
+	assert.ErrorContains(t, err, "missing name")
+	assert.ErrorContains(t, err, "no message group")
+	assert.ErrorContains(t, err, "unknown restart policy")
+
+	// the name goes into file names
+	_, err = ParseManifest([]byte("name: ../x\nexec: sh\n"), "bad.yaml")
+	assert.ErrorContains(t, err, `name "../x" is not only letters`)
+	_, err = ParseManifest([]byte("name: a/b\nexec: sh\n"), "bad.yaml")
+	assert.Error(t, err)
+	_, err = ParseManifest([]byte("name: LND\nexec: sh\n"), "bad.yaml")
+	assert.ErrorContains(t, err, `name "LND" is taken by LNBank`)
+	_, err = ParseManifest([]byte("name: my_side-car2\nexec: sh\n"), "good.yaml")
+	assert.NoError(t, err)
+}
+
+func TestManifestParseLogEntry(t *testing.T) {
+	m, err := ParseManifest([]byte(testManifest), "sidecar.yaml")
+	assert.NoError(t, err)
+	ms := ManifestService{manifest: m}
+
+	l, err := ms.parseLogEntry("2024-05-01 10:00:00 [WRN] HTTP: slow start")
+	assert.NoError(t, err)
+	assert.Equal(t, LogType(WARNING), l.logType)
+	assert.Equal(t, "slow start", l.desc)
+	assert.Equal(t, "Sidecar", l.service)
+	assert.Equal(t, "HTTP", l.subsystem)
+	assert.Nil(t, l.fields)
+	assert.Equal(t, time.Date(2024, 5, 1, 10, 0, 0, 0, time.Local), l.date)
+
+	// the groups besides the known ones are fields
+	l, err = ms.parseLogEntry("2024-05-01 10:00:01 [INF] DB: req=a1 done")
+	assert.NoError(t, err)
+	assert.Equal(t, "done", l.desc)
+	assert.Equal(t, map[string]string{"request": "a1"}, l.fields)
+
+	// lines not following the pattern are kept as they are, as part of the
+	// previous entry if there is one
+	l, err = ms.parseLogEntry("  at main.go:12")
+	assert.ErrorIs(t, err, errNotAnEntry)
+	assert.Equal(t, LogType(NORMAL), l.logType)
+	assert.Equal(t, "  at main.go:12", l.desc)
+
+	assert.Equal(t, LogType(ERROR), ms.logType("ERR"))
+	assert.Equal(t, LogType(FATAL), ms.logType("critical"))
+	assert.Equal(t, LogType(NORMAL), ms.logType("whatever"))
+}
+
+func TestLoadManifests(t *testing.T) {
+	dir := t.TempDir()
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "sidecar.yaml"), []byte(testManifest), 0644))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "broken.yml"), []byte("name: [broken"), 0644))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "README"), []byte("not a manifest"), 0644))
+	manifests, err := LoadManifests(dir)
+	assert.ErrorContains(t, err, "broken.yml")
+	if assert.Len(t, manifests, 1) {
+		assert.Equal(t, "Sidecar", manifests[0].Name)
+	}
+
+	manifests, err = LoadManifests(filepath.Join(dir, "missing"))
+	assert.NoError(t, err)
+	assert.Empty(t, manifests)
+}
+
+func TestManifestService(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("needs sh")
+	}
+	m, err := ParseManifest([]byte(testManifest), "sidecar.yaml")
+	assert.NoError(t, err)
+	s := newTestSupervisor(t, fakeService{"Base", nil}, ManifestService{manifest: m})
+	var mutex sync.Mutex
+	var logs []*Log
+	s.setOnLog(func(l *Log) {
+		mutex.Lock()
+		logs = append(logs, l)
+		mutex.Unlock()
+	})
+
+	assert.NoError(t, s.start("Sidecar"))
+	assertState(t, s, "Sidecar", READY)
+	mutex.Lock()
+	var warning *Log
+	for _, l := range logs {
+		if l.service == "Sidecar" && l.logType == WARNING {
+			warning = l
+		}
+	}
+	mutex.Unlock()
+	if assert.NotNil(t, warning) {
+		// the line out of the pattern is part of it
+		assert.Equal(t, "slow start\nlistening on 8889", warning.desc)
+		assert.Equal(t, "HTTP", warning.subsystem)
+	}
+
+	assert.NoError(t, s.stop("Sidecar"))
+	assertState(t, s, "Sidecar", STOPPED)
+}
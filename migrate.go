@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+// Version of the log table created by LogTable, kept in the user_version of
+// the db. Every change of the table adds a migration and a version.
+const LogSchemaVersion = 2
+
+// The statements taking the log table from version i to i+1
+var logMigrations = []string{
+	// 1: timestamps in nanoseconds instead of seconds, and an id in the order
+	// the logs were stored. The triggers of the search index are dropped with
+	// the old table and the index is rebuilt by CreateLogSearch.
+	`
+DROP TRIGGER IF EXISTS log_fts_insert;
+DROP TRIGGER IF EXISTS log_fts_delete;
+DROP TRIGGER IF EXISTS log_fts_update;
+CREATE TABLE log_v1 (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    timestamp INTEGER NOT NULL, -- unix nanoseconds
+    type_id TINYINT NOT NULL,
+    service VARCHAR(8) NOT NULL COLLATE NOCASE,
+    desc TEXT NOT NULL COLLATE NOCASE
+);
+INSERT INTO log_v1 (timestamp, type_id, service, desc)
+    SELECT timestamp * 1000000000, type_id, service, desc FROM log ORDER BY timestamp, rowid;
+DROP TABLE log;
+ALTER TABLE log_v1 RENAME TO log;
+CREATE INDEX log_idx ON log (timestamp, type_id, service COLLATE NOCASE);
+`,
+	// 2: subsystem, category and fields
+	logCategoriesMigration(),
+}
+
+// Bring the log table of db to LogSchemaVersion, each migration in its own
+// transaction. It returns the version the table had.
+func MigrateLogs(ctx context.Context, db *sql.DB) (int, error) {
+	var version int
+	if err := db.QueryRowContext(ctx, "PRAGMA user_version").Scan(&version); err != nil {
+		return 0, err
+	}
+	if version > LogSchemaVersion {
+		return version, fmt.Errorf("the log table is of version %v, newer than the %v of this LNBank", version, LogSchemaVersion)
+	}
+	for v := version; v < LogSchemaVersion; v++ {
+		if err := migrateLogs(ctx, db, v); err != nil {
+			return version, fmt.Errorf("cannot migrate the log table to version %v: %w", v+1, err)
+		}
+	}
+	return version, nil
+}
+
+func migrateLogs(ctx context.Context, db *sql.DB, from int) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, logMigrations[from]); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, fmt.Sprintf("PRAGMA user_version = %d", from+1)); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// The log table before LogSchemaVersion 1, in seconds and without id
+const logTableV0 = `
+CREATE TABLE IF NOT EXISTS log (
+    timestamp INTEGER NOT NULL ,
+    type_id TINYINT NOT NULL,
+    service VARCHAR(8) NOT NULL COLLATE NOCASE,
+    desc TEXT NOT NULL COLLATE NOCASE
+);
+create index log_idx on log (timestamp, type_id, service COLLATE NOCASE);
+`
+
+func TestMigrateLogs(t *testing.T) {
+	ctx := context.Background()
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "migrate.sqlite3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	_, err = db.Exec(logTableV0)
+	assert.NoError(t, err)
+	// the same second, stored in this order
+	for _, desc := range []string{"first", "second", "third"} {
+		_, err = db.Exec("INSERT INTO log (timestamp, type_id, desc, service) VALUES (1700000000, 4, ?, 'Lnd')", desc)
+		assert.NoError(t, err)
+	}
+	_, err = db.Exec("INSERT INTO log (timestamp, type_id, desc, service) VALUES (1600000000, 3, 'older', 'Tor')")
+	assert.NoError(t, err)
+	version, err := MigrateLogs(ctx, db)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, version)
+	rows, err := db.Query("SELECT id, timestamp, desc FROM log ORDER BY timestamp, id")
+	assert.NoError(t, err)
+	var descs []string
+	var ids []int64
+	for rows.Next() {
+		var id, timestamp int64
+		var desc string
+		assert.NoError(t, rows.Scan(&id, &timestamp, &desc))
+		descs = append(descs, desc)
+		ids = append(ids, id)
+		if desc == "older" {
+			assert.Equal(t, time.Unix(1600000000, 0), time.Unix(0, timestamp))
+		}
+	}
+	assert.NoError(t, rows.Err())
+	assert.Equal(t, []string{"older", "first", "second", "third"}, descs)
+	assert.Equal(t, []int64{1, 2, 3, 4}, ids)
+	var index int
+	assert.NoError(t, db.QueryRow("SELECT count(*) FROM sqlite_master WHERE name='log_idx'").Scan(&index))
+	assert.Equal(t, 1, index)
+
+	if ftsLogs {
+		// indexed again with the new ids
+		assert.NoError(t, CreateLogSearch(ctx, db))
+		var id int64
+		assert.NoError(t, db.QueryRow("SELECT rowid FROM log_fts WHERE log_fts MATCH 'second'").Scan(&id))
+		assert.Equal(t, int64(3), id)
+		_, err = db.Exec("INSERT INTO log (timestamp, type_id, desc, service) VALUES (?, 4, 'fourth', 'Lnd')", time.Now().UnixNano())
+		assert.NoError(t, err)
+		assert.NoError(t, db.QueryRow("SELECT rowid FROM log_fts WHERE log_fts MATCH 'fourth'").Scan(&id))
+		assert.Equal(t, int64(5), id)
+	}
+
+	version, err = MigrateLogs(ctx, db)
+	assert.NoError(t, err)
+	assert.Equal(t, LogSchemaVersion, version)
+	_, err = db.Exec("PRAGMA user_version = 99")
+	assert.NoError(t, err)
+	_, err = MigrateLogs(ctx, db)
+	assert.ErrorContains(t, err, "newer")
+}
+
+func TestMigrateLogCategories(t *testing.T) {
+	ctx := context.Background()
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "migrate.sqlite3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	_, err = db.Exec(logTableV0)
+	assert.NoError(t, err)
+	assert.NoError(t, migrateLogs(ctx, db, 0))
+	// lnd logs used to be stored with their subsystem as service
+	for _, service := range []string{"HSWC", "BTCN", "Lnd", "Tor", "LNBits"} {
+		_, err = db.Exec("INSERT INTO log (timestamp, type_id, desc, service) VALUES (?, 4, 'log', ?)", time.Now().UnixNano(), service)
+		assert.NoError(t, err)
+	}
+	version, err := MigrateLogs(ctx, db)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, version)
+
+	rows, err := db.Query("SELECT service, subsystem, category, fields FROM log ORDER BY id")
+	assert.NoError(t, err)
+	defer rows.Close()
+	var got [][4]string
+	for rows.Next() {
+		var row [4]string
+		assert.NoError(t, rows.Scan(&row[0], &row[1], &row[2], &row[3]))
+		got = append(got, row)
+	}
+	assert.NoError(t, rows.Err())
+	assert.Equal(t, [][4]string{
+		{"Lnd", "HSWC", CATEGORY_HTLC, ""},
+		{"Lnd", "BTCN", CATEGORY_NEUTRINO, ""},
+		{"Lnd", "", CATEGORY_NODE, ""},
+		{"Tor", "", CATEGORY_TOR, ""},
+		{"LNBits", "", "lnbits", ""},
+	}, got)
+}
+
+func TestLogTableVersion(t *testing.T) {
+	db := retentionDb(t)
+	version, err := MigrateLogs(context.Background(), db)
+	assert.NoError(t, err)
+	assert.Equal(t, LogSchemaVersion, version, "LogTable is of the latest version")
+}
+
+func TestQueryLogOrder(t *testing.T) {
+	service := "order" + time.Now().Format("150405.000000000")
+	t.Cleanup(func() {
+		_, err := DB.Exec("DELETE FROM log WHERE service=?", service)
+		assert.NoError(t, err)
+	})
+	// a burst of logs within the same millisecond, and one a microsecond later
+	now := time.Now().Truncate(time.Millisecond)
+	for _, desc := range []string{"a", "b", "c"} {
+		errs, fatal := LogToDb(&Log{date: now, logType: INFO, service: service, desc: desc})
+		assert.False(t, fatal, "%v", errs)
+	}
+	errs, fatal := LogToDb(&Log{date: now.Add(-time.Microsecond), logType: INFO, service: service, desc: "before"})
+	assert.False(t, fatal, "%v", errs)
+
+	q, err := QueryLog(time.Hour, nil, []string{service}, nil, "", 0)
+	assert.NoError(t, err)
+	defer q.close()
+	logs, err := q.getn(10)
+	assert.NoError(t, err)
+	var descs []string
+	for _, l := range logs {
+		descs = append(descs, l.desc)
+		assert.NotZero(t, l.seq)
+	}
+	assert.Equal(t, []string{"c", "b", "a", "before"}, descs)
+	if assert.Len(t, logs, 4) {
+		assert.Equal(t, now.Add(-time.Microsecond), logs[3].date)
+		assert.Greater(t, logs[0].seq, logs[1].seq)
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const ResourceTable = `
+CREATE TABLE IF NOT EXISTS resource (
+    timestamp INTEGER NOT NULL,
+    service VARCHAR(8) NOT NULL COLLATE NOCASE,
+    pid INTEGER NOT NULL,
+    cpu REAL NOT NULL,
+    rss INTEGER NOT NULL,
+    fds INTEGER NOT NULL,
+    read_bytes INTEGER NOT NULL,
+    write_bytes INTEGER NOT NULL
+);
+CREATE INDEX IF NOT EXISTS resource_idx ON resource (service COLLATE NOCASE, timestamp);
+`
+
+// Resources used by a supervised process at a given time
+type ProcessSample struct {
+	date    time.Time
+	service string
+	pid     int
+	// percentage of one core used since the previous sample
+	cpu float64
+	// resident memory in bytes
+	rss uint64
+	// open file descriptors
+	fds int
+	// bytes read from and written to disk since the process started
+	readBytes  uint64
+	writeBytes uint64
+}
+
+func (ps ProcessSample) String() string {
+	return fmt.Sprintf("⚙ %.1f%%  %v MB  %v fds", ps.cpu, ps.rss/1024/1024, ps.fds)
+}
+
+// Raw counters of a process, the CPU time is cumulative
+type processCounters struct {
+	cpuTime    time.Duration
+	rss        uint64
+	fds        int
+	readBytes  uint64
+	writeBytes uint64
+}
+
+// Limits that produce a WARNING when exceeded, 0 means no limit
+type ResourceLimits struct {
+	cpu float64
+	rss uint64
+	fds int
+}
+
+var DefaultResourceLimits = ResourceLimits{
+	cpu: 50,
+	rss: 4096 * 1024 * 1024,
+	fds: 4096,
+}
+
+const DefaultMonitorInterval = time.Second * 10
+
+// Read the resource limits of a service from the config table, rss in MB
+func ReadResourceLimits(service string) (ResourceLimits, error) {
+	limits := DefaultResourceLimits
+	cpu, err1 := ReadIntConfig("max_cpu", service, int(limits.cpu))
+	rss, err2 := ReadIntConfig("max_rss_mb", service, int(limits.rss/1024/1024))
+	fds, err3 := ReadIntConfig("max_fds", service, limits.fds)
+	limits.cpu = float64(cpu)
+	limits.rss = uint64(rss) * 1024 * 1024
+	limits.fds = fds
+	return limits, errors.Join(err1, err2, err3)
+}
+
+// Names of the limits exceeded by the sample
+func (limits ResourceLimits) exceeded(ps ProcessSample) map[string]string {
+	exceeded := make(map[string]string)
+	if limits.cpu > 0 && ps.cpu > limits.cpu {
+		exceeded["cpu"] = fmt.Sprintf("CPU %.1f%% over %.0f%%", ps.cpu, limits.cpu)
+	}
+	if limits.rss > 0 && ps.rss > limits.rss {
+		exceeded["rss"] = fmt.Sprintf("memory %v MB over %v MB", ps.rss/1024/1024, limits.rss/1024/1024)
+	}
+	if limits.fds > 0 && ps.fds > limits.fds {
+		exceeded["fds"] = fmt.Sprintf("%v open files over %v", ps.fds, limits.fds)
+	}
+	return exceeded
+}
+
+var (
+	lastSamples      = make(map[string]ProcessSample)
+	lastSamplesMutex sync.Mutex
+	// whether the resource table was created, tried again until it is
+	resourceTable      bool
+	resourceTableMutex sync.Mutex
+)
+
+func createResourceTable() error {
+	resourceTableMutex.Lock()
+	defer resourceTableMutex.Unlock()
+	if resourceTable {
+		return nil
+	}
+	if _, err := DB.ExecContext(ServicesContext, ResourceTable); err != nil {
+		return err
+	}
+	resourceTable = true
+	return nil
+}
+
+// The most recent sample of a running service
+func LastSample(service string) (ProcessSample, bool) {
+	lastSamplesMutex.Lock()
+	defer lastSamplesMutex.Unlock()
+	ps, ok := lastSamples[service]
+	return ps, ok
+}
+
+func SampleToDb(ps ProcessSample) error {
+	if err := createResourceTable(); err != nil {
+		return err
+	}
+	_, err := DB.ExecContext(ServicesContext,
+		"INSERT INTO resource (timestamp, service, pid, cpu, rss, fds, read_bytes, write_bytes) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+		ps.date.Unix(), ps.service, ps.pid, ps.cpu, ps.rss, ps.fds, ps.readBytes, ps.writeBytes)
+	return err
+}
+
+// Samples of a service taken within duration back from now, oldest first
+func QueryResources(service string, duration time.Duration) ([]ProcessSample, error) {
+	if err := createResourceTable(); err != nil {
+		return nil, err
+	}
+	rows, err := DB.QueryContext(ServicesContext,
+		"SELECT timestamp, service, pid, cpu, rss, fds, read_bytes, write_bytes FROM resource WHERE service=? AND timestamp >= ? ORDER BY timestamp",
+		service, time.Now().Add(-duration).Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var samples []ProcessSample
+	for rows.Next() {
+		var ps ProcessSample
+		var unixdate int64
+		if err := rows.Scan(&unixdate, &ps.service, &ps.pid, &ps.cpu, &ps.rss, &ps.fds, &ps.readBytes, &ps.writeBytes); err != nil {
+			return nil, err
+		}
+		ps.date = time.Unix(unixdate, 0)
+		samples = append(samples, ps)
+	}
+	return samples, rows.Err()
+}
+
+// Sample the resources of the process of a service until it exits, storing
+// them in the db and warning when they go over the limits of the service
+func MonitorProcess(ctx context.Context, service Service, pid int, exited <-chan struct{}) {
+	onLog := service.onLogHook()
+	name := service.name()
+	interval, err := ReadIntervalConfig("monitor_interval", name, DefaultMonitorInterval)
+	if err != nil {
+		onLog(service.fmtLog(WARNING, "cannot read monitor_interval, sampling every "+
+			DefaultMonitorInterval.String()+": "+err.Error()))
+	}
+	limits, err := ReadResourceLimits(name)
+	if err != nil {
+		onLog(service.fmtLog(WARNING, "cannot read resource limits: "+err.Error()))
+	}
+	defer func() {
+		lastSamplesMutex.Lock()
+		delete(lastSamples, name)
+		lastSamplesMutex.Unlock()
+	}()
+
+	previous, err := readProcessCounters(pid)
+	if errors.Is(err, errors.ErrUnsupported) {
+		return
+	}
+	previousTime := time.Now()
+	// only warn when a limit starts being exceeded
+	exceeding := make(map[string]string)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-exited:
+			return
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			counters, err := readProcessCounters(pid)
+			if err != nil {
+				// most probably it is exiting
+				continue
+			}
+			ps := ProcessSample{
+				date:       now,
+				service:    name,
+				pid:        pid,
+				cpu:        100 * float64(counters.cpuTime-previous.cpuTime) / float64(now.Sub(previousTime)),
+				rss:        counters.rss,
+				fds:        counters.fds,
+				readBytes:  counters.readBytes,
+				writeBytes: counters.writeBytes,
+			}
+			previous, previousTime = counters, now
+
+			lastSamplesMutex.Lock()
+			lastSamples[name] = ps
+			lastSamplesMutex.Unlock()
+			if err := SampleToDb(ps); err != nil && !errors.Is(err, sql.ErrConnDone) {
+				onLog(service.fmtLog(WARNING, "cannot store resource usage: "+err.Error()))
+			}
+
+			exceeded := limits.exceeded(ps)
+			for limit, desc := range exceeded {
+				if _, ok := exceeding[limit]; !ok {
+					onLog(service.fmtLog(WARNING, name+" is using too many resources: "+desc))
+				}
+			}
+			exceeding = exceeded
+		}
+	}
+}
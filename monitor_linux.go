@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// USER_HZ, the unit of the CPU times in /proc, is 100 on every Linux we run
+const clockTicks = 100
+
+// Read the counters of a process from /proc
+func readProcessCounters(pid int) (processCounters, error) {
+	var pc processCounters
+	proc := filepath.Join("/proc", strconv.Itoa(pid))
+
+	stat, err := os.ReadFile(filepath.Join(proc, "stat"))
+	if err != nil {
+		return pc, err
+	}
+	// the command name may have spaces, so split after it
+	end := strings.LastIndexByte(string(stat), ')')
+	if end < 0 {
+		return pc, fmt.Errorf("unexpected format of %v/stat", proc)
+	}
+	fields := strings.Fields(string(stat[end+1:]))
+	// utime and stime are fields 14 and 15, the first after the name is 3
+	if len(fields) < 13 {
+		return pc, fmt.Errorf("unexpected format of %v/stat", proc)
+	}
+	utime, err1 := strconv.ParseUint(fields[11], 10, 64)
+	stime, err2 := strconv.ParseUint(fields[12], 10, 64)
+	if err1 != nil || err2 != nil {
+		return pc, fmt.Errorf("unexpected cpu times in %v/stat", proc)
+	}
+	pc.cpuTime = time.Duration(utime+stime) * time.Second / clockTicks
+
+	status, err := os.Open(filepath.Join(proc, "status"))
+	if err != nil {
+		return pc, err
+	}
+	defer status.Close()
+	scanner := bufio.NewScanner(status)
+	for scanner.Scan() {
+		if kb, ok := strings.CutPrefix(scanner.Text(), "VmRSS:"); ok {
+			kb = strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(kb), "kB"))
+			rss, err := strconv.ParseUint(kb, 10, 64)
+			if err != nil {
+				return pc, fmt.Errorf("unexpected VmRSS in %v/status", proc)
+			}
+			pc.rss = rss * 1024
+		}
+	}
+
+	fds, err := os.ReadDir(filepath.Join(proc, "fd"))
+	if err != nil {
+		return pc, err
+	}
+	pc.fds = len(fds)
+
+	// not available in some kernels, the rest is still useful
+	if io, err := os.Open(filepath.Join(proc, "io")); err == nil {
+		defer io.Close()
+		scanner := bufio.NewScanner(io)
+		for scanner.Scan() {
+			name, value, _ := strings.Cut(scanner.Text(), ": ")
+			switch name {
+			case "read_bytes":
+				pc.readBytes, _ = strconv.ParseUint(value, 10, 64)
+			case "write_bytes":
+				pc.writeBytes, _ = strconv.ParseUint(value, 10, 64)
+			}
+		}
+	}
+	return pc, nil
+}
+
+// Path of the executable of a process
+func processExe(pid int) (string, error) {
+	return os.Readlink(filepath.Join("/proc", strconv.Itoa(pid), "exe"))
+}
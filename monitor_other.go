@@ -0,0 +1,14 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+// TODO read them on MacOS and Windows
+func readProcessCounters(pid int) (processCounters, error) {
+	return processCounters{}, errors.ErrUnsupported
+}
+
+func processExe(pid int) (string, error) {
+	return "", errors.ErrUnsupported
+}
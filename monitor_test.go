@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadProcessCounters(t *testing.T) {
+	pc, err := readProcessCounters(os.Getpid())
+	if errors.Is(err, errors.ErrUnsupported) {
+		t.Skip(err)
+	}
+	assert.NoError(t, err)
+	assert.NotZero(t, pc.rss)
+	assert.NotZero(t, pc.fds)
+	_, err = readProcessCounters(-1)
+	assert.Error(t, err)
+}
+
+func TestResourceLimits(t *testing.T) {
+	limits := ResourceLimits{cpu: 50, rss: 1024 * 1024 * 1024, fds: 100}
+	assert.Empty(t, limits.exceeded(ProcessSample{cpu: 10, rss: 1024, fds: 10}))
+	exceeded := limits.exceeded(ProcessSample{cpu: 60, rss: 2 * 1024 * 1024 * 1024, fds: 10})
+	assert.Len(t, exceeded, 2)
+	assert.Equal(t, "CPU 60.0% over 50%", exceeded["cpu"])
+	assert.Equal(t, "memory 2048 MB over 1024 MB", exceeded["rss"])
+	assert.Empty(t, ResourceLimits{}.exceeded(ProcessSample{cpu: 1000, fds: 100000}))
+}
+
+func TestMonitorProcess(t *testing.T) {
+	if _, err := readProcessCounters(os.Getpid()); err != nil {
+		t.Skip(err)
+	}
+	_, err := DB.Exec("DELETE FROM resource WHERE service='test_monitor'")
+	if err != nil {
+		// the table is created on the first sample
+		assert.ErrorContains(t, err, "no such table")
+	}
+	assert.NoError(t, SetConfig("monitor_interval", "test_monitor", "50ms"))
+	// every process has more than one open file
+	assert.NoError(t, SetConfig("max_fds", "test_monitor", 1))
+
+	service := scanService{fakeService{n: "test_monitor"}, make(chan *Log, 100)}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*300)
+	defer cancel()
+	MonitorProcess(ctx, service, os.Getpid(), nil)
+
+	samples, err := QueryResources("test_monitor", time.Minute)
+	assert.NoError(t, err)
+	assert.GreaterOrEqual(t, len(samples), 3)
+	assert.Equal(t, os.Getpid(), samples[0].pid)
+	assert.NotZero(t, samples[0].rss)
+
+	// only warned once
+	close(service.logs)
+	warnings := 0
+	for l := range service.logs {
+		if l.logType == WARNING {
+			assert.Contains(t, l.desc, "open files over 1")
+			warnings++
+		}
+	}
+	assert.Equal(t, 1, warnings)
+}
+
+func TestMonitorProcessInterval(t *testing.T) {
+	if _, err := readProcessCounters(os.Getpid()); err != nil {
+		t.Skip(err)
+	}
+	defer DB.Exec("DELETE FROM config WHERE service='test_monitor_interval'")
+	// a ticker cannot tick every 0s, the default is used
+	assert.NoError(t, SetConfig("monitor_interval", "test_monitor_interval", "0s"))
+	service := scanService{fakeService{n: "test_monitor_interval"}, make(chan *Log, 100)}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+	defer cancel()
+	MonitorProcess(ctx, service, os.Getpid(), nil)
+	close(service.logs)
+	l := <-service.logs
+	if assert.NotNil(t, l) {
+		assert.Equal(t, LogType(WARNING), l.logType)
+		assert.Contains(t, l.desc, "sampling every 10s: monitor_interval of test_monitor_interval must be positive")
+	}
+}
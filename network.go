@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// The bitcoin network lnd runs on. Everything but mainnet uses coins without
+// value, so it must always be visible to the user.
+type Network int8
+
+const (
+	MAINNET Network = iota
+	TESTNET
+	SIGNET
+	REGTEST
+)
+
+// Network of the selected profile, read once by Setup
+var ActiveNetwork Network
+
+func (n Network) String() string {
+	switch n {
+	case TESTNET:
+		return "testnet"
+	case SIGNET:
+		return "signet"
+	case REGTEST:
+		return "regtest"
+	}
+	return "mainnet"
+}
+
+func ParseNetwork(network string) (Network, error) {
+	switch strings.ToLower(network) {
+	case "mainnet":
+		return MAINNET, nil
+	case "testnet":
+		return TESTNET, nil
+	case "signet":
+		return SIGNET, nil
+	case "regtest":
+		return REGTEST, nil
+	}
+	return MAINNET, fmt.Errorf("unknown bitcoin network %q, use mainnet, testnet, signet or regtest", network)
+}
+
+// Read the network from the config table, mainnet until it is changed
+func ReadNetwork() (Network, error) {
+	value, err := ReadConfig("network", "Bitcoin", MAINNET.String())
+	if err != nil {
+		return MAINNET, err
+	}
+	return ParseNetwork(fmt.Sprint(value))
+}
+
+// Store the network in the config table, for the next start
+func SetNetwork(n Network) error {
+	return SetConfig("network", "Bitcoin", n.String())
+}
+
+// The config name of a setting that is kept for each network, such as the
+// wallet password, so switching networks never overwrites the mainnet one
+func (n Network) configName(name string) string {
+	if n == MAINNET {
+		return name
+	}
+	return n.String() + "_" + name
+}
+
+// Added to the default ports of lnd, in the style of the ports of bitcoind
+func (n Network) portOffset() int {
+	switch n {
+	case TESTNET:
+		return 10000
+	case SIGNET:
+		return 30000
+	case REGTEST:
+		return 20000
+	}
+	return 0
+}
+
+// Neutrino peers serving compact filters. Without them neutrino finds peers
+// through the DNS seeds of the network, regtest needs a local node.
+func (n Network) neutrinoPeers() []string {
+	switch n {
+	case MAINNET:
+		return []string{
+			"btcd1.lnolymp.us",
+			"btcd2.lnolymp.us",
+			"btcd-mainnet.lightning.computer",
+			"node.blixtwallet.com",
+			"node.eldamar.icu",
+			"noad.sathoarder.com",
+			"bb1.breez.technology",
+			"bb2.breez.technology",
+		}
+	case TESTNET:
+		return []string{
+			"btcd-testnet.lightning.computer",
+			"faucet.lightning.community",
+		}
+	case REGTEST:
+		return []string{"localhost:18444"}
+	}
+	return nil
+}
+
+// Settings of lnd.conf that change with the network
+func (n Network) lndSettings() [][2]string {
+	settings := [][2]string{{"bitcoin." + n.String(), "true"}}
+	for _, peer := range n.neutrinoPeers() {
+		settings = append(settings, [2]string{"neutrino.connect", peer})
+	}
+	// lnd needs a fee estimator for neutrino on mainnet only
+	if n == MAINNET {
+		settings = append(settings, [2]string{"feeurl", "https://bitcoinchainfees.strike.me/v1/fee-estimates"})
+	}
+	return settings
+}
+
+// Keys of lnd.conf written by lndSettings
+var lndNetworkKeys = []string{
+	"bitcoin.mainnet", "bitcoin.testnet", "bitcoin.signet", "bitcoin.regtest",
+	"neutrino.connect", "feeurl",
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseNetwork(t *testing.T) {
+	for _, n := range []Network{MAINNET, TESTNET, SIGNET, REGTEST} {
+		parsed, err := ParseNetwork(n.String())
+		assert.NoError(t, err)
+		assert.Equal(t, n, parsed)
+	}
+	n, err := ParseNetwork("Signet")
+	assert.NoError(t, err)
+	assert.Equal(t, SIGNET, n)
+	_, err = ParseNetwork("simnet")
+	assert.Error(t, err)
+
+	assert.Equal(t, "pass", MAINNET.configName("pass"))
+	assert.Equal(t, "testnet_pass", TESTNET.configName("pass"))
+}
+
+func TestNetworkPorts(t *testing.T) {
+	network := ActiveNetwork
+	t.Cleanup(func() { ActiveNetwork = network })
+	ActiveNetwork = MAINNET
+	assert.Equal(t, "rest_port", portSpec("Lnd", "rest_port").key())
+	ActiveNetwork = REGTEST
+	assert.Equal(t, "regtest_rest_port", portSpec("Lnd", "rest_port").key())
+	assert.Equal(t, "socks_port", portSpec("Tor", "socks_port").key())
+	assert.Equal(t, 9745+PortOffset+20000, PortOf("Lnd", "p2p_port"))
+}
+
+func TestConfigureNetwork(t *testing.T) {
+	network, file := ActiveNetwork, LndConfigFile
+	t.Cleanup(func() { ActiveNetwork, LndConfigFile = network, file })
+	LndConfigFile = filepath.Join(t.TempDir(), "lnd.conf")
+	assert.NoError(t, os.WriteFile(LndConfigFile, []byte(defaultLndConfig), 0644))
+	var logs []*Log
+	onLog := func(l *Log) { logs = append(logs, l) }
+
+	ActiveNetwork = MAINNET
+	assert.NoError(t, LndService{}.configureNetwork(onLog))
+	values, err := ConfigFileValues(LndConfigFile, "=", "neutrino.connect")
+	assert.NoError(t, err)
+	assert.Equal(t, MAINNET.neutrinoPeers(), values)
+	values, _ = ConfigFileValues(LndConfigFile, "=", "feeurl")
+	assert.Len(t, values, 1)
+
+	// a peer added by the user stays while the network does not change
+	content, err := os.ReadFile(LndConfigFile)
+	assert.NoError(t, err)
+	assert.NoError(t, os.WriteFile(LndConfigFile, append(content, "neutrino.connect=mynode\n"...), 0644))
+	assert.NoError(t, LndService{}.configureNetwork(onLog))
+	values, _ = ConfigFileValues(LndConfigFile, "=", "neutrino.connect")
+	assert.Contains(t, values, "mynode")
+
+	ActiveNetwork = TESTNET
+	assert.NoError(t, LndService{}.configureNetwork(onLog))
+	content, err = os.ReadFile(LndConfigFile)
+	assert.NoError(t, err)
+	assert.Contains(t, string(content), "bitcoin.testnet=true\nneutrino.connect=btcd-testnet.lightning.computer\n")
+	for _, key := range []string{"bitcoin.mainnet", "feeurl"} {
+		values, _ = ConfigFileValues(LndConfigFile, "=", key)
+		assert.Empty(t, values, key)
+	}
+	values, _ = ConfigFileValues(LndConfigFile, "=", "neutrino.connect")
+	assert.Equal(t, TESTNET.neutrinoPeers(), values)
+	// the example configuration is kept commented
+	assert.True(t, strings.Contains(string(content), "; bitcoin.mainnet=false"))
+	// only the change of network is a warning
+	if assert.Len(t, logs, 2) {
+		assert.Equal(t, LogType(INFO), logs[0].logType)
+		assert.Equal(t, LogType(WARNING), logs[1].logType)
+	}
+}
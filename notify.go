@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// File under ServiceRootDir with the notification rules, for example:
+//
+//   - level: error                # error and fatal logs
+//     service: Lnd                # of any service when empty
+//     match: 'channel .* closed'  # regular expression on the description
+//     command: [notify-send, "LNBank ${SERVICE}", "${DESC}"]
+//     every: 10m                  # at most once every 10 minutes
+//
+// The command also gets the log in the LNBANK_SERVICE, LNBANK_LEVEL and
+// LNBANK_DESC environment variables.
+const NotifyFile = "notify.yaml"
+
+// How long a notification command may take
+const NotifyTimeout = time.Second * 30
+
+type NotifyRule struct {
+	Service string        `yaml:"service"`
+	Level   string        `yaml:"level"`
+	Match   string        `yaml:"match"`
+	Command []string      `yaml:"command"`
+	Every   time.Duration `yaml:"every"`
+
+	level LogType
+	match *regexp.Regexp
+	last  time.Time
+}
+
+// Whether a log is of the service of the rule, matches it and is at least
+// as important as its level, FATAL being the most important one
+func (nr *NotifyRule) matches(l *Log) bool {
+	if nr.Service != "" && nr.Service != l.service {
+		return false
+	}
+	// a rule of NORMAL level takes every log
+	if nr.level != NORMAL && (l.logType == NORMAL || l.logType > nr.level) {
+		return false
+	}
+	return nr.match == nil || nr.match.MatchString(l.desc)
+}
+
+// Read the rules of a file, none if it does not exist
+func LoadNotifyRules(file string) ([]*NotifyRule, error) {
+	content, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var rules []*NotifyRule
+	if err := yaml.Unmarshal(content, &rules); err != nil {
+		return nil, fmt.Errorf("%v: %w", file, err)
+	}
+	var errs []error
+	for i, rule := range rules {
+		if len(rule.Command) == 0 {
+			errs = append(errs, fmt.Errorf("%v: rule %v has no command", file, i+1))
+		}
+		rule.level = WARNING
+		if rule.Level != "" {
+			if rule.level, err = ParseLogType(rule.Level); err != nil {
+				errs = append(errs, fmt.Errorf("%v: rule %v: %w", file, i+1, err))
+			}
+		}
+		if rule.Match != "" {
+			if rule.match, err = regexp.Compile(rule.Match); err != nil {
+				errs = append(errs, fmt.Errorf("%v: rule %v: %w", file, i+1, err))
+			}
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+// Runs the command of the rules matching each log
+type notifySink struct {
+	rules []*NotifyRule
+}
+
+func (ns *notifySink) write(l *Log) error {
+	var errs []error
+	for _, rule := range ns.rules {
+		if !rule.matches(l) || time.Since(rule.last) < rule.Every {
+			continue
+		}
+		rule.last = time.Now()
+		errs = append(errs, notify(rule.Command, l))
+	}
+	return errors.Join(errs...)
+}
+
+func (ns *notifySink) close() error { return nil }
+
+// Run a notification command about a log
+func notify(command []string, l *Log) error {
+	vars := map[string]string{
+		"SERVICE": l.service,
+		"LEVEL":   l.logType.Name(),
+		"DESC":    l.desc,
+	}
+	expand := func(value string) string {
+		return os.Expand(value, func(name string) string {
+			if value, ok := vars[name]; ok {
+				return value
+			}
+			return os.Getenv(name)
+		})
+	}
+	args := make([]string, 0, len(command))
+	for _, arg := range command {
+		args = append(args, expand(arg))
+	}
+	ctx, cancel := context.WithTimeout(ServicesContext, NotifyTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Env = os.Environ()
+	for name, value := range vars {
+		cmd.Env = append(cmd.Env, "LNBANK_"+name+"="+value)
+	}
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%v: %v %s", args[0], err, bytes.TrimSpace(output))
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadNotifyRules(t *testing.T) {
+	dir := t.TempDir()
+	rules, err := LoadNotifyRules(filepath.Join(dir, NotifyFile))
+	assert.NoError(t, err)
+	assert.Empty(t, rules)
+
+	file := filepath.Join(dir, NotifyFile)
+	assert.NoError(t, os.WriteFile(file, []byte(`
+- level: error
+  service: Lnd
+  match: 'channel .* closed'
+  command: [notify-send, "${SERVICE}", "${DESC}"]
+  every: 10m
+- command: [true]
+`), 0644))
+	rules, err = LoadNotifyRules(file)
+	assert.NoError(t, err)
+	if assert.Len(t, rules, 2) {
+		assert.Equal(t, time.Minute*10, rules[0].Every)
+		closed := &Log{logType: ERROR, service: "Lnd", desc: "channel abc closed"}
+		assert.True(t, rules[0].matches(closed))
+		assert.True(t, rules[0].matches(&Log{logType: FATAL, service: "Lnd", desc: "channel abc closed"}))
+		assert.False(t, rules[0].matches(&Log{logType: WARNING, service: "Lnd", desc: "channel abc closed"}))
+		assert.False(t, rules[0].matches(&Log{logType: ERROR, service: "Tor", desc: "channel abc closed"}))
+		assert.False(t, rules[0].matches(&Log{logType: ERROR, service: "Lnd", desc: "channel abc opened"}))
+		// warnings and worse by default
+		assert.True(t, rules[1].matches(&Log{logType: WARNING, service: "Tor"}))
+		assert.False(t, rules[1].matches(&Log{logType: INFO, service: "Tor"}))
+		assert.False(t, rules[1].matches(&Log{logType: NORMAL, service: "Tor"}))
+	}
+
+	assert.NoError(t, os.WriteFile(file, []byte("- level: loud\n  match: '('\n"), 0644))
+	_, err = LoadNotifyRules(file)
+	assert.ErrorContains(t, err, "no command")
+	assert.ErrorContains(t, err, "unknown log type")
+	assert.ErrorContains(t, err, "missing closing")
+}
+
+func TestNotifySink(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("needs sh")
+	}
+	dir := t.TempDir()
+	out := filepath.Join(dir, "notified")
+	script := filepath.Join(dir, "notify.sh")
+	assert.NoError(t, os.WriteFile(script, []byte(`echo "$1 $LNBANK_LEVEL $LNBANK_DESC" >> `+out), 0755))
+	ns := &notifySink{rules: []*NotifyRule{{
+		Command: []string{"sh", script, "${SERVICE}"},
+		Every:   time.Hour,
+		level:   ERROR,
+	}}}
+	assert.NoError(t, ns.write(&Log{logType: INFO, service: "Tor", desc: "fine"}))
+	assert.NoError(t, ns.write(&Log{logType: ERROR, service: "Tor", desc: "broken"}))
+	// once an hour at most
+	assert.NoError(t, ns.write(&Log{logType: FATAL, service: "Tor", desc: "worse"}))
+	content, err := os.ReadFile(out)
+	assert.NoError(t, err)
+	assert.Equal(t, "Tor ERROR broken", strings.TrimSpace(string(content)))
+
+	ns.rules[0].Command = []string{"false"}
+	ns.rules[0].Every = 0
+	assert.ErrorContains(t, ns.write(&Log{logType: ERROR, service: "Tor", desc: "broken"}), "false")
+}
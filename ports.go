@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A port a service listens on. The port in use is stored in the config table
+// under name and service, so every configuration file depending on it is
+// rendered from the same value.
+type PortSpec struct {
+	service string
+	name    string
+	host    string
+	port    int
+	desc    string
+	// kept for each bitcoin network, with the default moved by the network
+	network bool
+}
+
+// The config name of the port
+func (ps PortSpec) key() string {
+	if ps.network {
+		return ActiveNetwork.configName(ps.name)
+	}
+	return ps.name
+}
+
+func (ps PortSpec) address(port int) string {
+	return net.JoinHostPort(ps.host, strconv.Itoa(port))
+}
+
+// All the ports of all the services, with their defaults for the default
+// profile on mainnet. The rest of profiles add PortOffset to them, and the
+// rest of networks their portOffset to the ports of lnd.
+var Ports = []PortSpec{
+	{"Tor", "socks_port", "localhost", 9055, "SOCKS proxy", false},
+	{"Tor", "control_port", "localhost", 9056, "control port", false},
+	{"Lnd", "rest_port", "localhost", 8090, "REST API", true},
+	{"Lnd", "rpc_port", "localhost", 10019, "gRPC API", true},
+	{"Lnd", "p2p_port", "0.0.0.0", 9745, "peer to peer", true},
+}
+
+// How many ports after the configured one are tried when it is taken
+const PortSearchRange = 100
+
+func portSpec(service string, name string) PortSpec {
+	for _, ps := range Ports {
+		if ps.service == service && ps.name == name {
+			return ps
+		}
+	}
+	panic("unknown port " + name + " of " + service)
+}
+
+// The port assigned to a service, the default one until it is reassigned
+func PortOf(service string, name string) int {
+	ps := portSpec(service, name)
+	def := ps.port + PortOffset
+	if ps.network {
+		def += ActiveNetwork.portOffset()
+	}
+	port, err := ReadIntConfig(ps.key(), ps.service, def)
+	if err != nil || port <= 0 || port > 65535 {
+		return def
+	}
+	return port
+}
+
+// host:port of a port of a service, to connect to it locally
+func AddressOf(service string, name string) string {
+	return net.JoinHostPort("localhost", strconv.Itoa(PortOf(service, name)))
+}
+
+// true if nothing is listening on the port
+func portFree(host string, port int) bool {
+	l, err := net.Listen("tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+	if err != nil {
+		return false
+	}
+	l.Close()
+	return true
+}
+
+// Check that all the ports of a service are free before launching it. A taken
+// port is moved to the next free one, which is stored in the config table so
+// the configuration files of the service and of its dependents follow it.
+func PreflightPorts(service string, onLog func(*Log)) error {
+	// ports assigned to other services are not free even if they are not
+	// listening now
+	var assigned []int
+	for _, ps := range Ports {
+		if ps.service != service {
+			assigned = append(assigned, PortOf(ps.service, ps.name))
+		}
+	}
+
+	var errs []error
+	for _, ps := range Ports {
+		if ps.service != service {
+			continue
+		}
+		port := PortOf(ps.service, ps.name)
+		if portFree(ps.host, port) && !slices.Contains(assigned, port) {
+			assigned = append(assigned, port)
+			continue
+		}
+		free := 0
+		for candidate := port + 1; candidate <= min(port+PortSearchRange, 65535); candidate++ {
+			if !slices.Contains(assigned, candidate) && portFree(ps.host, candidate) {
+				free = candidate
+				break
+			}
+		}
+		if free == 0 {
+			errs = append(errs, fmt.Errorf("%v port %v of %v is taken and there is no free port after it",
+				ps.desc, port, service))
+			continue
+		}
+		if err := SetConfig(ps.key(), ps.service, free); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		assigned = append(assigned, free)
+		onLog(&Log{
+			date:    time.Now(),
+			logType: WARNING,
+			service: service,
+			desc:    fmt.Sprintf("%v port %v is taken, using %v instead", ps.desc, port, free),
+		})
+	}
+	return errors.Join(errs...)
+}
+
+// Replace the value of the given settings in a configuration file, keeping
+// everything else. A setting is a line starting with its key followed by sep,
+// commented lines are left alone. Settings not found are added at the top.
+func RenderConfigFile(file string, sep string, settings [][2]string) error {
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	found := make([]bool, len(settings))
+	var out bytes.Buffer
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		line := scanner.Text()
+		for i, setting := range settings {
+			if !found[i] && strings.HasPrefix(strings.TrimSpace(line), setting[0]+sep) {
+				line = setting[0] + sep + setting[1]
+				found[i] = true
+				break
+			}
+		}
+		out.WriteString(line + "\n")
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	var missing bytes.Buffer
+	for i, setting := range settings {
+		if !found[i] {
+			missing.WriteString(setting[0] + sep + setting[1] + "\n")
+		}
+	}
+	rendered := append(missing.Bytes(), out.Bytes()...)
+	if bytes.Equal(rendered, content) {
+		return nil
+	}
+	return os.WriteFile(file, rendered, 0644)
+}
+
+// Replace every line of the given keys in a configuration file with the given
+// settings, so keys that can be repeated are written as a whole. They are
+// written where the first of those lines was, or else at the top.
+func ReplaceConfigKeys(file string, sep string, keys []string, settings [][2]string) error {
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	var block bytes.Buffer
+	for _, setting := range settings {
+		block.WriteString(setting[0] + sep + setting[1] + "\n")
+	}
+	var out bytes.Buffer
+	written := false
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		line := scanner.Text()
+		key, _, found := strings.Cut(strings.TrimSpace(line), sep)
+		if found && slices.Contains(keys, strings.TrimSpace(key)) {
+			if !written {
+				out.Write(block.Bytes())
+				written = true
+			}
+			continue
+		}
+		out.WriteString(line + "\n")
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	rendered := out.Bytes()
+	if !written {
+		rendered = append(block.Bytes(), rendered...)
+	}
+	if bytes.Equal(rendered, content) {
+		return nil
+	}
+	return os.WriteFile(file, rendered, 0644)
+}
+
+// Values of a key in a configuration file, commented lines excluded
+func ConfigFileValues(file string, sep string, key string) ([]string, error) {
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var values []string
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		k, value, found := strings.Cut(strings.TrimSpace(scanner.Text()), sep)
+		if found && strings.TrimSpace(k) == key {
+			values = append(values, strings.TrimSpace(value))
+		}
+	}
+	return values, scanner.Err()
+}
+
+// The ports of a service as shown to the user
+func PortsString(service string) string {
+	var ports []string
+	for _, ps := range Ports {
+		if ps.service == service {
+			ports = append(ports, fmt.Sprintf("%v %v", ps.desc, PortOf(ps.service, ps.name)))
+		}
+	}
+	return strings.Join(ports, ", ")
+}
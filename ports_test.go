@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPreflightPorts(t *testing.T) {
+	// a port that is taken
+	l, err := net.Listen("tcp", "localhost:0")
+	assert.NoError(t, err)
+	defer l.Close()
+	taken := l.Addr().(*net.TCPAddr).Port
+
+	service := fmt.Sprintf("porttest%v", time.Now().UnixNano())
+	ports := Ports
+	t.Cleanup(func() { Ports = ports })
+	Ports = append(slices.Clone(ports), PortSpec{service, "test_port", "localhost", taken, "test", false})
+
+	var logs []*Log
+	assert.NoError(t, PreflightPorts(service, func(l *Log) { logs = append(logs, l) }))
+	moved := PortOf(service, "test_port")
+	assert.NotEqual(t, taken, moved)
+	assert.Greater(t, moved, taken)
+	if assert.Len(t, logs, 1) {
+		assert.Equal(t, LogType(WARNING), logs[0].logType)
+		assert.Contains(t, logs[0].desc, fmt.Sprint(moved))
+	}
+
+	// a free port stays
+	logs = nil
+	assert.NoError(t, PreflightPorts(service, func(l *Log) { logs = append(logs, l) }))
+	assert.Equal(t, moved, PortOf(service, "test_port"))
+	assert.Empty(t, logs)
+	assert.Equal(t, fmt.Sprintf("test %v", moved), PortsString(service))
+}
+
+func TestRenderConfigFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "lnd.conf")
+	assert.NoError(t, os.WriteFile(file, []byte("restlisten=localhost:8090\n;rpclisten=localhost:1\nalias=LNBank\n"), 0644))
+	assert.NoError(t, RenderConfigFile(file, "=", [][2]string{
+		{"restlisten", "localhost:8091"},
+		{"rpclisten", "localhost:10020"},
+		{"listen", "0.0.0.0:9745"},
+	}))
+	content, err := os.ReadFile(file)
+	assert.NoError(t, err)
+	assert.Equal(t, "rpclisten=localhost:10020\nlisten=0.0.0.0:9745\nrestlisten=localhost:8091\n;rpclisten=localhost:1\nalias=LNBank\n", string(content))
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os/exec"
+	"time"
+)
+
+// An active check of a running service. Probes are used to know when a
+// service is ready, besides its logs, and later to know it still works.
+type Probe interface {
+	check(ctx context.Context) error
+	String() string
+}
+
+// Services with probes. Readiness probes must pass before the service is
+// ready, liveness probes are run periodically while it is ready.
+type probedService interface {
+	probes() (readiness []Probe, liveness []Probe)
+}
+
+// Something accepts connections on the address
+type TcpProbe struct {
+	address func() string
+}
+
+func (p TcpProbe) check(ctx context.Context) error {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", p.address())
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+func (p TcpProbe) String() string {
+	return "tcp " + p.address()
+}
+
+// A SOCKS5 proxy answers the handshake on the address
+type SocksProbe struct {
+	address func() string
+}
+
+func (p SocksProbe) check(ctx context.Context) error {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", p.address())
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		if err := conn.SetDeadline(deadline); err != nil {
+			return err
+		}
+	}
+	// version 5, one method: no authentication
+	if _, err := conn.Write([]byte{5, 1, 0}); err != nil {
+		return err
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return fmt.Errorf("no SOCKS handshake: %w", err)
+	}
+	if reply[0] != 5 || reply[1] != 0 {
+		return fmt.Errorf("unexpected SOCKS handshake %x", reply)
+	}
+	return nil
+}
+
+func (p SocksProbe) String() string {
+	return "socks " + p.address()
+}
+
+// probes only talk to local services with self signed certificates
+var probeClient = &http.Client{
+	Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	},
+}
+
+// A GET on the url is answered without a server error
+type HttpProbe struct {
+	url func() string
+}
+
+func (p HttpProbe) check(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.url(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := probeClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode >= 500 {
+		return fmt.Errorf("GET %v: %v", p.url(), resp.Status)
+	}
+	return nil
+}
+
+func (p HttpProbe) String() string {
+	return "http " + p.url()
+}
+
+// A command exits successfully, such as lncli getinfo that calls the gRPC
+// GetInfo of lnd
+type CommandProbe struct {
+	name    string
+	command func(ctx context.Context) *exec.Cmd
+}
+
+func (p CommandProbe) check(ctx context.Context) error {
+	output, err := p.command(ctx).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%v %s", err, bytes.TrimSpace(output))
+	}
+	return nil
+}
+
+func (p CommandProbe) String() string {
+	return p.name
+}
+
+// Run all probes, each one with its timeout, and return the first failure
+func runProbes(ctx context.Context, probes []Probe, timeout time.Duration) error {
+	for _, probe := range probes {
+		pctx, cancel := context.WithTimeout(ctx, timeout)
+		err := probe.check(pctx)
+		cancel()
+		if err != nil {
+			return fmt.Errorf("%v: %w", probe, err)
+		}
+	}
+	return nil
+}
+
+type ProbeConfig struct {
+	// time between liveness checks, and the limit of each check
+	interval time.Duration
+	timeout  time.Duration
+	// consecutive failures after which the service is degraded, and after
+	// which it is restarted. 0 never does it.
+	degradedAfter int
+	restartAfter  int
+}
+
+var DefaultProbeConfig = ProbeConfig{
+	interval:      time.Second * 30,
+	timeout:       time.Second * 10,
+	degradedAfter: 1,
+	restartAfter:  3,
+}
+
+// Read the probe configuration of a service from the config table
+func ReadProbeConfig(service string) (ProbeConfig, error) {
+	pc := DefaultProbeConfig
+	var errs []error
+	var err error
+	pc.interval, err = ReadIntervalConfig("probe_interval", service, pc.interval)
+	errs = append(errs, err)
+	pc.timeout, err = ReadDurationConfig("probe_timeout", service, pc.timeout)
+	errs = append(errs, err)
+	pc.degradedAfter, err = ReadIntConfig("probe_degraded_after", service, pc.degradedAfter)
+	errs = append(errs, err)
+	pc.restartAfter, err = ReadIntConfig("probe_restart_after", service, pc.restartAfter)
+	errs = append(errs, err)
+	return pc, errors.Join(errs...)
+}
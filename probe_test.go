@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os/exec"
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProbes(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	// a SOCKS5 server that accepts no authentication
+	l, err := net.Listen("tcp", "localhost:0")
+	assert.NoError(t, err)
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			hello := make([]byte, 3)
+			if _, err := conn.Read(hello); err == nil {
+				_, _ = conn.Write([]byte{5, 0})
+			}
+			conn.Close()
+		}
+	}()
+	address := func() string { return l.Addr().String() }
+	assert.NoError(t, TcpProbe{address}.check(ctx))
+	assert.NoError(t, SocksProbe{address}.check(ctx))
+
+	closed, err := net.Listen("tcp", "localhost:0")
+	assert.NoError(t, err)
+	closed.Close()
+	assert.Error(t, TcpProbe{func() string { return closed.Addr().String() }}.check(ctx))
+
+	var status atomic.Int32
+	status.Store(http.StatusOK)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(int(status.Load()))
+	}))
+	defer server.Close()
+	probe := HttpProbe{func() string { return server.URL }}
+	assert.NoError(t, probe.check(ctx))
+	// lnd answers 401 without macaroon, but it answers
+	status.Store(http.StatusUnauthorized)
+	assert.NoError(t, probe.check(ctx))
+	status.Store(http.StatusServiceUnavailable)
+	assert.ErrorContains(t, probe.check(ctx), "503")
+	// a socks server is not an http server
+	assert.Error(t, HttpProbe{func() string { return "http://" + address() }}.check(ctx))
+
+	if runtime.GOOS != "windows" {
+		ok := CommandProbe{"true", func(ctx context.Context) *exec.Cmd { return exec.CommandContext(ctx, "true") }}
+		fail := CommandProbe{"false", func(ctx context.Context) *exec.Cmd { return exec.CommandContext(ctx, "false") }}
+		assert.NoError(t, runProbes(ctx, []Probe{ok}, time.Second))
+		assert.ErrorContains(t, runProbes(ctx, []Probe{ok, fail}, time.Second), "false")
+	}
+}
+
+type funcProbe func() error
+
+func (fp funcProbe) check(context.Context) error { return fp() }
+func (fp funcProbe) String() string              { return "func" }
+
+// A service whose readiness and liveness are controlled by the test
+type probedFakeService struct {
+	fakeService
+	ready *atomic.Bool
+	alive *atomic.Bool
+}
+
+func (ps probedFakeService) probes() ([]Probe, []Probe) {
+	check := func(b *atomic.Bool) funcProbe {
+		return func() error {
+			if !b.Load() {
+				return errors.New("not answering")
+			}
+			return nil
+		}
+	}
+	return []Probe{check(ps.ready)}, []Probe{check(ps.alive)}
+}
+
+func TestSupervisorProbes(t *testing.T) {
+	ps := probedFakeService{fakeService{"lnd", nil}, &atomic.Bool{}, &atomic.Bool{}}
+	s := newTestSupervisor(t, ps)
+	assert.NoError(t, s.setProbeConfig("lnd", ProbeConfig{
+		interval:      time.Millisecond * 20,
+		timeout:       time.Second,
+		degradedAfter: 1,
+		restartAfter:  5,
+	}))
+	assert.NoError(t, s.setRestartConfig("lnd", RestartConfig{
+		policy:     RESTART_ON_FAILURE,
+		backoff:    time.Millisecond,
+		maxBackoff: time.Millisecond,
+		maxRetries: 3,
+		window:     time.Minute,
+	}))
+	var restarted atomic.Bool
+	s.subscribe(func(t Transition) {
+		if t.from == STOPPING && t.state == CRASHED {
+			restarted.Store(true)
+		}
+	})
+
+	// not ready until its readiness probes pass
+	ps.alive.Store(true)
+	assert.NoError(t, s.start("lnd"))
+	time.Sleep(time.Millisecond * 100)
+	st, _ := s.statusOf("lnd")
+	assert.Equal(t, STARTING, st.state)
+	ps.ready.Store(true)
+	assertState(t, s, "lnd", READY)
+
+	// degraded while it does not answer, ready again once it does
+	ps.alive.Store(false)
+	assertState(t, s, "lnd", DEGRADED)
+	ps.alive.Store(true)
+	assertState(t, s, "lnd", READY)
+
+	// restarted when it keeps not answering
+	ps.alive.Store(false)
+	assert.Eventually(t, restarted.Load, time.Second*5, time.Millisecond*10)
+	ps.alive.Store(true)
+	assertState(t, s, "lnd", READY)
+	st, _ = s.statusOf("lnd")
+	assert.Equal(t, 1, st.restarts)
+}
+
+func TestReadProbeConfig(t *testing.T) {
+	_, err := DB.Exec("DELETE FROM config WHERE service='test_probe'")
+	assert.NoError(t, err)
+	pc, err := ReadProbeConfig("test_probe")
+	assert.NoError(t, err)
+	assert.Equal(t, DefaultProbeConfig, pc)
+
+	// a ticker cannot tick every 0s
+	assert.NoError(t, SetConfig("probe_interval", "test_probe", "0s"))
+	pc, err = ReadProbeConfig("test_probe")
+	assert.ErrorContains(t, err, "probe_interval of test_probe must be positive")
+	assert.Equal(t, DefaultProbeConfig.interval, pc.interval)
+	assert.NoError(t, SetConfig("probe_interval", "test_probe", "-1m"))
+	pc, err = ReadProbeConfig("test_probe")
+	assert.Error(t, err)
+	assert.Equal(t, DefaultProbeConfig.interval, pc.interval)
+}
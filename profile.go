@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// The profile used when none is selected. It lives directly in the root
+// directory, as LNBank did before having profiles.
+const DefaultProfile = "main"
+
+// Selected profile, shown in the window title
+var Profile = DefaultProfile
+
+// Added to the default ports of the services, so the profiles can run at the
+// same time
+var PortOffset int
+
+var profileName = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,32}$`)
+
+// The root directory given by a flag, or else by the LNBANK_ROOT environment
+// variable, or else ~/LNBank
+func RootDir(flag string) (string, error) {
+	if flag != "" {
+		return filepath.Abs(flag)
+	}
+	if env := os.Getenv("LNBANK_ROOT"); env != "" {
+		return filepath.Abs(env)
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("cannot find the home directory: %w", err)
+	}
+	return filepath.Join(home, "LNBank"), nil
+}
+
+// The profile given by a flag, or else by the LNBANK_PROFILE environment
+// variable, or else the default one
+func ProfileName(flag string) (string, error) {
+	profile := flag
+	if profile == "" {
+		profile = os.Getenv("LNBANK_PROFILE")
+	}
+	if profile == "" {
+		return DefaultProfile, nil
+	}
+	if !profileName.MatchString(profile) {
+		return "", fmt.Errorf("invalid profile name %q, use letters, numbers, - and _", profile)
+	}
+	return profile, nil
+}
+
+// Directory of a profile, with its own db, tor and lnd directories
+func ProfileDir(root string, profile string) string {
+	if profile == DefaultProfile {
+		return root
+	}
+	return filepath.Join(root, "profiles", profile)
+}
+
+// Offset of the default ports of a profile: 0 for the default profile and a
+// multiple of 10 up to 900 for the rest, so each port keeps its last digit
+func ProfilePortOffset(profile string) int {
+	if profile == DefaultProfile {
+		return 0
+	}
+	return 10 * int(1+crc32.ChecksumIEEE([]byte(profile))%90)
+}
+
+// Title of the window, with the profile when it isn't the default one and the
+// network when it isn't mainnet
+func WindowTitle() string {
+	title := "LNBank"
+	if Profile != DefaultProfile {
+		title += " (" + Profile + ")"
+	}
+	if ActiveNetwork != MAINNET {
+		title += " - " + strings.ToUpper(ActiveNetwork.String())
+	}
+	return title
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProfiles(t *testing.T) {
+	t.Setenv("LNBANK_ROOT", "")
+	t.Setenv("LNBANK_PROFILE", "")
+	dir := t.TempDir()
+	root, err := RootDir(dir)
+	assert.NoError(t, err)
+	assert.Equal(t, dir, root)
+	t.Setenv("LNBANK_ROOT", filepath.Join(dir, "env"))
+	root, err = RootDir("")
+	assert.NoError(t, err)
+	assert.Equal(t, filepath.Join(dir, "env"), root)
+
+	profile, err := ProfileName("")
+	assert.NoError(t, err)
+	assert.Equal(t, DefaultProfile, profile)
+	t.Setenv("LNBANK_PROFILE", "testing")
+	profile, err = ProfileName("")
+	assert.NoError(t, err)
+	assert.Equal(t, "testing", profile)
+	profile, err = ProfileName("regtest_2")
+	assert.NoError(t, err)
+	assert.Equal(t, "regtest_2", profile)
+	_, err = ProfileName("../main")
+	assert.Error(t, err)
+
+	assert.Equal(t, dir, ProfileDir(dir, DefaultProfile))
+	assert.Equal(t, filepath.Join(dir, "profiles", "testing"), ProfileDir(dir, "testing"))
+
+	assert.Equal(t, 0, ProfilePortOffset(DefaultProfile))
+	offset := ProfilePortOffset("testing")
+	assert.Equal(t, offset, ProfilePortOffset("testing"))
+	assert.True(t, offset >= 10 && offset <= 900 && offset%10 == 0, offset)
+}
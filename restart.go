@@ -0,0 +1,106 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// What the supervisor does when a service exits without being asked to
+type RestartPolicy int8
+
+const (
+	RESTART_NEVER RestartPolicy = iota
+	RESTART_ON_FAILURE
+	RESTART_ALWAYS
+)
+
+func (rp RestartPolicy) String() string {
+	switch rp {
+	case RESTART_NEVER:
+		return "never"
+	case RESTART_ALWAYS:
+		return "always"
+	default:
+		return "on-failure"
+	}
+}
+
+func ParseRestartPolicy(policy string) (RestartPolicy, error) {
+	switch policy {
+	case "never":
+		return RESTART_NEVER, nil
+	case "on-failure":
+		return RESTART_ON_FAILURE, nil
+	case "always":
+		return RESTART_ALWAYS, nil
+	}
+	return RESTART_ON_FAILURE, fmt.Errorf("unknown restart policy %q", policy)
+}
+
+type RestartConfig struct {
+	policy RestartPolicy
+	// delay before the first restart, doubled on every following restart up
+	// to maxBackoff
+	backoff    time.Duration
+	maxBackoff time.Duration
+	// more than maxRetries restarts within window is a crash loop, and the
+	// service won't be restarted again until started manually
+	maxRetries int
+	window     time.Duration
+}
+
+var DefaultRestartConfig = RestartConfig{
+	policy:     RESTART_ON_FAILURE,
+	backoff:    time.Second,
+	maxBackoff: time.Minute * 5,
+	maxRetries: 5,
+	window:     time.Minute * 30,
+}
+
+// Delay before the restart number attempt, starting at 0
+func (rc RestartConfig) delay(attempt int) time.Duration {
+	delay := rc.backoff
+	for range attempt {
+		delay *= 2
+		if delay >= rc.maxBackoff {
+			return rc.maxBackoff
+		}
+	}
+	return min(delay, rc.maxBackoff)
+}
+
+// true if a service that exited with the given log must be restarted
+func (rc RestartConfig) mustRestart(l *Log) bool {
+	switch rc.policy {
+	case RESTART_ALWAYS:
+		return true
+	case RESTART_ON_FAILURE:
+		return l == nil || l.logType == FATAL || l.logType == ERROR
+	}
+	return false
+}
+
+// Read the restart configuration of a service from the config table. Missing
+// values are stored with their defaults so they can be edited later.
+func ReadRestartConfig(service string) (RestartConfig, error) {
+	rc := DefaultRestartConfig
+	var errs []error
+
+	value, err := ReadConfig("restart", service, rc.policy.String())
+	errs = append(errs, err)
+	if rc.policy, err = ParseRestartPolicy(fmt.Sprint(value)); err != nil {
+		errs = append(errs, err)
+	}
+
+	rc.backoff, err = ReadDurationConfig("restart_backoff", service, rc.backoff)
+	errs = append(errs, err)
+	rc.maxBackoff, err = ReadDurationConfig("restart_max_backoff", service, rc.maxBackoff)
+	errs = append(errs, err)
+	rc.window, err = ReadDurationConfig("restart_window", service, rc.window)
+	errs = append(errs, err)
+	rc.maxRetries, err = ReadIntConfig("restart_retries", service, rc.maxRetries)
+	errs = append(errs, err)
+
+	return rc, errors.Join(errs...)
+}
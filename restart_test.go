@@ -0,0 +1,47 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRestartDelay(t *testing.T) {
+	rc := RestartConfig{backoff: time.Second, maxBackoff: time.Second * 10}
+	assert.Equal(t, time.Second, rc.delay(0))
+	assert.Equal(t, time.Second*2, rc.delay(1))
+	assert.Equal(t, time.Second*8, rc.delay(3))
+	assert.Equal(t, time.Second*10, rc.delay(4))
+	assert.Equal(t, time.Second*10, rc.delay(100))
+}
+
+func TestMustRestart(t *testing.T) {
+	crash := &Log{logType: FATAL}
+	exit := &Log{logType: INFO}
+	assert.False(t, RestartConfig{policy: RESTART_NEVER}.mustRestart(crash))
+	assert.True(t, RestartConfig{policy: RESTART_ON_FAILURE}.mustRestart(crash))
+	assert.False(t, RestartConfig{policy: RESTART_ON_FAILURE}.mustRestart(exit))
+	assert.True(t, RestartConfig{policy: RESTART_ALWAYS}.mustRestart(exit))
+}
+
+func TestReadRestartConfig(t *testing.T) {
+	_, err := DB.Exec("DELETE FROM config WHERE service='test_restart'")
+	assert.NoError(t, err)
+	rc, err := ReadRestartConfig("test_restart")
+	assert.NoError(t, err)
+	assert.Equal(t, DefaultRestartConfig, rc)
+
+	assert.NoError(t, SetConfig("restart", "test_restart", "always"))
+	assert.NoError(t, SetConfig("restart_window", "test_restart", "1h"))
+	assert.NoError(t, SetConfig("restart_retries", "test_restart", 2))
+	rc, err = ReadRestartConfig("test_restart")
+	assert.NoError(t, err)
+	assert.Equal(t, RESTART_ALWAYS, rc.policy)
+	assert.Equal(t, time.Hour, rc.window)
+	assert.Equal(t, 2, rc.maxRetries)
+
+	assert.NoError(t, SetConfig("restart", "test_restart", "sometimes"))
+	_, err = ReadRestartConfig("test_restart")
+	assert.ErrorContains(t, err, "unknown restart policy")
+}
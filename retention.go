@@ -0,0 +1,373 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// How long the logs are kept and how big the db may grow, read from the
+// config table of the "log" service
+type Retention struct {
+	// how long the logs of each type are kept, 0 forever
+	keep [DEBUG + 1]time.Duration
+	// keep_<type> settings of single services, which override keep
+	services map[string]map[LogType]time.Duration
+	// bytes of the db above which the oldest logs are deleted, 0 no limit
+	maxSize int64
+	// time between prunings, and between full vacuums
+	interval    time.Duration
+	vacuumEvery time.Duration
+}
+
+var DefaultRetention = Retention{
+	keep: [DEBUG + 1]time.Duration{
+		NORMAL:  time.Hour * 24 * 30,
+		FATAL:   0,
+		ERROR:   0,
+		WARNING: time.Hour * 24 * 90,
+		INFO:    time.Hour * 24 * 30,
+		DEBUG:   time.Hour * 24 * 3,
+	},
+	maxSize:     1024 << 20,
+	interval:    time.Hour,
+	vacuumEvery: time.Hour * 24 * 7,
+}
+
+// Logs deleted by each statement, so inserts are not held back for long
+const PruneBatch = 1000
+
+// Pause between batches
+const PrunePause = time.Millisecond * 10
+
+// How long after starting the logs are pruned for the first time
+const PruneDelay = time.Minute
+
+// Parse a retention such as "3d", "12h" or "forever", which is 0
+func ParseRetention(value string) (time.Duration, error) {
+	value = strings.TrimSpace(value)
+	switch {
+	case value == "forever" || value == "0":
+		return 0, nil
+	case strings.HasSuffix(value, "d"):
+		days, err := strconv.Atoi(strings.TrimSuffix(value, "d"))
+		if err != nil || days < 0 {
+			return 0, fmt.Errorf("invalid retention %q", value)
+		}
+		return time.Hour * 24 * time.Duration(days), nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid retention %q", value)
+	}
+	return d, nil
+}
+
+// The opposite of ParseRetention
+func formatRetention(d time.Duration) string {
+	switch {
+	case d == 0:
+		return "forever"
+	case d%(time.Hour*24) == 0:
+		return strconv.Itoa(int(d/(time.Hour*24))) + "d"
+	}
+	return d.String()
+}
+
+func readRetentionConfig(name string, service string, defaultvalue time.Duration) (time.Duration, error) {
+	value, err := ReadConfig(name, service, formatRetention(defaultvalue))
+	if err != nil {
+		return defaultvalue, err
+	}
+	d, err := ParseRetention(fmt.Sprint(value))
+	if err != nil {
+		return defaultvalue, fmt.Errorf("%v of %v: %w", name, service, err)
+	}
+	return d, nil
+}
+
+// Read the retention from the config table: keep_<type> (keep_debug,
+// keep_info...), max_db_mb, prune_interval and vacuum_every of the "log"
+// service, and keep_<type> of any other service for its own logs
+func ReadRetention() (Retention, error) {
+	r := DefaultRetention
+	r.services = make(map[string]map[LogType]time.Duration)
+	var errs []error
+	var err error
+	for lt := LogType(NORMAL); lt <= DEBUG; lt++ {
+		r.keep[lt], err = readRetentionConfig("keep_"+strings.ToLower(lt.Name()), "log", r.keep[lt])
+		errs = append(errs, err)
+	}
+	maxMB, err := ReadIntConfig("max_db_mb", "log", int(r.maxSize>>20))
+	errs = append(errs, err)
+	r.maxSize = int64(maxMB) << 20
+	r.interval, err = readRetentionConfig("prune_interval", "log", r.interval)
+	errs = append(errs, err)
+	if r.interval == 0 {
+		r.interval = DefaultRetention.interval
+	}
+	r.vacuumEvery, err = readRetentionConfig("vacuum_every", "log", r.vacuumEvery)
+	errs = append(errs, err)
+
+	rows, err := DB.QueryContext(ServicesContext,
+		`SELECT service, name, value FROM config WHERE name LIKE 'keep\_%' ESCAPE '\' AND service != 'log'`)
+	if err != nil {
+		return r, errors.Join(append(errs, err)...)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var service, name, value string
+		if err := rows.Scan(&service, &name, &value); err != nil {
+			return r, errors.Join(append(errs, err)...)
+		}
+		lt, err := ParseLogType(strings.TrimPrefix(name, "keep_"))
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%v of %v: %w", name, service, err))
+			continue
+		}
+		d, err := ParseRetention(value)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%v of %v: %w", name, service, err))
+			continue
+		}
+		if r.services[service] == nil {
+			r.services[service] = make(map[LogType]time.Duration)
+		}
+		r.services[service][lt] = d
+	}
+	errs = append(errs, rows.Err())
+	return r, errors.Join(errs...)
+}
+
+// Delete the logs matching where in batches, returning how many were deleted
+func deleteLogs(ctx context.Context, db *sql.DB, where string, args ...any) (int64, error) {
+	var deleted int64
+	for {
+		result, err := db.ExecContext(ctx,
+			"DELETE FROM log WHERE id IN (SELECT id FROM log WHERE "+where+" LIMIT ?)",
+			append(args, PruneBatch)...)
+		if err != nil {
+			return deleted, err
+		}
+		n, err := result.RowsAffected()
+		if err != nil {
+			return deleted, err
+		}
+		deleted += n
+		if n < PruneBatch {
+			return deleted, nil
+		}
+		select {
+		case <-time.After(PrunePause):
+		case <-ctx.Done():
+			return deleted, ctx.Err()
+		}
+	}
+}
+
+// Delete the logs older than their retention, returning how many were deleted
+func PruneLogs(ctx context.Context, db *sql.DB, r Retention, now time.Time) (int64, error) {
+	var deleted int64
+	for lt := LogType(NORMAL); lt <= DEBUG; lt++ {
+		// the services with their own retention of the type are pruned apart
+		where := "type_id=? AND timestamp<?"
+		args := []any{lt, now.Add(-r.keep[lt]).UnixNano()}
+		for service, keep := range r.services {
+			d, ok := keep[lt]
+			if !ok {
+				continue
+			}
+			where += " AND service!=?"
+			args = append(args, service)
+			if d == 0 {
+				continue
+			}
+			n, err := deleteLogs(ctx, db, "type_id=? AND service=? AND timestamp<?",
+				lt, service, now.Add(-d).UnixNano())
+			deleted += n
+			if err != nil {
+				return deleted, err
+			}
+		}
+		if r.keep[lt] == 0 {
+			continue
+		}
+		n, err := deleteLogs(ctx, db, where, args...)
+		deleted += n
+		if err != nil {
+			return deleted, err
+		}
+	}
+	return deleted, nil
+}
+
+// Bytes of the db in use, and of its file including the free pages
+func dbSize(ctx context.Context, db *sql.DB) (used int64, total int64, err error) {
+	err = db.QueryRowContext(ctx,
+		"SELECT (page_count - freelist_count) * page_size, page_count * page_size "+
+			"FROM pragma_page_count(), pragma_freelist_count(), pragma_page_size()").
+		Scan(&used, &total)
+	return used, total, err
+}
+
+// The log types in the order they are given up when the db is too big
+var expendableLogTypes = []LogType{DEBUG, INFO, NORMAL, WARNING, ERROR, FATAL}
+
+// Delete the oldest logs, the least important types first, until the db
+// uses at most maxSize bytes. It returns how many were deleted.
+func ShrinkLogs(ctx context.Context, db *sql.DB, maxSize int64) (int64, error) {
+	var deleted int64
+	if maxSize <= 0 {
+		return 0, nil
+	}
+	for _, lt := range expendableLogTypes {
+		for {
+			used, _, err := dbSize(ctx, db)
+			if err != nil {
+				return deleted, err
+			}
+			if used <= maxSize {
+				return deleted, nil
+			}
+			result, err := db.ExecContext(ctx,
+				"DELETE FROM log WHERE id IN (SELECT id FROM log WHERE type_id=? ORDER BY timestamp, id LIMIT ?)",
+				lt, PruneBatch)
+			if err != nil {
+				return deleted, err
+			}
+			n, err := result.RowsAffected()
+			if err != nil {
+				return deleted, err
+			}
+			deleted += n
+			if n == 0 {
+				break
+			}
+			select {
+			case <-time.After(PrunePause):
+			case <-ctx.Done():
+				return deleted, ctx.Err()
+			}
+		}
+	}
+	return deleted, nil
+}
+
+// Give the free pages of the db back to the file system. A full vacuum
+// rebuilds the whole db, otherwise only the free pages are released, which
+// needs the db to be in incremental auto vacuum mode. A full vacuum puts it
+// in that mode.
+func VacuumDb(ctx context.Context, db *sql.DB, full bool) error {
+	// the pragmas and the vacuum must use the same connection
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	var mode int
+	if err := conn.QueryRowContext(ctx, "PRAGMA auto_vacuum").Scan(&mode); err != nil {
+		return err
+	}
+	// 2 is incremental, which only a full vacuum can change to
+	if mode != 2 || full {
+		if _, err := conn.ExecContext(ctx, "PRAGMA auto_vacuum = INCREMENTAL"); err != nil {
+			return err
+		}
+		_, err := conn.ExecContext(ctx, "VACUUM")
+		return err
+	}
+	// every page freed is a row, which must be read for it to go on
+	rows, err := conn.QueryContext(ctx, "PRAGMA incremental_vacuum")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+	}
+	return rows.Err()
+}
+
+// Prune the logs of the db and vacuum it once, logging what was done
+func RetainLogsOnce(ctx context.Context, db *sql.DB, r Retention, fullVacuum bool, onLog func(*Log)) error {
+	logf := func(lt LogType, format string, args ...any) {
+		onLog(&Log{date: time.Now(), logType: lt, service: "LNBank", desc: fmt.Sprintf(format, args...)})
+	}
+	_, before, err := dbSize(ctx, db)
+	if err != nil {
+		return err
+	}
+	start := time.Now()
+	pruned, err := PruneLogs(ctx, db, r, start)
+	if err != nil {
+		return fmt.Errorf("cannot prune the logs: %w", err)
+	}
+	shrunk, err := ShrinkLogs(ctx, db, r.maxSize)
+	if err != nil {
+		return fmt.Errorf("cannot shrink the logs: %w", err)
+	}
+	if shrunk > 0 {
+		logf(WARNING, "the database is over %v MB, the %v oldest logs were deleted", r.maxSize>>20, shrunk)
+	}
+	if err := VacuumDb(ctx, db, fullVacuum); err != nil {
+		return fmt.Errorf("cannot vacuum the database: %w", err)
+	}
+	_, after, err := dbSize(ctx, db)
+	if err != nil {
+		return err
+	}
+	if pruned+shrunk > 0 || fullVacuum || after != before {
+		vacuum := "incremental"
+		if fullVacuum {
+			vacuum = "full"
+		}
+		logf(INFO, "%v old logs deleted, %v vacuum, the database went from %.1f MB to %.1f MB in %v",
+			pruned+shrunk, vacuum, float64(before)/(1<<20), float64(after)/(1<<20),
+			time.Since(start).Round(time.Millisecond))
+	}
+	return nil
+}
+
+// Prune the logs of DB every prune_interval, with a full vacuum every
+// vacuum_every, until ctx is done. The logs go to sup.
+func RetainLogs(ctx context.Context, sup *Supervisor) {
+	warn := func(desc string) {
+		sup.log(&Log{date: time.Now(), logType: WARNING, service: "LNBank", desc: desc})
+	}
+	go func() {
+		wait := PruneDelay
+		for {
+			select {
+			case <-time.After(wait):
+			case <-ctx.Done():
+				return
+			}
+			// read every time, so changes apply without restarting
+			r, err := ReadRetention()
+			if err != nil {
+				warn("cannot read the log retention: " + err.Error())
+			}
+			wait = r.interval
+
+			last, err := ReadIntConfig("last_vacuum", "log", 0)
+			if err != nil {
+				warn("cannot read the last vacuum: " + err.Error())
+			}
+			full := r.vacuumEvery > 0 && time.Since(time.Unix(int64(last), 0)) >= r.vacuumEvery
+			if err := RetainLogsOnce(ctx, DB, r, full, sup.log); err != nil {
+				if ctx.Err() == nil {
+					warn(err.Error())
+				}
+				continue
+			}
+			if full {
+				if err := SetConfig("last_vacuum", "log", time.Now().Unix()); err != nil {
+					warn("cannot store the last vacuum: " + err.Error())
+				}
+			}
+		}
+	}()
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// A db of its own with the log table, so the logs of LNBank are not pruned
+func retentionDb(t *testing.T) *sql.DB {
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "retention.sqlite3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if _, err := db.Exec(LogTable); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("DELETE FROM log"); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func insertLogs(t *testing.T, db *sql.DB, n int, date time.Time, lt LogType, service string) {
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range n {
+		_, err := tx.Exec("INSERT INTO log (timestamp, type_id, desc, service) VALUES (?, ?, ?, ?)",
+			date.UnixNano(), lt, fmt.Sprintf("log %v %v", i, strings.Repeat("x", 200)), service)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func countLogs(t *testing.T, db *sql.DB, lt LogType, service string) int {
+	var n int
+	if err := db.QueryRow("SELECT count(*) FROM log WHERE type_id=? AND service=?", lt, service).Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestParseRetention(t *testing.T) {
+	for value, want := range map[string]time.Duration{
+		"forever": 0,
+		"0":       0,
+		"3d":      time.Hour * 72,
+		"12h":     time.Hour * 12,
+		" 30d ":   time.Hour * 24 * 30,
+	} {
+		d, err := ParseRetention(value)
+		assert.NoError(t, err, value)
+		assert.Equal(t, want, d, value)
+		back, err := ParseRetention(formatRetention(d))
+		assert.NoError(t, err, value)
+		assert.Equal(t, d, back, value)
+	}
+	for _, value := range []string{"", "3 days", "-1d", "-2h", "xd"} {
+		_, err := ParseRetention(value)
+		assert.Error(t, err, value)
+	}
+}
+
+func TestReadRetention(t *testing.T) {
+	service := fmt.Sprint("retention", time.Now().UnixNano())
+	assert.NoError(t, SetConfig("keep_debug", service, "1d"))
+	assert.NoError(t, SetConfig("keep_error", service, "forever"))
+	r, err := ReadRetention()
+	assert.NoError(t, err)
+	assert.Equal(t, map[LogType]time.Duration{DEBUG: time.Hour * 24, ERROR: 0}, r.services[service])
+	assert.NotZero(t, r.interval)
+
+	assert.NoError(t, SetConfig("keep_loud", service, "1d"))
+	r, err = ReadRetention()
+	assert.ErrorContains(t, err, "keep_loud of "+service)
+	assert.Len(t, r.services[service], 2)
+	_, err = DB.Exec("DELETE FROM config WHERE service=?", service)
+	assert.NoError(t, err)
+}
+
+func TestPruneLogs(t *testing.T) {
+	db := retentionDb(t)
+	now := time.Now()
+	old := now.Add(-time.Hour * 24 * 10)
+	insertLogs(t, db, 2500, old, DEBUG, "Tor")
+	insertLogs(t, db, 10, now, DEBUG, "Tor")
+	insertLogs(t, db, 10, old, DEBUG, "Lnd")
+	insertLogs(t, db, 10, old, ERROR, "Tor")
+	insertLogs(t, db, 10, old, ERROR, "Lnd")
+	insertLogs(t, db, 10, old, INFO, "Lnd")
+
+	r := DefaultRetention
+	r.services = map[string]map[LogType]time.Duration{
+		// lnd keeps its debug logs longer, and its errors not forever
+		"Lnd": {DEBUG: time.Hour * 24 * 30, ERROR: time.Hour * 24},
+	}
+	deleted, err := PruneLogs(context.Background(), db, r, now)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2510), deleted)
+	assert.Equal(t, 10, countLogs(t, db, DEBUG, "Tor"))
+	assert.Equal(t, 10, countLogs(t, db, DEBUG, "Lnd"))
+	assert.Equal(t, 10, countLogs(t, db, ERROR, "Tor"))
+	assert.Equal(t, 0, countLogs(t, db, ERROR, "Lnd"))
+	assert.Equal(t, 10, countLogs(t, db, INFO, "Lnd"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	insertLogs(t, db, 2500, old, DEBUG, "Tor")
+	deleted, err = PruneLogs(ctx, db, r, now)
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Less(t, deleted, int64(2500))
+}
+
+func TestShrinkLogs(t *testing.T) {
+	db := retentionDb(t)
+	now := time.Now()
+	insertLogs(t, db, 3000, now.Add(-time.Hour), DEBUG, "Tor")
+	insertLogs(t, db, 3000, now, DEBUG, "Tor")
+	insertLogs(t, db, 3000, now.Add(-time.Hour*2), ERROR, "Tor")
+	used, _, err := dbSize(context.Background(), db)
+	assert.NoError(t, err)
+
+	// the oldest debug logs go first, the errors are kept
+	deleted, err := ShrinkLogs(context.Background(), db, used*2/3)
+	assert.NoError(t, err)
+	assert.GreaterOrEqual(t, deleted, int64(2000))
+	assert.LessOrEqual(t, deleted, int64(4000))
+	assert.Equal(t, 3000, countLogs(t, db, ERROR, "Tor"))
+	var newest int
+	assert.NoError(t, db.QueryRow("SELECT count(*) FROM log WHERE type_id=? AND timestamp=?", DEBUG, now.UnixNano()).Scan(&newest))
+	assert.Equal(t, 6000-int(deleted), countLogs(t, db, DEBUG, "Tor"))
+	assert.GreaterOrEqual(t, newest, 2000)
+	used2, _, err := dbSize(context.Background(), db)
+	assert.NoError(t, err)
+	assert.LessOrEqual(t, used2, used*2/3)
+
+	deleted, err = ShrinkLogs(context.Background(), db, 0)
+	assert.NoError(t, err)
+	assert.Zero(t, deleted)
+}
+
+func TestRetainLogsOnce(t *testing.T) {
+	db := retentionDb(t)
+	var mode int
+	assert.NoError(t, db.QueryRow("PRAGMA auto_vacuum").Scan(&mode))
+	assert.Equal(t, 2, mode, "new dbs vacuum incrementally")
+
+	insertLogs(t, db, 5000, time.Now().Add(-time.Hour*24*10), DEBUG, "Tor")
+	_, before, err := dbSize(context.Background(), db)
+	assert.NoError(t, err)
+	var logs []*Log
+	r := DefaultRetention
+	r.maxSize = 0
+	assert.NoError(t, RetainLogsOnce(context.Background(), db, r, false, func(l *Log) { logs = append(logs, l) }))
+	_, after, err := dbSize(context.Background(), db)
+	assert.NoError(t, err)
+	assert.Less(t, after, before/2)
+	if assert.Len(t, logs, 1) {
+		assert.Equal(t, LogType(INFO), logs[0].logType)
+		assert.Contains(t, logs[0].desc, "5000 old logs deleted, incremental vacuum")
+	}
+
+	// a db that does not vacuum incrementally gets a full vacuum
+	_, err = db.Exec("PRAGMA auto_vacuum = NONE; VACUUM")
+	assert.NoError(t, err)
+	assert.NoError(t, VacuumDb(context.Background(), db, false))
+	assert.NoError(t, db.QueryRow("PRAGMA auto_vacuum").Scan(&mode))
+	assert.Equal(t, 2, mode)
+}
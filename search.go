@@ -0,0 +1,507 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Full text index of the descriptions of the logs, kept in sync by triggers.
+// It needs SQLite built with FTS5, which go-sqlite3 does with the
+// sqlite_fts5 build tag. Without it the logs are searched with LIKE.
+const LogSearchTable = `
+CREATE VIRTUAL TABLE IF NOT EXISTS log_fts USING fts5(desc, content='log', content_rowid='id');
+CREATE TRIGGER IF NOT EXISTS log_fts_insert AFTER INSERT ON log BEGIN
+    INSERT INTO log_fts (rowid, desc) VALUES (new.id, new.desc);
+END;
+CREATE TRIGGER IF NOT EXISTS log_fts_delete AFTER DELETE ON log BEGIN
+    INSERT INTO log_fts (log_fts, rowid, desc) VALUES ('delete', old.id, old.desc);
+END;
+CREATE TRIGGER IF NOT EXISTS log_fts_update AFTER UPDATE OF desc ON log BEGIN
+    INSERT INTO log_fts (log_fts, rowid, desc) VALUES ('delete', old.id, old.desc);
+    INSERT INTO log_fts (rowid, desc) VALUES (new.id, new.desc);
+END;
+`
+
+// Whether the logs of DB are searched with the full text index
+var ftsLogs bool
+
+// Around the terms found in the snippet of a search result
+const (
+	HighlightStart = "«"
+	HighlightEnd   = "»"
+)
+
+// Bytes of the description around the first term found shown in a snippet
+// when the logs are searched without the index
+const SnippetLength = 160
+
+var errNoFts = errors.New("SQLite was built without FTS5, logs are searched without an index")
+
+// Create the full text index of the logs of db and fill it with the logs it
+// does not have yet. Without FTS5, as in a build without -tags sqlite_fts5,
+// its triggers are removed, so logging keeps working with a db created by a
+// build that had it, and errNoFts is returned.
+func CreateLogSearch(ctx context.Context, db *sql.DB) error {
+	var fts bool
+	if err := db.QueryRowContext(ctx, "SELECT sqlite_compileoption_used('ENABLE_FTS5')").Scan(&fts); err != nil {
+		return err
+	}
+	if !fts {
+		_, err := db.ExecContext(ctx, `
+DROP TRIGGER IF EXISTS log_fts_insert;
+DROP TRIGGER IF EXISTS log_fts_delete;
+DROP TRIGGER IF EXISTS log_fts_update;`)
+		return errors.Join(errNoFts, err)
+	}
+	var triggers int
+	if err := db.QueryRowContext(ctx,
+		"SELECT count(*) FROM sqlite_master WHERE type='trigger' AND name LIKE 'log\\_fts\\_%' ESCAPE '\\'").
+		Scan(&triggers); err != nil {
+		return err
+	}
+	if triggers == 3 {
+		return nil
+	}
+	// new, or its triggers were removed and it missed some logs
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, LogSearchTable); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "INSERT INTO log_fts (log_fts) VALUES ('rebuild')"); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// A search of logs such as `tor AND (bootstrap OR circuit) -warn "no route" conn*`:
+// words and "quoted phrases" must all be found unless joined with OR, NOT or
+// a leading - excludes a word, phrase or group, and a trailing * matches
+// words starting with it. Case does not matter, and words without letters or
+// digits are ignored.
+type SearchQuery struct {
+	expr searchExpr
+	// the words and phrases to be found, for the snippets without the index
+	terms []searchTerm
+}
+
+type searchExpr interface {
+	// the expression in the FTS5 query syntax
+	fts() string
+	// a condition on the column col using LIKE, and its parameters
+	like(col string) (string, []any)
+}
+
+type searchTerm struct {
+	text   string
+	prefix bool
+}
+
+func (st searchTerm) fts() string {
+	quoted := `"` + strings.ReplaceAll(st.text, `"`, `""`) + `"`
+	if st.prefix {
+		return quoted + "*"
+	}
+	return quoted
+}
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+func (st searchTerm) like(col string) (string, []any) {
+	return col + ` LIKE ? ESCAPE '\'`, []any{"%" + likeEscaper.Replace(st.text) + "%"}
+}
+
+// Every expression of all must match and none of not
+type searchAnd struct {
+	all []searchExpr
+	not []searchExpr
+}
+
+func (sa searchAnd) fts() string {
+	all := make([]string, 0, len(sa.all))
+	for _, e := range sa.all {
+		all = append(all, e.fts())
+	}
+	query := "(" + strings.Join(all, " AND ") + ")"
+	for _, e := range sa.not {
+		query = "(" + query + " NOT " + e.fts() + ")"
+	}
+	return query
+}
+
+func (sa searchAnd) like(col string) (string, []any) {
+	var conditions []string
+	var args []any
+	for _, e := range sa.all {
+		condition, eargs := e.like(col)
+		conditions = append(conditions, condition)
+		args = append(args, eargs...)
+	}
+	for _, e := range sa.not {
+		condition, eargs := e.like(col)
+		conditions = append(conditions, "NOT "+condition)
+		args = append(args, eargs...)
+	}
+	return "(" + strings.Join(conditions, " AND ") + ")", args
+}
+
+// Any expression must match
+type searchOr []searchExpr
+
+func (so searchOr) fts() string {
+	alts := make([]string, 0, len(so))
+	for _, e := range so {
+		alts = append(alts, e.fts())
+	}
+	return "(" + strings.Join(alts, " OR ") + ")"
+}
+
+func (so searchOr) like(col string) (string, []any) {
+	var conditions []string
+	var args []any
+	for _, e := range so {
+		condition, eargs := e.like(col)
+		conditions = append(conditions, condition)
+		args = append(args, eargs...)
+	}
+	return "(" + strings.Join(conditions, " OR ") + ")", args
+}
+
+// Parse a search, nil if it has nothing to search for
+func ParseSearch(query string) (*SearchQuery, error) {
+	tokens, err := searchTokens(query)
+	if err != nil {
+		return nil, err
+	}
+	p := searchParser{tokens: tokens}
+	expr, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %q in the search", p.tokens[p.pos].text)
+	}
+	if expr == nil {
+		return nil, nil
+	}
+	return &SearchQuery{expr: expr, terms: p.terms}, nil
+}
+
+type searchToken struct {
+	text string
+	// a quoted phrase, never an operator
+	phrase bool
+}
+
+func searchTokens(query string) ([]searchToken, error) {
+	var tokens []searchToken
+	rs := []rune(query)
+	for i := 0; i < len(rs); {
+		switch r := rs[i]; {
+		case unicode.IsSpace(r):
+			i++
+		case r == '(' || r == ')':
+			tokens = append(tokens, searchToken{text: string(r)})
+			i++
+		case r == '-' && i+1 < len(rs) && !unicode.IsSpace(rs[i+1]):
+			tokens = append(tokens, searchToken{text: "NOT"})
+			i++
+		case r == '"':
+			end := i + 1
+			for end < len(rs) && rs[end] != '"' {
+				end++
+			}
+			if end == len(rs) {
+				return nil, errors.New("missing closing \" in the search")
+			}
+			text := string(rs[i+1 : end])
+			i = end + 1
+			if i < len(rs) && rs[i] == '*' {
+				text += "*"
+				i++
+			}
+			tokens = append(tokens, searchToken{text: text, phrase: true})
+		default:
+			end := i
+			for end < len(rs) && !unicode.IsSpace(rs[end]) && !strings.ContainsRune(`()"`, rs[end]) {
+				end++
+			}
+			tokens = append(tokens, searchToken{text: string(rs[i:end])})
+			i = end
+		}
+	}
+	return tokens, nil
+}
+
+type searchParser struct {
+	tokens []searchToken
+	pos    int
+	// the terms found outside NOT
+	terms []searchTerm
+	not   int
+}
+
+func (p *searchParser) peek() (searchToken, bool) {
+	if p.pos >= len(p.tokens) {
+		return searchToken{}, false
+	}
+	return p.tokens[p.pos], true
+}
+
+func (p *searchParser) operator(name string) bool {
+	t, ok := p.peek()
+	return ok && !t.phrase && t.text == name
+}
+
+func (p *searchParser) or() (searchExpr, error) {
+	var alts searchOr
+	for {
+		start := p.pos
+		e, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		if e != nil {
+			alts = append(alts, e)
+		}
+		if !p.operator("OR") {
+			if p.pos == start && start > 0 && p.tokens[start-1].text == "OR" {
+				return nil, errors.New("nothing after OR in the search")
+			}
+			break
+		}
+		if p.pos == start {
+			return nil, errors.New(`unexpected "OR" in the search`)
+		}
+		p.pos++
+	}
+	switch len(alts) {
+	case 0:
+		return nil, nil
+	case 1:
+		return alts[0], nil
+	}
+	return alts, nil
+}
+
+func (p *searchParser) and() (searchExpr, error) {
+	var sa searchAnd
+	end := func() bool {
+		_, ok := p.peek()
+		return !ok || p.operator(")") || p.operator("OR")
+	}
+	for !end() {
+		if p.operator("AND") {
+			p.pos++
+			if len(sa.all)+len(sa.not) == 0 || end() {
+				return nil, errors.New(`unexpected "AND" in the search`)
+			}
+			continue
+		}
+		not := p.operator("NOT")
+		if not {
+			p.pos++
+			if end() {
+				return nil, errors.New("nothing after NOT in the search")
+			}
+			p.not++
+		}
+		e, err := p.primary()
+		if not {
+			p.not--
+		}
+		if err != nil {
+			return nil, err
+		}
+		if e == nil {
+			continue
+		}
+		if not {
+			sa.not = append(sa.not, e)
+		} else {
+			sa.all = append(sa.all, e)
+		}
+	}
+	switch {
+	case len(sa.all) == 0 && len(sa.not) == 0:
+		return nil, nil
+	case len(sa.all) == 0:
+		return nil, errors.New("a search needs a word to find besides the excluded ones")
+	case len(sa.all) == 1 && len(sa.not) == 0:
+		return sa.all[0], nil
+	}
+	return sa, nil
+}
+
+func (p *searchParser) primary() (searchExpr, error) {
+	t, ok := p.peek()
+	if !ok {
+		return nil, nil
+	}
+	p.pos++
+	if !t.phrase && t.text == "(" {
+		e, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if !p.operator(")") {
+			return nil, errors.New("missing closing ) in the search")
+		}
+		p.pos++
+		return e, nil
+	}
+	if !t.phrase && (t.text == ")" || t.text == "AND" || t.text == "OR" || t.text == "NOT") {
+		return nil, fmt.Errorf("unexpected %q in the search", t.text)
+	}
+	term := searchTerm{text: t.text}
+	if strings.HasSuffix(term.text, "*") {
+		term.text, term.prefix = strings.TrimRight(term.text, "*"), true
+	}
+	if !strings.ContainsFunc(term.text, func(r rune) bool { return unicode.IsLetter(r) || unicode.IsDigit(r) }) {
+		return nil, nil
+	}
+	if p.not == 0 {
+		p.terms = append(p.terms, term)
+	}
+	return term, nil
+}
+
+// The condition on the log table matching the search, and its parameters
+func (sq *SearchQuery) condition() (string, []any) {
+	if ftsLogs {
+		return "log.id IN (SELECT rowid FROM log_fts WHERE log_fts MATCH ?)", []any{sq.expr.fts()}
+	}
+	return sq.expr.like("log.desc")
+}
+
+// The part of a description around the first term found, with every term
+// found between HighlightStart and HighlightEnd
+func (sq *SearchQuery) snippet(desc string) string {
+	patterns := make([]string, 0, len(sq.terms))
+	for _, term := range sq.terms {
+		patterns = append(patterns, regexp.QuoteMeta(term.text))
+	}
+	found := regexp.MustCompile("(?i)" + strings.Join(patterns, "|"))
+	first := found.FindStringIndex(desc)
+	if first != nil && len(desc) > SnippetLength {
+		start := max(0, first[0]-SnippetLength/4)
+		end := min(len(desc), start+SnippetLength)
+		// not in the middle of a character
+		for start > 0 && !utf8.RuneStart(desc[start]) {
+			start--
+		}
+		for end < len(desc) && !utf8.RuneStart(desc[end]) {
+			end++
+		}
+		cut := desc[start:end]
+		if start > 0 {
+			cut = "…" + cut
+		}
+		if end < len(desc) {
+			cut += "…"
+		}
+		desc = cut
+	}
+	return found.ReplaceAllString(desc, HighlightStart+"$0"+HighlightEnd)
+}
+
+// A log found by SearchLog
+type SearchResult struct {
+	Log
+	// the part of the description where it was found, highlighted
+	snippet string
+	// lower is better, 0 when searched without the index
+	rank float64
+}
+
+func (sr SearchResult) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Seq       int64             `json:"seq"`
+		Time      time.Time         `json:"time"`
+		Type      string            `json:"type"`
+		Service   string            `json:"service"`
+		Subsystem string            `json:"subsystem,omitempty"`
+		Category  string            `json:"category"`
+		Desc      string            `json:"desc"`
+		Fields    map[string]string `json:"fields,omitempty"`
+		Snippet   string            `json:"snippet"`
+		Rank      float64           `json:"rank"`
+	}{sr.seq, sr.date, sr.logType.Name(), sr.service, sr.subsystem, sr.category(), sr.desc, sr.fields, sr.snippet, sr.rank})
+}
+
+// Search the logs of the last duration, best matches first or the newest
+// ones without the full text index. logtypes, services and categories narrow
+// it when not nil, and limit is the maximum number of results, 0 for no limit.
+func SearchLog(query string,
+	duration time.Duration,
+	logtypes []LogType,
+	services []string,
+	categories []string,
+	limit uint,
+) ([]SearchResult, error) {
+	sq, err := ParseSearch(query)
+	if err != nil {
+		return nil, err
+	}
+	if sq == nil {
+		return nil, errors.New("nothing to search for")
+	}
+	var sqlquery strings.Builder
+	var params []any
+	if ftsLogs {
+		sqlquery.WriteString("SELECT log.id, log.timestamp, log.type_id, log.service, log.subsystem, log.desc, log.fields, " +
+			"snippet(log_fts, 0, ?, ?, '…', 32), bm25(log_fts) " +
+			"FROM log_fts JOIN log ON log.id = log_fts.rowid WHERE log_fts MATCH ?")
+		params = append(params, HighlightStart, HighlightEnd, sq.expr.fts())
+	} else {
+		condition, args := sq.condition()
+		sqlquery.WriteString("SELECT log.id, log.timestamp, log.type_id, log.service, log.subsystem, log.desc, log.fields, '', 0 " +
+			"FROM log WHERE " + condition)
+		params = append(params, args...)
+	}
+	where, args, err := SelectLogs().Since(duration).Types(logtypes...).Services(services...).
+		Categories(categories...).where()
+	if err != nil {
+		return nil, err
+	}
+	sqlquery.WriteString(" AND " + where)
+	params = append(params, args...)
+	if ftsLogs {
+		sqlquery.WriteString(" ORDER BY bm25(log_fts), log.timestamp DESC, log.id DESC")
+	} else {
+		sqlquery.WriteString(" ORDER BY log.timestamp DESC, log.id DESC")
+	}
+	if limit != 0 {
+		sqlquery.WriteString(" LIMIT ?")
+		params = append(params, limit)
+	}
+
+	rows, err := DB.QueryContext(ServicesContext, sqlquery.String(), params...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var results []SearchResult
+	for rows.Next() {
+		var sr SearchResult
+		if err := scanLog(rows, &sr.Log, &sr.snippet, &sr.rank); err != nil {
+			return nil, err
+		}
+		if !ftsLogs {
+			sr.snippet = sq.snippet(sr.desc)
+		}
+		results = append(results, sr)
+	}
+	return results, rows.Err()
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseSearch(t *testing.T) {
+	tests := []struct {
+		query string
+		fts   string
+		like  string
+		args  []any
+	}{
+		{`tor`, `"tor"`, `desc LIKE ? ESCAPE '\'`, []any{"%tor%"}},
+		{`tor bootstrap`, `("tor" AND "bootstrap")`, `(desc LIKE ? ESCAPE '\' AND desc LIKE ? ESCAPE '\')`, []any{"%tor%", "%bootstrap%"}},
+		{`tor AND boot*`, `("tor" AND "boot"*)`, `(desc LIKE ? ESCAPE '\' AND desc LIKE ? ESCAPE '\')`, []any{"%tor%", "%boot%"}},
+		{`tor OR lnd`, `("tor" OR "lnd")`, `(desc LIKE ? ESCAPE '\' OR desc LIKE ? ESCAPE '\')`, []any{"%tor%", "%lnd%"}},
+		{`"no route" -warn`, `(("no route") NOT "warn")`, `(desc LIKE ? ESCAPE '\' AND NOT desc LIKE ? ESCAPE '\')`, []any{"%no route%", "%warn%"}},
+		{`a NOT (b OR c)`, `(("a") NOT ("b" OR "c"))`, `(desc LIKE ? ESCAPE '\' AND NOT (desc LIKE ? ESCAPE '\' OR desc LIKE ? ESCAPE '\'))`, []any{"%a%", "%b%", "%c%"}},
+		{`(x OR y) z`, `(("x" OR "y") AND "z")`, `((desc LIKE ? ESCAPE '\' OR desc LIKE ? ESCAPE '\') AND desc LIKE ? ESCAPE '\')`, []any{"%x%", "%y%", "%z%"}},
+		{`50% "say "`, `("50%" AND "say ")`, `(desc LIKE ? ESCAPE '\' AND desc LIKE ? ESCAPE '\')`, []any{`%50\%%`, "%say %"}},
+		{`description % 4`, `("description" AND "4")`, `(desc LIKE ? ESCAPE '\' AND desc LIKE ? ESCAPE '\')`, []any{"%description%", "%4%"}},
+	}
+	for _, test := range tests {
+		sq, err := ParseSearch(test.query)
+		if !assert.NoError(t, err, test.query) || !assert.NotNil(t, sq, test.query) {
+			continue
+		}
+		assert.Equal(t, test.fts, sq.expr.fts(), test.query)
+		like, args := sq.expr.like("desc")
+		assert.Equal(t, test.like, like, test.query)
+		assert.Equal(t, test.args, args, test.query)
+	}
+
+	for _, query := range []string{"", "  ", "% -", "()"} {
+		sq, err := ParseSearch(query)
+		assert.NoError(t, err, query)
+		assert.Nil(t, sq, query)
+	}
+	for query, msg := range map[string]string{
+		`"open`:    `missing closing "`,
+		`(a OR b`:  `missing closing )`,
+		`a)`:       `unexpected ")"`,
+		`-a`:       `a word to find`,
+		`a NOT`:    `nothing after NOT`,
+		`a OR AND`: `unexpected "AND"`,
+		`a AND`:    `unexpected "AND"`,
+		`a OR`:     `nothing after OR`,
+		`OR a`:     `unexpected "OR"`,
+	} {
+		_, err := ParseSearch(query)
+		assert.ErrorContains(t, err, msg, query)
+	}
+}
+
+func TestSnippet(t *testing.T) {
+	sq, err := ParseSearch(`route* -nothing "peer é"`)
+	assert.NoError(t, err)
+	assert.Equal(t, "no «route» to «PEER é»", sq.snippet("no route to PEER é"))
+
+	long := strings.Repeat("é", 100) + " routes " + strings.Repeat("x", 200)
+	snippet := sq.snippet(long)
+	assert.True(t, strings.HasPrefix(snippet, "…é"), snippet)
+	assert.True(t, strings.HasSuffix(snippet, "x…"), snippet)
+	assert.Contains(t, snippet, " «route»s ")
+	assert.LessOrEqual(t, len(snippet), SnippetLength+20)
+}
+
+func searchLogs(t *testing.T, service string) {
+	for i, desc := range []string{
+		"bootstrapped 100%: done",
+		"bootstrapped 50%: loading relay descriptors",
+		"no route to peer, bootstrapped again",
+		"channel opened with peer",
+		"connection refused\ngoroutine 1 [running]:\nmain.main()",
+	} {
+		errs, fatal := LogToDb(&Log{
+			date:    time.Now().Add(-time.Minute * time.Duration(i)),
+			logType: INFO,
+			service: service,
+			desc:    desc,
+		})
+		assert.Nil(t, errs)
+		assert.False(t, fatal)
+	}
+}
+
+func TestSearchLog(t *testing.T) {
+	service := fmt.Sprint("search", time.Now().UnixNano())
+	searchLogs(t, service)
+	t.Cleanup(func() {
+		_, err := DB.Exec("DELETE FROM log WHERE service=?", service)
+		assert.NoError(t, err)
+	})
+	withFts := ftsLogs
+	t.Cleanup(func() { ftsLogs = withFts })
+
+	for _, fts := range []bool{false, true} {
+		if fts && !withFts {
+			t.Log("SQLite built without FTS5, the index is not tested")
+			continue
+		}
+		ftsLogs = fts
+		search := func(query string) []SearchResult {
+			results, err := SearchLog(query, time.Hour, nil, []string{service}, nil, 0)
+			assert.NoError(t, err, query)
+			return results
+		}
+		descs := func(results []SearchResult) []string {
+			var descs []string
+			for _, sr := range results {
+				descs = append(descs, sr.desc)
+			}
+			return descs
+		}
+
+		results := search("bootstrapped")
+		assert.Len(t, results, 3, fts)
+		for _, sr := range results {
+			assert.Contains(t, sr.snippet, HighlightStart+"bootstrapped"+HighlightEnd, fts)
+		}
+		if fts {
+			// the shortest matches are the most relevant
+			assert.Equal(t, "bootstrapped 100%: done", results[0].desc)
+			assert.Less(t, results[0].rank, 0.0)
+		} else {
+			assert.Equal(t, "bootstrapped 100%: done", results[0].desc, "newest first")
+		}
+		assert.ElementsMatch(t, []string{"bootstrapped 50%: loading relay descriptors"},
+			descs(search(`bootstrapped -"no route" -done`)), fts)
+		assert.ElementsMatch(t, []string{"channel opened with peer", "no route to peer, bootstrapped again"},
+			descs(search(`peer`)), fts)
+		assert.ElementsMatch(t, []string{"channel opened with peer", "bootstrapped 100%: done"},
+			descs(search(`chan* OR (done AND boot*)`)), fts)
+		assert.ElementsMatch(t, []string{"connection refused\ngoroutine 1 [running]:\nmain.main()"},
+			descs(search(`"connection refused" goroutine`)), fts)
+		assert.Empty(t, search(`"peer channel"`), fts)
+
+		results, err := SearchLog("peer", time.Hour, []LogType{ERROR}, []string{service}, nil, 0)
+		assert.NoError(t, err)
+		assert.Empty(t, results)
+		results, err = SearchLog("peer", time.Hour, nil, []string{service}, nil, 1)
+		assert.NoError(t, err)
+		assert.Len(t, results, 1)
+
+		q, err := QueryLog(time.Hour, nil, []string{service}, nil, "bootstrapped -again", 0)
+		assert.NoError(t, err)
+		logs, err := q.getn(10)
+		assert.NoError(t, err)
+		assert.Len(t, logs, 2, fts)
+		q.close()
+	}
+
+	_, err := SearchLog("% -", time.Hour, nil, nil, nil, 0)
+	assert.ErrorContains(t, err, "nothing to search")
+	_, err = QueryLog(time.Hour, nil, nil, nil, `"open`, 0)
+	assert.Error(t, err)
+}
+
+func TestLogSearchIndex(t *testing.T) {
+	if !ftsLogs {
+		t.Skip("SQLite built without FTS5")
+	}
+	ctx := context.Background()
+	db := retentionDb(t)
+	insertLogs(t, db, 10, time.Now(), INFO, "Tor")
+	assert.NoError(t, CreateLogSearch(ctx, db))
+	// the logs before the index are indexed too
+	count := func(query string) int {
+		var n int
+		assert.NoError(t, db.QueryRow("SELECT count(*) FROM log_fts WHERE log_fts MATCH ?", query).Scan(&n))
+		return n
+	}
+	assert.Equal(t, 10, count(`"log"`))
+	insertLogs(t, db, 5, time.Now(), INFO, "Lnd")
+	assert.Equal(t, 15, count(`"log"`))
+	assert.Equal(t, 1, count(`"log 3"`)+count(`"log 13"`)-1)
+
+	// deletes and vacuums keep it in sync
+	_, err := db.Exec("DELETE FROM log WHERE service='Tor'")
+	assert.NoError(t, err)
+	assert.Equal(t, 5, count(`"log"`))
+	assert.NoError(t, VacuumDb(ctx, db, true))
+	assert.Equal(t, 5, count(`"log"`))
+	var integrity error
+	_, integrity = db.Exec("INSERT INTO log_fts (log_fts, rank) VALUES ('integrity-check', 1)")
+	assert.NoError(t, integrity)
+	assert.NoError(t, CreateLogSearch(ctx, db))
+}
@@ -6,13 +6,16 @@ import (
 	"bytes"
 	"context"
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"runtime"
 	"strings"
+	"syscall"
 	"time"
 
 	_ "github.com/mattn/go-sqlite3"
@@ -24,6 +27,13 @@ type Log struct {
 	desc    string
 	service string
 	logType LogType
+	// part of the service that logged it, such as the lnd subsystem HSWC
+	subsystem string
+	// optional details of the log, such as those parsed by a manifest
+	fields map[string]string
+	// id of the log in the db, in the order logs were stored. 0 until it is
+	// read from the db.
+	seq int64
 }
 
 // log types
@@ -55,8 +65,57 @@ func (lt LogType) String() string {
 	}
 }
 
+// Plain name of the log type, for machines and terminals without emojis
+func (lt LogType) Name() string {
+	switch lt {
+	case FATAL:
+		return "FATAL"
+	case ERROR:
+		return "ERROR"
+	case WARNING:
+		return "WARNING"
+	case INFO:
+		return "INFO"
+	case DEBUG:
+		return "DEBUG"
+	default:
+		return "NORMAL"
+	}
+}
+
+// The log type given its plain name, as returned by Name
+func ParseLogType(name string) (LogType, error) {
+	for lt := LogType(NORMAL); lt <= DEBUG; lt++ {
+		if strings.EqualFold(lt.Name(), name) {
+			return lt, nil
+		}
+	}
+	return NORMAL, fmt.Errorf("unknown log type %q", name)
+}
+
+func (l Log) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Seq       int64             `json:"seq,omitempty"`
+		Time      time.Time         `json:"time"`
+		Type      string            `json:"type"`
+		Service   string            `json:"service"`
+		Subsystem string            `json:"subsystem,omitempty"`
+		Category  string            `json:"category"`
+		Desc      string            `json:"desc"`
+		Fields    map[string]string `json:"fields,omitempty"`
+	}{l.seq, l.date, l.logType.Name(), l.service, l.subsystem, l.category(), l.desc, l.fields})
+}
+
 func (l Log) String() string {
-	return fmt.Sprintf("%v %v %v: %v", l.service, l.logType, l.date.Format(time.Stamp), l.desc)
+	return fmt.Sprintf("%v %v %v: %v", l.source(), l.logType, l.date.Format(time.Stamp), l.desc)
+}
+
+// The service of the log followed by its subsystem, if any
+func (l Log) source() string {
+	if l.subsystem == "" {
+		return l.service
+	}
+	return l.service + " " + l.subsystem
 }
 
 type Service interface {
@@ -78,11 +137,27 @@ type Service interface {
 
 	// This is used to format the log before showing to the user or insert in db
 	fmtLog(LogType, string) *Log
+
+	// names of the services that must be ready before starting this one
+	dependencies() []string
+
+	// ask the running command to exit cleanly, if it doesn't exit in time it
+	// will be killed
+	shutdown(cmd *exec.Cmd) error
+
+	// install the executable and its configuration, called before every start
+	install(onLog func(*Log)) error
+}
+
+// Services that are ready as soon as their process runs, besides their
+// readiness probes, since nothing in their logs tells it
+type readyOnStartService interface {
+	readyOnStart() bool
 }
 
 // All services running are here
 var (
-	Services map[string]Service
+	Services *Supervisor
 	DB       *sql.DB
 )
 
@@ -97,46 +172,118 @@ var (
 )
 
 func init() {
-	var err error
-
 	ServicesContext, ServicesCancelFunc = context.WithCancel(context.Background())
+}
 
-	home, err := os.UserHomeDir()
-	if err != nil {
-		panic("Panic, can't find UserHomeDir")
-	}
+// Prepare the services of a profile, whose files are kept under root. It must
+// be called once before using the services.
+func Setup(root string, profile string) error {
+	var err error
 
-	ServiceRootDir = filepath.Join(home, "LNBank")
+	Profile = profile
+	PortOffset = ProfilePortOffset(profile)
+	ServiceRootDir = ProfileDir(root, profile)
 
 	err = os.MkdirAll(ServiceRootDir, 0755)
 	if err != nil {
-		panic("Cannot create LNBank root dir")
+		return fmt.Errorf("cannot create LNBank root dir: %w", err)
 	}
 
+	ControlTokenFile = filepath.Join(ServiceRootDir, "control.token")
+	ControlSocketFile = filepath.Join(ServiceRootDir, "control.sock")
+
 	DBFile = filepath.Join(ServiceRootDir, "lnbank.sqlite3")
 	// Check if the log database file exists
 	_, err = os.Stat(DBFile)
 	if err != nil { // if file does not exist
-		DB, err = sql.Open("sqlite3", DBFile)
+		DB, err = sql.Open("sqlite3", DBFile+DbOptions)
 		if err != nil {
-			fmt.Println("Error opening/creating SQLite DB:", err)
-			panic("Panic, can't create LNBank SQLite DB")
-		} else {
-			_, err = DB.ExecContext(ServicesContext, LogTable)
-			if err != nil {
-				fmt.Println("Error creating table:", err)
-				panic("Panic, can't create table")
-			}
+			return fmt.Errorf("cannot create LNBank SQLite DB: %w", err)
+		}
+		_, err = DB.ExecContext(ServicesContext, LogTable)
+		if err != nil {
+			return fmt.Errorf("cannot create log table: %w", err)
 		}
 	} else { // if it does exist, just open the db
-		DB, err = sql.Open("sqlite3", DBFile)
+		DB, err = sql.Open("sqlite3", DBFile+DbOptions)
+		if err != nil {
+			return fmt.Errorf("log DB is corrupted: %w", err)
+		}
+		version, err := MigrateLogs(ServicesContext, DB)
 		if err != nil {
-			panic("Log DB is corrupted")
+			return err
+		}
+		if version < LogSchemaVersion {
+			fmt.Printf("Migrated the log table from version %v to %v\n", version, LogSchemaVersion)
+		}
+	}
+
+	searchErr := CreateLogSearch(ServicesContext, DB)
+	ftsLogs = searchErr == nil
+
+	ActiveNetwork, err = ReadNetwork()
+	if err != nil {
+		return err
+	}
+
+	Logs = NewLogBus()
+	if err := RegisterLogSinks(Logs); err != nil {
+		fmt.Println("Error setting up the logs:", err)
+	}
+	// once per start, where the logs are kept, rather than on every search
+	if searchErr != nil {
+		desc := "cannot set up the log search: " + searchErr.Error()
+		if errors.Is(searchErr, errNoFts) {
+			desc = "logs are searched without the FTS5 index, build LNBank with ./build.sh or -tags sqlite_fts5 to have it"
 		}
+		Logs.publish(&Log{date: time.Now(), logType: WARNING, service: "LNBank", desc: desc})
 	}
 
 	// PREPARE SERVICES
-	Services = make(map[string]Service)
+	Services = NewSupervisor(ServicesContext)
+	Services.setOnLog(Logs.publish)
+	for _, service := range []Service{TorService{}, LndService{}} {
+		Services.register(service)
+		rc, err := ReadRestartConfig(service.name())
+		if err != nil {
+			fmt.Println("Error reading the restart configuration of "+service.name()+":", err)
+		}
+		if err := Services.setRestartConfig(service.name(), rc); err != nil {
+			return err
+		}
+		pc, err := ReadProbeConfig(service.name())
+		if err != nil {
+			fmt.Println("Error reading the probe configuration of "+service.name()+":", err)
+		}
+		if err := Services.setProbeConfig(service.name(), pc); err != nil {
+			return err
+		}
+	}
+	manifests, err := LoadManifests(filepath.Join(ServiceRootDir, ManifestDir))
+	if err != nil {
+		fmt.Println("Error loading service manifests:", err)
+	}
+	for _, m := range manifests {
+		if _, exists := Services.statusOf(m.Name); exists {
+			fmt.Println("Error loading service manifest " + m.file + ": " + m.Name + " already exists")
+			continue
+		}
+		Manifests[m.Name] = m
+		Services.register(ManifestService{manifest: m})
+		if err := Services.setRestartConfig(m.Name, m.restartConfig()); err != nil {
+			return err
+		}
+		pc, err := ReadProbeConfig(m.Name)
+		if err != nil {
+			fmt.Println("Error reading the probe configuration of "+m.Name+":", err)
+		}
+		if err := Services.setProbeConfig(m.Name, pc); err != nil {
+			return err
+		}
+	}
+	PersistTransitions(ServicesContext, Services)
+	RetainLogs(ServicesContext, Services)
+	return nil
 }
 
 func UnzipReader(rd *bytes.Reader, size int64, dest string, onLog func(*Log)) error {
@@ -249,164 +396,35 @@ func (log *Log) Validate() (err []error) {
 	return err
 }
 
-var insertStmt *sql.Stmt
-
-// Log to the database, it returns a list of errors found and if any of them is fatal
+// Log to the database at once, it returns a list of errors found and if any
+// of them is fatal. The logs of the services go through the DbWriter of the
+// bus instead, which is much faster.
 func LogToDb(log *Log) (errs []error, fatal bool) {
 	// Validate the log entry and return any errors found
 	errs = log.Validate()
-
-	// Prepare a statement for inserting the log into the database but only if it doesn't exist
-	if insertStmt == nil {
-		var err error
-		insertStmt, err = DB.PrepareContext(ServicesContext,
-			"INSERT INTO log (timestamp, type_id, desc, service) VALUES (?, ?, ?, ?)",
-		)
-		if err != nil {
-			insertStmt = nil
-			return append(errs, err), true
-		}
-		// TODO defer stmt.Close()
-	}
-
-	_, err := insertStmt.ExecContext(ServicesContext, log.date.Unix(), log.logType, log.desc, log.service)
-	if err != nil {
-		return append(errs, err), true
-	}
-
+	logs := []*Log{log}
 	// Errors in logs are also logged to the db
 	if errs != nil {
-		LogToDb(&Log{
-			date:    time.Now(),
-			service: "LNBank",
-			desc:    fmt.Sprintf("Service %v provided an incorrect log: %v", log.service, errs),
-			logType: WARNING,
-		})
+		logs = append(logs, invalidLog(log, errs))
+	}
+	if err := execLogs(ServicesContext, DB, logs); err != nil {
+		return append(errs, err), true
 	}
-
 	return errs, false
 }
 
-type LogQuery struct {
-	next  func() (Log, error)
-	close func()
-	getn  func(n uint) ([]Log, error)
-}
-
-// Query the logs and returns a closure useful to iterate over the rows.
-// desc is no case and limit is the maximum number of rows allowed.
-func QueryLog(duration time.Duration,
-	logtypes []LogType,
-	services []string,
-	desc string,
-	limit uint,
-) (LogQuery, error) {
-	var conditions strings.Builder
-	conditions.WriteString("SELECT timestamp, type_id, service, desc FROM log WHERE timestamp >= ?")
-
-	if logtypes != nil {
-		conditions.WriteString(" AND (")
-		first := true
-		for range logtypes {
-			if !first {
-				conditions.WriteString(" OR")
-			} else {
-				first = false
-			}
-			conditions.WriteString(" type_id=?")
-		}
-		conditions.WriteString(" )")
-	}
-
-	if services != nil {
-		conditions.WriteString(" AND (")
-		first := true
-		for range services {
-			if !first {
-				conditions.WriteString(" OR")
-			} else {
-				first = false
-			}
-			conditions.WriteString(" service=?")
-		}
-		conditions.WriteString(" )")
-	}
-	if desc != "" {
-		conditions.WriteString(" AND desc LIKE ?")
-	}
-
-	conditions.WriteString(" ORDER BY timestamp DESC")
-
-	if limit != 0 {
-		conditions.WriteString(" LIMIT ?")
-	}
-
-	var params []interface{}
-
-	// timestamp
-	params = append(params, time.Now().Add(-duration).Unix())
-
-	// logtypes
-	for _, logtype := range logtypes {
-		params = append(params, logtype)
-	}
-
-	// services
-	for _, service := range services {
-		params = append(params, service) // services
-	}
-
-	// desc and limit
-	if desc != "" {
-		params = append(params, "%"+desc+"%")
-	}
-	if limit != 0 {
-		params = append(params, limit)
-	}
-
-	result, err := DB.QueryContext(ServicesContext, conditions.String(), params...)
+// Read a log selected as id, timestamp, type_id, service, subsystem, desc,
+// fields followed by the columns of more
+func scanLog(rows *sql.Rows, log *Log, more ...any) error {
+	var unixdate int64
+	var fields string
+	err := rows.Scan(append([]any{&log.seq, &unixdate, &log.logType, &log.service, &log.subsystem, &log.desc, &fields}, more...)...)
 	if err != nil {
-		return LogQuery{}, err
-	}
-	logQuery := LogQuery{
-		next: func() (Log, error) {
-			var log Log
-			if !result.Next() {
-				result.Close()
-				return log, errors.New("end")
-			}
-			var unixdate int64
-			err := result.Scan(&unixdate, &log.logType, &log.service, &log.desc)
-			if err != nil {
-				return Log{}, err
-			}
-
-			log.date = time.Unix(unixdate, 0)
-			return log, nil
-		},
-		close: func() { result.Close() },
-		getn: func(n uint) ([]Log, error) {
-			var logs []Log
-			for result.Next() {
-				var unixdate int64
-				var log Log
-				err := result.Scan(&unixdate, &log.logType, &log.service, &log.desc)
-				if err != nil {
-					_, _ = LogToDb(&Log{
-						date:    time.Now(),
-						service: "LNBank",
-						logType: WARNING,
-						desc:    "unable to scan from the db: " + err.Error(),
-					})
-					return []Log{}, errors.New("unable to scan from the db: " + err.Error())
-				}
-				log.date = time.Unix(unixdate, 0)
-				logs = append(logs, log)
-			}
-			return logs, nil
-		},
+		return err
 	}
-	return logQuery, nil
+	log.date = time.Unix(0, unixdate)
+	log.fields, err = parseFields(fields)
+	return err
 }
 
 // Given a prepared command, execute it and scan its output calling onLog and onReady
@@ -416,6 +434,15 @@ func ScanCommand(ctx context.Context, service Service, cmd *exec.Cmd) *Log {
 	onLog := service.onLogHook()
 	onReady := service.onReadyHook()
 	name := service.name()
+	// the executable, before being wrapped by the isolation
+	exe := cmd.Path
+	iso, err := ReadIsolation(name)
+	if err != nil {
+		onLog(service.fmtLog(WARNING, "cannot read the isolation settings of "+name+": "+err.Error()))
+	}
+	if err := Isolate(cmd, name, iso); err != nil {
+		onLog(service.fmtLog(WARNING, "cannot isolate "+name+": "+err.Error()))
+	}
 	stdout, err := cmd.StdoutPipe()
 	if err != nil {
 		go onLog(service.fmtLog(FATAL, "error preparing "+name+" execution: "+err.Error()))
@@ -425,76 +452,138 @@ func ScanCommand(ctx context.Context, service Service, cmd *exec.Cmd) *Log {
 		go onLog(service.fmtLog(FATAL, "error preparing "+name+" execution: "+err.Error()))
 	}
 
+	// closed once the process has exited
+	exited := make(chan struct{})
+	defer close(exited)
+
 	scanner := bufio.NewScanner(stdout)
 	err = cmd.Start()
 	if err != nil {
 		go onLog(service.fmtLog(FATAL, "error executing "+name+": "+err.Error()))
+	} else {
+		if rs, ok := service.(readyOnStartService); ok && rs.readyOnStart() {
+			go onReady()
+		}
+		go MonitorProcess(ctx, service, cmd.Process.Pid, exited)
+		if err := WritePidFile(name, cmd.Process.Pid, exe); err != nil {
+			onLog(service.fmtLog(WARNING, "cannot write the pid file of "+name+": "+err.Error()))
+		}
+		defer RemovePidFile(name)
 	}
 
-	scanComming := make(chan bool, 1000)
+	// the lines are sent, as the scanner overwrites them on the next Scan
+	scanComming := make(chan string, 1000)
 	go func() {
 		for scanner.Scan() {
-			scanComming <- true
+			scanComming <- scanner.Text()
 		}
-		scanComming <- false
-		// close(scanComming)
+		close(scanComming)
 	}()
 	log := service.fmtLog(INFO, "exit")
 
 	scannerErr := bufio.NewScanner(stderr)
-	fatalComming := make(chan bool, 1000)
+	errComming := make(chan string, 1000)
 	go func() {
 		for scannerErr.Scan() {
-			fatalComming <- true
+			errComming <- scannerErr.Text()
 		}
-		fatalComming <- false
-		// close(scanComming)
+		close(errComming)
 	}()
 
-scanLoop:
-	for {
+	// both outputs are parsed, their lines grouped into entries
+	entries := make(chan lineGroup, 100)
+	go groupLines(scanComming, service.parseLogEntry, entries)
+	errEntries := make(chan lineGroup, 100)
+	go groupLines(errComming, service.parseLogEntry, errEntries)
+
+	// only stop it once
+	done := ctx.Done()
+
+	for entries != nil || errEntries != nil {
 		select {
-		case <-ctx.Done():
-			// send the kill signal and lets hope the scanner will end with some useful logs
-			if err := cmd.Process.Kill(); err != nil {
-				log = service.fmtLog(FATAL, "cannot kill "+name+" process: "+err.Error())
-				onLog(log)
-			}
-		case goon := <-scanComming:
+		case <-done:
+			done = nil
+			// lets hope the scanner will end with some useful logs
+			go StopCommand(service, cmd, exited)
+		case entry, goon := <-entries:
 			if !goon {
-				defer close(scanComming)
-				break scanLoop
+				entries = nil
+				continue
 			}
-			text := scanner.Text()
-			l, err := service.parseLogEntry(text)
-			if err != nil {
-				onLog(service.fmtLog(WARNING, fmt.Sprintf("non-conventional "+name+" log format %v: %s", err, text)))
-			} else {
-				onLog(&l)
-				if service.isReady(l.desc, onLog) {
-					onReady()
-				}
+			l, parsed := entryLog(service, entry, false)
+			onLog(l)
+			if parsed && entryReady(service, l, onLog) {
+				onReady()
 			}
-		case fatal := <-fatalComming:
-			if !fatal {
-				defer close(fatalComming)
-				break scanLoop
+		case entry, goon := <-errEntries:
+			if !goon {
+				errEntries = nil
+				continue
+			}
+			l, parsed := entryLog(service, entry, true)
+			onLog(l)
+			if parsed && entryReady(service, l, onLog) {
+				onReady()
 			}
-			onLog(service.fmtLog(FATAL, scannerErr.Text()))
 		}
 	}
 	if scanerr := scanner.Err(); scanerr != nil {
 		log = service.fmtLog(FATAL, "error receiving stdout from "+name+": %v"+scanerr.Error())
 	}
 	if err := cmd.Wait(); err != nil {
-		if err.Error() != "signal: killed" {
+		if ctx.Err() == nil {
 			log = service.fmtLog(FATAL, err.Error())
+		} else {
+			// we asked it to exit, so this is expected
+			log = service.fmtLog(WARNING, name+" exited while stopping: "+err.Error())
 		}
 	}
 	onLog(log)
 	return log
 }
 
+const DefaultStopTimeout = time.Second * 30
+
+// Ask the command to exit cleanly through the service and, if it refuses,
+// with SIGTERM. If it is still running after the stop_timeout of the service
+// it is killed.
+func StopCommand(service Service, cmd *exec.Cmd, exited <-chan struct{}) {
+	onLog := service.onLogHook()
+	name := service.name()
+	if cmd.Process == nil {
+		return
+	}
+	timeout, err := ReadDurationConfig("stop_timeout", name, DefaultStopTimeout)
+	if err != nil {
+		onLog(service.fmtLog(WARNING, "cannot read stop_timeout of "+name+": "+err.Error()))
+	}
+
+	if err := service.shutdown(cmd); err != nil {
+		onLog(service.fmtLog(WARNING, "cannot stop "+name+" cleanly, terminating it: "+err.Error()))
+		switch err := cmd.Process.Signal(syscall.SIGTERM); {
+		case err == nil:
+		case errors.Is(err, os.ErrProcessDone):
+			return
+		case runtime.GOOS == "windows":
+			// there is no SIGTERM there
+			timeout = 0
+		default:
+			// it may still exit on its own, as an adopted process may not be
+			// ours to signal
+			onLog(service.fmtLog(WARNING, "cannot terminate "+name+": "+err.Error()))
+		}
+	}
+
+	select {
+	case <-exited:
+	case <-time.After(timeout):
+		onLog(service.fmtLog(WARNING, fmt.Sprintf("%v is still running after %v, killing it", name, timeout)))
+		if err := cmd.Process.Kill(); err != nil && !errors.Is(err, os.ErrProcessDone) {
+			onLog(service.fmtLog(FATAL, "cannot kill "+name+" process: "+err.Error()))
+		}
+	}
+}
+
 // Install an embeded executable, using exePath to determine if it is already
 // installed and log out the result to onLog
 func InstallExe(embededZip []byte, exePath string, onLog func(*Log)) error {
@@ -509,15 +598,23 @@ func InstallExe(embededZip []byte, exePath string, onLog func(*Log)) error {
 	return nil
 }
 
+// The log table as of LogSchemaVersion
 const LogTable = `
+PRAGMA auto_vacuum = INCREMENTAL;
+PRAGMA user_version = 2;
 CREATE TABLE IF NOT EXISTS log (
-    timestamp INTEGER NOT NULL ,
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    timestamp INTEGER NOT NULL, -- unix nanoseconds
     type_id TINYINT NOT NULL,
     service VARCHAR(8) NOT NULL COLLATE NOCASE,
-    desc TEXT NOT NULL COLLATE NOCASE
+    desc TEXT NOT NULL COLLATE NOCASE,
+    subsystem TEXT NOT NULL DEFAULT '' COLLATE NOCASE,
+    category TEXT NOT NULL DEFAULT '' COLLATE NOCASE,
+    fields TEXT NOT NULL DEFAULT '' -- JSON object
 );
 create index log_idx on log (timestamp, type_id, service COLLATE NOCASE);
+CREATE INDEX log_category_idx ON log (category COLLATE NOCASE, timestamp);
 
-INSERT INTO log (timestamp, type_id, desc, service)
-  VALUES (strftime('%s'), 0, 'Creation of LNBank', 'LNBank');
+INSERT INTO log (timestamp, type_id, desc, service, category)
+  VALUES (strftime('%s') * 1000000000, 0, 'Creation of LNBank', 'LNBank', 'lnbank');
 `
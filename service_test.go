@@ -1,16 +1,48 @@
 package main
 
 import (
+	"context"
+	"database/sql"
 	"errors"
 	"fmt"
 	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
 )
 
+// The tests use the default profile, as LNBank does without flags, under a
+// root of their own so the db and config of the user are left alone
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "lnbank-test")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	os.Setenv("LNBANK_ROOT", dir)
+	root, err := RootDir("")
+	if err == nil {
+		err = Setup(root, DefaultProfile)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.RemoveAll(dir)
+		os.Exit(1)
+	}
+	code := m.Run()
+	if DB != nil {
+		DB.Close()
+	}
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
 func CompareErrorSlices(expected []error, actual []error) bool {
 	if len(expected) != len(actual) {
 		return false
@@ -159,7 +191,7 @@ func TestLogToDb(t *testing.T) {
 	var type_id LogType
 	err = db.QueryRow(
 		"SELECT type_id FROM log WHERE desc=? AND service=? AND timestamp=?",
-		log.desc, log.service, now.Unix(),
+		log.desc, log.service, now.UnixNano(),
 	).Scan(&type_id)
 	if err != nil {
 		t.Fatal(err)
@@ -169,8 +201,8 @@ func TestLogToDb(t *testing.T) {
 	// Logs with errors are also logged to the db
 	var desc string
 	err = db.QueryRow(
-		"SELECT desc FROM log WHERE timestamp=? AND desc LIKE '%incorrect log type%' ORDER BY timestamp DESC",
-		time.Now().Unix(),
+		"SELECT desc FROM log WHERE timestamp>=? AND desc LIKE '%incorrect log type%' ORDER BY timestamp DESC, id DESC",
+		now.UnixNano(),
 	).Scan(&desc)
 	if err != nil {
 		t.Fatal(err)
@@ -179,6 +211,24 @@ func TestLogToDb(t *testing.T) {
 }
 
 func TestQueryLog(t *testing.T) {
+	// so many logs go to a db of their own, not the one of the other tests
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "query.sqlite3")+DbOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(LogTable); err != nil {
+		t.Fatal(err)
+	}
+	// searched as the shared one is
+	if err := CreateLogSearch(ServicesContext, db); err != nil && !errors.Is(err, errNoFts) {
+		t.Fatal(err)
+	}
+	shared := DB
+	DB = db
+	t.Cleanup(func() {
+		DB = shared
+		db.Close()
+	})
 	servs := []string{"service1", "service2", "service3"}
 	for i := range 10000 {
 		errs, fatal := LogToDb(&Log{
@@ -194,7 +244,7 @@ func TestQueryLog(t *testing.T) {
 
 	// check that we can get the first log
 
-	query, err := QueryLog(time.Hour*10000, nil, nil, "", 0)
+	query, err := QueryLog(time.Hour*10000, nil, nil, nil, "", 0)
 	if err != nil {
 		t.Fatal(err)
 	} else {
@@ -206,7 +256,7 @@ func TestQueryLog(t *testing.T) {
 		query.close()
 	}
 	// check for logtypes
-	query, err = QueryLog(time.Hour*10000, []LogType{WARNING}, nil, "", 0)
+	query, err = QueryLog(time.Hour*10000, []LogType{WARNING}, nil, nil, "", 0)
 	if err != nil {
 		t.Fatal(err)
 	} else {
@@ -218,7 +268,7 @@ func TestQueryLog(t *testing.T) {
 		query.close()
 	}
 	// check for services
-	query, err = QueryLog(time.Hour*10000, []LogType{ERROR}, []string{servs[0], servs[1]}, "", 0)
+	query, err = QueryLog(time.Hour*10000, []LogType{ERROR}, []string{servs[0], servs[1]}, nil, "", 0)
 	if err != nil {
 		t.Fatal(err)
 	} else {
@@ -230,7 +280,7 @@ func TestQueryLog(t *testing.T) {
 		query.close()
 	}
 	// check for description
-	query, err = QueryLog(time.Hour*10000, nil, nil, "description % 4", 0)
+	query, err = QueryLog(time.Hour*10000, nil, nil, nil, "description % 4", 0)
 	if err != nil {
 		t.Fatal(err)
 	} else {
@@ -242,7 +292,7 @@ func TestQueryLog(t *testing.T) {
 		query.close()
 	}
 	// check getting 1000
-	query, err = QueryLog(time.Hour*1000, nil, nil, "", 1000)
+	query, err = QueryLog(time.Hour*1000, nil, nil, nil, "", 1000)
 	if err != nil {
 		t.Fatal(err)
 	} else {
@@ -252,3 +302,92 @@ func TestQueryLog(t *testing.T) {
 		query.close()
 	}
 }
+
+// A service whose command is stopped with SIGTERM, recording its logs
+type scanService struct {
+	fakeService
+	logs chan *Log
+}
+
+func (ss scanService) onLogHook() func(*Log) {
+	return func(l *Log) { ss.logs <- l }
+}
+func (ss scanService) shutdown(*exec.Cmd) error {
+	return errors.New("no clean way")
+}
+
+func TestScanCommandStop(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("needs sh")
+	}
+	service := scanService{fakeService{n: "test_scan"}, make(chan *Log, 100)}
+	assert.NoError(t, SetConfig("stop_timeout", "test_scan", "300ms"))
+
+	// exits on SIGTERM
+	ctx, cancel := context.WithCancel(context.Background())
+	cmd := exec.Command("sh", "-c", `trap 'echo bye; exit 0' TERM; echo hello; while true; do sleep 0.05; done`)
+	time.AfterFunc(time.Millisecond*200, cancel)
+	start := time.Now()
+	log := ScanCommand(ctx, service, cmd)
+	assert.Less(t, time.Since(start), time.Second)
+	assert.Equal(t, LogType(INFO), log.logType, log.desc)
+
+	// ignores SIGTERM, so it is killed after stop_timeout
+	ctx, cancel = context.WithCancel(context.Background())
+	cmd = exec.Command("sh", "-c", `trap '' TERM; while true; do sleep 0.05; done`)
+	time.AfterFunc(time.Millisecond*200, cancel)
+	start = time.Now()
+	log = ScanCommand(ctx, service, cmd)
+	assert.GreaterOrEqual(t, time.Since(start), time.Millisecond*500)
+	assert.Equal(t, LogType(WARNING), log.logType, log.desc)
+	close(service.logs)
+	var killed bool
+	for l := range service.logs {
+		killed = killed || strings.Contains(l.desc, "killing it")
+	}
+	assert.True(t, killed, "it was never killed")
+}
+
+func TestStopCommandDone(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("needs sh")
+	}
+	service := scanService{fakeService{n: "test_stop_done"}, make(chan *Log, 100)}
+	assert.NoError(t, SetConfig("stop_timeout", "test_stop_done", "5s"))
+	cmd := exec.Command("sh", "-c", "true")
+	assert.NoError(t, cmd.Run())
+	// nothing to wait for nor to kill
+	start := time.Now()
+	StopCommand(service, cmd, make(chan struct{}))
+	assert.Less(t, time.Since(start), time.Second)
+	close(service.logs)
+	for l := range service.logs {
+		assert.NotContains(t, l.desc, "killing it")
+	}
+}
+
+// A service ready as soon as its process runs
+type startService struct {
+	scanService
+	ready *atomic.Int32
+}
+
+func (ss startService) onReadyHook() func() { return func() { ss.ready.Add(1) } }
+func (ss startService) readyOnStart() bool  { return true }
+
+func TestScanCommandReadyOnStart(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("needs sh")
+	}
+	service := startService{scanService{fakeService{n: "test_start"}, make(chan *Log, 100)}, &atomic.Int32{}}
+	ScanCommand(context.Background(), service, exec.Command("sh", "-c", "true"))
+	assert.Eventually(t, func() bool { return service.ready.Load() == 1 }, time.Second*5, time.Millisecond*10)
+
+	// never ready if it never ran
+	service.ready.Store(0)
+	cmd := exec.Command("sh", "-c", "true")
+	cmd.Dir = filepath.Join(t.TempDir(), "missing")
+	ScanCommand(context.Background(), service, cmd)
+	time.Sleep(time.Millisecond * 50)
+	assert.Zero(t, service.ready.Load())
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/layout"
+	"fyne.io/fyne/v2/theme"
+	"fyne.io/fyne/v2/widget"
+)
+
+// Cards of the services that need their own widgets, by service name. The
+// rest of the services get the generic card from service_widgets.
+var ServiceWidgets = make(map[string]func() fyne.CanvasObject)
+
+// Generic card showing the state of a supervised service and the buttons to
+// start and stop it
+func service_widgets(name string) fyne.CanvasObject {
+	card := widget.NewCard(STOPPED.String()+" "+name, "", nil)
+
+	settings := widget.NewButtonWithIcon("config", theme.SettingsIcon(), func() {
+		fmt.Println("Settings " + name)
+	})
+	start := func() {
+		if err := Services.start(name); err != nil {
+			Services.log(&Log{
+				date:    time.Now(),
+				service: "LNBank",
+				logType: ERROR,
+				desc:    "cannot start " + name + ": " + err.Error(),
+			})
+		}
+	}
+	stop := func() {
+		_ = Services.stop(name)
+	}
+
+	show := func(st ServiceStatus) {
+		mw_mutex.Lock()
+		defer mw_mutex.Unlock()
+		card.SetTitle(st.state.String() + " " + name)
+		switch st.state {
+		case INSTALLING, STARTING:
+			card.SetSubTitle(st.state.Name() + "...")
+			card.SetContent(container.New(layout.NewGridLayoutWithColumns(1),
+				widget.NewButtonWithIcon("cancel", theme.CancelIcon(), stop),
+			))
+		case READY, DEGRADED:
+			if st.state == DEGRADED {
+				card.SetSubTitle("degraded: " + st.reason)
+			}
+			buttons := container.New(layout.NewGridLayoutWithColumns(2),
+				widget.NewButtonWithIcon("stop", theme.MediaStopIcon(), stop),
+				settings)
+			if ports := PortsString(name); ports != "" {
+				card.SetContent(container.NewVBox(widget.NewLabel(ports), buttons))
+			} else {
+				card.SetContent(buttons)
+			}
+		case STOPPING:
+			card.SetSubTitle("stopping...")
+			card.SetContent(container.New(layout.NewGridLayoutWithColumns(1), settings))
+		case CRASHED:
+			if st.restarts > 0 {
+				card.SetSubTitle(fmt.Sprintf("crashed, restarting (%v)...", st.restarts))
+			} else {
+				card.SetSubTitle("crashed: " + st.reason)
+			}
+			card.SetContent(container.New(layout.NewGridLayoutWithColumns(2),
+				widget.NewButtonWithIcon("start", theme.MediaPlayIcon(), start), settings))
+		case CRASHLOOP:
+			card.SetSubTitle("crashed too many times, check the logs")
+			card.SetContent(container.New(layout.NewGridLayoutWithColumns(2),
+				widget.NewButtonWithIcon("start", theme.MediaPlayIcon(), start), settings))
+		default:
+			card.SetSubTitle("stopped")
+			card.SetContent(container.New(layout.NewGridLayoutWithColumns(2),
+				widget.NewButtonWithIcon("start", theme.MediaPlayIcon(), start), settings))
+		}
+	}
+	Services.subscribe(func(t Transition) {
+		if t.name == name {
+			show(t.ServiceStatus)
+		}
+	})
+	if st, ok := Services.statusOf(name); ok {
+		show(st)
+	}
+
+	// uptime
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ServicesContext.Done():
+				return
+			case <-ticker.C:
+				st, ok := Services.statusOf(name)
+				if !ok || st.state != READY {
+					continue
+				}
+				subtitle := ServiceVersion(name) + "    🕓 " + time.Since(st.upSince).Round(time.Second).String()
+				if ps, ok := LastSample(name); ok {
+					subtitle += "    " + ps.String()
+				}
+				mw_mutex.Lock()
+				card.SetSubTitle(subtitle)
+				mw_mutex.Unlock()
+			}
+		}
+	}()
+
+	return card
+}
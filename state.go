@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// State of a service as seen by the Supervisor
+type ServiceState int8
+
+const (
+	STOPPED ServiceState = iota
+	// installing the executable and its configuration
+	INSTALLING
+	// waiting for its dependencies and then for the service to be ready
+	STARTING
+	READY
+	// running, but not working as it should
+	DEGRADED
+	// asked to exit, waiting for it
+	STOPPING
+	// exited on its own with an error
+	CRASHED
+	// it crashed too many times, so it won't be restarted automatically
+	CRASHLOOP
+)
+
+func (st ServiceState) String() string {
+	switch st {
+	case INSTALLING:
+		return "📦"
+	case STARTING:
+		return "⏳"
+	case READY:
+		return "✅"
+	case DEGRADED:
+		return "⚠️"
+	case STOPPING:
+		return "⏹"
+	case CRASHED:
+		return "❌"
+	case CRASHLOOP:
+		return "💥"
+	default:
+		return "🔴"
+	}
+}
+
+// Plain name of the state
+func (st ServiceState) Name() string {
+	switch st {
+	case INSTALLING:
+		return "installing"
+	case STARTING:
+		return "starting"
+	case READY:
+		return "ready"
+	case DEGRADED:
+		return "degraded"
+	case STOPPING:
+		return "stopping"
+	case CRASHED:
+		return "crashed"
+	case CRASHLOOP:
+		return "crashloop"
+	default:
+		return "stopped"
+	}
+}
+
+// true while the service has a process or is about to have one
+func (st ServiceState) running() bool {
+	switch st {
+	case INSTALLING, STARTING, READY, DEGRADED, STOPPING:
+		return true
+	}
+	return false
+}
+
+// The only changes of state allowed
+var stateTransitions = map[ServiceState][]ServiceState{
+	// a service restarted always can loop on clean exits too
+	STOPPED:    {INSTALLING, CRASHLOOP},
+	INSTALLING: {STARTING, STOPPING, STOPPED, CRASHED},
+	STARTING:   {READY, STOPPING, STOPPED, CRASHED},
+	READY:      {DEGRADED, STOPPING, STOPPED, CRASHED},
+	DEGRADED:   {READY, STOPPING, STOPPED, CRASHED},
+	STOPPING:   {STOPPED, CRASHED},
+	CRASHED:    {INSTALLING, CRASHLOOP, STOPPED},
+	CRASHLOOP:  {INSTALLING, STOPPED},
+}
+
+func (st ServiceState) canTransition(to ServiceState) bool {
+	return slices.Contains(stateTransitions[st], to)
+}
+
+// A change of state of a service. The embedded status is the one right after
+// the change, so its since is the time of the transition.
+type Transition struct {
+	from ServiceState
+	ServiceStatus
+}
+
+const TransitionTable = `
+CREATE TABLE IF NOT EXISTS transition (
+    timestamp INTEGER NOT NULL, -- unix nanoseconds
+    service VARCHAR(8) NOT NULL COLLATE NOCASE,
+    from_state TINYINT NOT NULL,
+    to_state TINYINT NOT NULL,
+    reason TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS transition_idx ON transition (service COLLATE NOCASE, timestamp);
+`
+
+var transitionTable sync.Once
+
+func createTransitionTable() error {
+	var err error
+	transitionTable.Do(func() {
+		_, err = DB.ExecContext(ServicesContext, TransitionTable)
+	})
+	return err
+}
+
+func TransitionToDb(t Transition) error {
+	if err := createTransitionTable(); err != nil {
+		return err
+	}
+	_, err := DB.ExecContext(ServicesContext,
+		"INSERT INTO transition (timestamp, service, from_state, to_state, reason) VALUES (?, ?, ?, ?, ?)",
+		t.since.UnixNano(), t.name, t.from, t.state, t.reason)
+	return err
+}
+
+// Store every transition of the services of sup in the db until ctx is done.
+// A slow db must not hold back the services, so when it falls behind they are
+// dropped and counted rather than waited for.
+func PersistTransitions(ctx context.Context, sup *Supervisor) {
+	transitions := make(chan Transition, 100)
+	var dropped atomic.Int64
+	sup.subscribe(func(t Transition) {
+		select {
+		case transitions <- t:
+		default:
+			dropped.Add(1)
+		}
+	})
+	warn := func(desc string) {
+		sup.log(&Log{date: time.Now(), logType: WARNING, service: "LNBank", desc: desc})
+	}
+	go func() {
+		for {
+			select {
+			case t := <-transitions:
+				if err := TransitionToDb(t); err != nil {
+					warn("cannot store the state of " + t.name + ": " + err.Error())
+				}
+				if n := dropped.Swap(0); n > 0 {
+					warn(fmt.Sprintf("%v changes of state of the services were not stored, the db is too slow", n))
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// Transitions of a service between from and to, oldest first
+func QueryTransitions(service string, from time.Time, to time.Time) ([]Transition, error) {
+	if err := createTransitionTable(); err != nil {
+		return nil, err
+	}
+	rows, err := DB.QueryContext(ServicesContext,
+		"SELECT timestamp, service, from_state, to_state, reason FROM transition WHERE service=? AND timestamp >= ? AND timestamp < ? ORDER BY timestamp",
+		service, from.UnixNano(), to.UnixNano())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var transitions []Transition
+	for rows.Next() {
+		var t Transition
+		var nanos int64
+		if err := rows.Scan(&nanos, &t.name, &t.from, &t.state, &t.reason); err != nil {
+			return nil, err
+		}
+		t.since = time.Unix(0, nanos)
+		transitions = append(transitions, t)
+	}
+	return transitions, rows.Err()
+}
+
+// How long a service was in each state during a period
+type Availability struct {
+	from    time.Time
+	to      time.Time
+	states  map[ServiceState]time.Duration
+	crashes int
+}
+
+// Fraction of the period the service was ready
+func (a Availability) ratio() float64 {
+	total := a.to.Sub(a.from)
+	if total <= 0 {
+		return 0
+	}
+	return float64(a.states[READY]) / float64(total)
+}
+
+// Compute the availability of a service between from and to from its
+// transitions. Before its first transition a service is STOPPED.
+func QueryAvailability(service string, from time.Time, to time.Time) (Availability, error) {
+	a := Availability{from: from, to: to, states: make(map[ServiceState]time.Duration)}
+	if err := createTransitionTable(); err != nil {
+		return a, err
+	}
+	state := STOPPED
+	var nanos int64
+	err := DB.QueryRowContext(ServicesContext,
+		"SELECT to_state, timestamp FROM transition WHERE service=? AND timestamp < ? ORDER BY timestamp DESC LIMIT 1",
+		service, from.UnixNano()).Scan(&state, &nanos)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return a, err
+	}
+
+	transitions, err := QueryTransitions(service, from, to)
+	if err != nil {
+		return a, err
+	}
+	last := from
+	for _, t := range transitions {
+		a.states[state] += t.since.Sub(last)
+		if t.state == CRASHED {
+			a.crashes++
+		}
+		state, last = t.state, t.since
+	}
+	a.states[state] += to.Sub(last)
+	return a, nil
+}
+
+func (a Availability) String() string {
+	return fmt.Sprintf("%.2f%% available, %v crashes", a.ratio()*100, a.crashes)
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCanTransition(t *testing.T) {
+	assert.True(t, STOPPED.canTransition(INSTALLING))
+	assert.True(t, READY.canTransition(DEGRADED))
+	assert.True(t, CRASHED.canTransition(INSTALLING))
+	assert.True(t, STOPPED.canTransition(CRASHLOOP))
+	assert.False(t, STOPPED.canTransition(READY))
+	assert.False(t, STOPPING.canTransition(READY))
+	assert.False(t, CRASHLOOP.canTransition(READY))
+}
+
+// A service that cannot be installed
+type uninstallableService struct {
+	fakeService
+}
+
+func (us uninstallableService) install(func(*Log)) error {
+	return errors.New("no space left on device")
+}
+
+func TestSupervisorTransitions(t *testing.T) {
+	s := newTestSupervisor(t, fakeService{"tor", nil}, uninstallableService{fakeService{"lnd", []string{"tor"}}})
+	assert.NoError(t, s.setRestartConfig("lnd", RestartConfig{policy: RESTART_NEVER}))
+	var mutex sync.Mutex
+	states := make(map[string][]string)
+	s.subscribe(func(t Transition) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		states[t.name] = append(states[t.name], t.from.Name()+">"+t.state.Name())
+	})
+
+	assert.NoError(t, s.start("tor"))
+	assertState(t, s, "tor", READY)
+	assert.NoError(t, s.setDegraded("tor", true, "no circuits"))
+	st, _ := s.statusOf("tor")
+	assert.Equal(t, DEGRADED, st.state)
+	assert.Equal(t, "no circuits", st.reason)
+	assert.NoError(t, s.setDegraded("tor", false, "circuits built"))
+
+	assert.NoError(t, s.start("lnd"))
+	assertState(t, s, "lnd", CRASHED)
+	st, _ = s.statusOf("lnd")
+	assert.Contains(t, st.reason, "no space left on device")
+
+	assert.NoError(t, s.stop("tor"))
+	assertState(t, s, "tor", STOPPED)
+	assertState(t, s, "lnd", STOPPED)
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	assert.Equal(t, []string{
+		"stopped>installing", "installing>starting", "starting>ready",
+		"ready>degraded", "degraded>ready",
+		"ready>stopping", "stopping>stopped",
+	}, states["tor"])
+	assert.Equal(t, []string{"stopped>installing", "installing>crashed", "crashed>stopped"}, states["lnd"])
+}
+
+func TestAvailability(t *testing.T) {
+	service := fmt.Sprintf("test%v", time.Now().UnixNano()%100000)
+	from := time.Now().Add(-time.Hour)
+	at := func(minutes int) time.Time { return from.Add(time.Duration(minutes) * time.Minute) }
+	for _, tr := range []Transition{
+		{STOPPED, ServiceStatus{name: service, state: INSTALLING, since: at(-10), reason: "start requested"}},
+		{INSTALLING, ServiceStatus{name: service, state: STARTING, since: at(-9), reason: "installed"}},
+		{STARTING, ServiceStatus{name: service, state: READY, since: at(-8), reason: "ready"}},
+		{READY, ServiceStatus{name: service, state: CRASHED, since: at(30), reason: "segfault"}},
+		{CRASHED, ServiceStatus{name: service, state: INSTALLING, since: at(45), reason: "automatic restart"}},
+		{INSTALLING, ServiceStatus{name: service, state: READY, since: at(45), reason: "ready"}},
+	} {
+		assert.NoError(t, TransitionToDb(tr))
+	}
+
+	transitions, err := QueryTransitions(service, from, at(60))
+	assert.NoError(t, err)
+	assert.Len(t, transitions, 3)
+	assert.Equal(t, "segfault", transitions[0].reason)
+	assert.Equal(t, READY, transitions[0].from)
+
+	a, err := QueryAvailability(service, from, at(60))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, a.crashes)
+	assert.Equal(t, time.Minute*45, a.states[READY])
+	assert.Equal(t, time.Minute*15, a.states[CRASHED])
+	assert.InDelta(t, 0.75, a.ratio(), 0.0001)
+
+	a, err = QueryAvailability("never started", from, at(60))
+	assert.NoError(t, err)
+	assert.Equal(t, time.Hour, a.states[STOPPED])
+}
@@ -0,0 +1,733 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Snapshot of a supervised service, this is what front ends should show
+type ServiceStatus struct {
+	name         string
+	state        ServiceState
+	since        time.Time
+	reason       string
+	dependencies []string
+	// automatic restarts within the restart window
+	restarts int
+	// when the current run got ready, kept while it is degraded and back
+	upSince time.Time
+}
+
+// How long closing LNBank waits for the services to exit
+const ShutdownTimeout = time.Minute * 2
+
+// One execution of a service, from its installation until onStop is called
+type serviceRun struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	// closed when the service is ready, so dependents can start
+	ready chan struct{}
+	// closed when the service has stopped
+	done chan struct{}
+	// the supervisor asked it to stop, so it must not be restarted
+	requested bool
+	// stopped because a service it depends on stopped
+	cascaded bool
+	// waiting for its readiness probes
+	probing bool
+	// why the supervisor stopped it because it did not answer its probes
+	failed string
+}
+
+type supervised struct {
+	service Service
+	state   ServiceState
+	since   time.Time
+	reason  string
+	upSince time.Time
+	// the service was started and not explicitly stopped since, so it must
+	// come back as soon as its dependencies are ready again
+	wanted bool
+	run    *serviceRun
+
+	restart  RestartConfig
+	restarts []time.Time
+	retry    *time.Timer
+
+	probe ProbeConfig
+}
+
+// The Supervisor owns all the services. It starts them once their
+// dependencies are ready and stops the dependents before the services they
+// depend on, so adding a new service is just a matter of registering it.
+type Supervisor struct {
+	mutex     sync.Mutex
+	ctx       context.Context
+	services  map[string]*supervised
+	onLog     func(*Log)
+	listeners []func(Transition)
+	// logs produced while locked, sent once unlocked
+	pending []*Log
+	// transitions made while locked, sent to the listeners once unlocked by
+	// one goroutine at a time, so they arrive in order
+	transitions []Transition
+	notifying   bool
+}
+
+func NewSupervisor(ctx context.Context) *Supervisor {
+	return &Supervisor{
+		ctx:      ctx,
+		services: make(map[string]*supervised),
+		onLog:    func(*Log) {},
+	}
+}
+
+// Unlock the supervisor and send the logs and transitions produced meanwhile
+func (s *Supervisor) unlock() {
+	pending := s.pending
+	s.pending = nil
+	onLog := s.onLog
+	notify := !s.notifying && len(s.transitions) > 0
+	if notify {
+		s.notifying = true
+	}
+	s.mutex.Unlock()
+	for _, l := range pending {
+		onLog(l)
+	}
+	if notify {
+		s.notify()
+	}
+}
+
+// Send the transitions to the listeners until there are no more, including
+// the ones made meanwhile by other goroutines or by the listeners
+func (s *Supervisor) notify() {
+	for {
+		s.mutex.Lock()
+		transitions, listeners := s.transitions, s.listeners
+		s.transitions = nil
+		if len(transitions) == 0 {
+			s.notifying = false
+			s.mutex.Unlock()
+			return
+		}
+		s.mutex.Unlock()
+		for _, t := range transitions {
+			for _, listener := range listeners {
+				listener(t)
+			}
+		}
+	}
+}
+
+// Add a service to the supervisor. Its dependencies can be registered later,
+// but all of them must exist before starting it.
+func (s *Supervisor) register(service Service) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.services[service.name()] = &supervised{
+		service: service,
+		since:   time.Now(),
+		restart: DefaultRestartConfig,
+		probe:   DefaultProbeConfig,
+	}
+}
+
+// Change how often and how strictly the probes of the service are checked
+func (s *Supervisor) setProbeConfig(name string, pc ProbeConfig) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	sv, ok := s.services[name]
+	if !ok {
+		return fmt.Errorf("unknown service %v", name)
+	}
+	sv.probe = pc
+	return nil
+}
+
+// Change what to do when the service exits on its own
+func (s *Supervisor) setRestartConfig(name string, rc RestartConfig) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	sv, ok := s.services[name]
+	if !ok {
+		return fmt.Errorf("unknown service %v", name)
+	}
+	sv.restart = rc
+	return nil
+}
+
+// Set the function that receives the logs of all the supervised services
+func (s *Supervisor) setOnLog(onLog func(*Log)) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.onLog = onLog
+}
+
+func (s *Supervisor) log(l *Log) {
+	s.mutex.Lock()
+	onLog := s.onLog
+	s.mutex.Unlock()
+	onLog(l)
+}
+
+// Call listener on every transition of any service, in order, once the
+// supervisor is unlocked
+func (s *Supervisor) subscribe(listener func(Transition)) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.listeners = append(s.listeners, listener)
+}
+
+// Return the name of all services, each one after all its dependencies
+func (s *Supervisor) order() ([]string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.sortLocked()
+}
+
+func (s *Supervisor) sortLocked() ([]string, error) {
+	names := make([]string, 0, len(s.services))
+	for name := range s.services {
+		names = append(names, name)
+	}
+	// independent services are always returned in the same order
+	slices.Sort(names)
+
+	sorted := make([]string, 0, len(names))
+	visited := make(map[string]bool)
+	visiting := make(map[string]bool)
+	var visit func(name string, path []string) error
+	visit = func(name string, path []string) error {
+		if visited[name] {
+			return nil
+		}
+		if visiting[name] {
+			return fmt.Errorf("dependency cycle: %v", strings.Join(append(path, name), " → "))
+		}
+		sv, ok := s.services[name]
+		if !ok {
+			return fmt.Errorf("%v depends on %v, which is not registered", path[len(path)-1], name)
+		}
+		visiting[name] = true
+		for _, dep := range sv.service.dependencies() {
+			if err := visit(dep, append(path, name)); err != nil {
+				return err
+			}
+		}
+		visiting[name] = false
+		visited[name] = true
+		sorted = append(sorted, name)
+		return nil
+	}
+	for _, name := range names {
+		if err := visit(name, nil); err != nil {
+			return nil, err
+		}
+	}
+	return sorted, nil
+}
+
+// true if sv needs the service called name, directly or through other services
+func (s *Supervisor) dependsOnLocked(sv *supervised, name string) bool {
+	for _, dep := range sv.service.dependencies() {
+		if dep == name || s.dependsOnLocked(s.services[dep], name) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Supervisor) dependentsLocked(name string) []*supervised {
+	var dependents []*supervised
+	for _, sv := range s.services {
+		if slices.Contains(sv.service.dependencies(), name) {
+			dependents = append(dependents, sv)
+		}
+	}
+	return dependents
+}
+
+func (s *Supervisor) statusLocked(sv *supervised) ServiceStatus {
+	return ServiceStatus{
+		name:         sv.service.name(),
+		state:        sv.state,
+		since:        sv.since,
+		reason:       sv.reason,
+		dependencies: sv.service.dependencies(),
+		restarts:     len(sv.restarts),
+		upSince:      sv.upSince,
+	}
+}
+
+// Move the service to a new state, if the state machine allows it, and tell
+// the listeners about it
+func (s *Supervisor) transitionLocked(sv *supervised, to ServiceState, reason string) bool {
+	from := sv.state
+	if !from.canTransition(to) {
+		s.pending = append(s.pending, sv.service.fmtLog(WARNING, fmt.Sprintf(
+			"%v cannot go from %v to %v: %v", sv.service.name(), from.Name(), to.Name(), reason)))
+		return false
+	}
+	sv.state = to
+	sv.since = time.Now()
+	if from == STARTING && to == READY {
+		sv.upSince = sv.since
+	}
+	sv.reason = reason
+	s.transitions = append(s.transitions, Transition{from: from, ServiceStatus: s.statusLocked(sv)})
+	return true
+}
+
+// The state of all the services, each one after all its dependencies
+func (s *Supervisor) status() []ServiceStatus {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	names, err := s.sortLocked()
+	if err != nil {
+		// a broken graph can still be shown, it just won't start
+		names = names[:0]
+		for name := range s.services {
+			names = append(names, name)
+		}
+		slices.Sort(names)
+	}
+	statuses := make([]ServiceStatus, 0, len(names))
+	for _, name := range names {
+		statuses = append(statuses, s.statusLocked(s.services[name]))
+	}
+	return statuses
+}
+
+func (s *Supervisor) statusOf(name string) (ServiceStatus, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	sv, ok := s.services[name]
+	if !ok {
+		return ServiceStatus{}, false
+	}
+	return s.statusLocked(sv), true
+}
+
+// Start a service and, before it, all of its dependencies
+func (s *Supervisor) start(name string) error {
+	s.mutex.Lock()
+	defer s.unlock()
+	if _, err := s.sortLocked(); err != nil {
+		return err
+	}
+	sv, ok := s.services[name]
+	if !ok {
+		return fmt.Errorf("unknown service %v", name)
+	}
+	// a manual start gives a new chance to crashed services
+	sv.restarts = nil
+	s.startLocked(sv, "start requested")
+	return nil
+}
+
+// Start all the registered services
+func (s *Supervisor) startAll() error {
+	s.mutex.Lock()
+	defer s.unlock()
+	names, err := s.sortLocked()
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		s.startLocked(s.services[name], "start requested")
+	}
+	return nil
+}
+
+func (s *Supervisor) startLocked(sv *supervised, reason string) {
+	sv.wanted = true
+	if sv.state.running() {
+		return
+	}
+	deps := make([]*serviceRun, 0)
+	for _, name := range sv.service.dependencies() {
+		dep := s.services[name]
+		s.startLocked(dep, "needed by "+sv.service.name())
+		deps = append(deps, dep.run)
+	}
+	if sv.retry != nil {
+		sv.retry.Stop()
+	}
+	if !s.transitionLocked(sv, INSTALLING, reason) {
+		return
+	}
+	ctx, cancel := context.WithCancel(s.ctx)
+	run := &serviceRun{
+		ctx:    ctx,
+		cancel: cancel,
+		ready:  make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	sv.run = run
+	go s.execute(sv, run, deps)
+}
+
+// Install the service, wait for its dependencies to be ready and then run it
+func (s *Supervisor) execute(sv *supervised, run *serviceRun, deps []*serviceRun) {
+	name := sv.service.name()
+	if err := sv.service.install(s.log); err != nil {
+		s.stopped(sv, run, sv.service.fmtLog(FATAL, "cannot install "+name+": "+err.Error()))
+		return
+	}
+	if vs, ok := sv.service.(versionedService); ok {
+		CheckVersion(run.ctx, sv.service, vs, s.log)
+	}
+
+	s.mutex.Lock()
+	if sv.run == run && sv.state == INSTALLING {
+		s.transitionLocked(sv, STARTING, "installed")
+	}
+	s.unlock()
+
+	for _, dep := range deps {
+		select {
+		case <-dep.ready:
+		case <-run.ctx.Done():
+			s.stopped(sv, run, sv.service.fmtLog(INFO, "cancelled while waiting for its dependencies"))
+			return
+		}
+	}
+	if run.ctx.Err() != nil {
+		s.stopped(sv, run, sv.service.fmtLog(INFO, "cancelled before starting"))
+		return
+	}
+	sv.service.start(run.ctx,
+		func() { s.ready(sv, run) },
+		func(l *Log) { s.stopped(sv, run, l) },
+		s.log,
+	)
+}
+
+// The service says it is ready. It is once its readiness probes pass.
+func (s *Supervisor) ready(sv *supervised, run *serviceRun) {
+	s.mutex.Lock()
+	defer s.unlock()
+	if sv.run != run || sv.state != STARTING || run.probing {
+		return
+	}
+	if ps, ok := sv.service.(probedService); ok {
+		readiness, _ := ps.probes()
+		if len(readiness) > 0 {
+			run.probing = true
+			go s.awaitReadiness(sv, run, readiness)
+			return
+		}
+	}
+	s.readyLocked(sv, run)
+}
+
+// Retry the readiness probes until they pass or the run is cancelled
+func (s *Supervisor) awaitReadiness(sv *supervised, run *serviceRun, probes []Probe) {
+	s.mutex.Lock()
+	timeout := sv.probe.timeout
+	s.unlock()
+	ticker := time.NewTicker(time.Millisecond * 500)
+	defer ticker.Stop()
+	for {
+		if err := runProbes(run.ctx, probes, timeout); err == nil {
+			s.mutex.Lock()
+			if sv.run == run && sv.state == STARTING {
+				s.readyLocked(sv, run)
+			}
+			s.unlock()
+			return
+		}
+		select {
+		case <-run.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *Supervisor) readyLocked(sv *supervised, run *serviceRun) {
+	close(run.ready)
+	name := sv.service.name()
+	s.transitionLocked(sv, READY, "ready to accept connections")
+	s.pending = append(s.pending, sv.service.fmtLog(INFO, name+" is ready to accept connections"))
+	// bring back the services that were stopped because this one stopped
+	for _, other := range s.services {
+		if other.wanted && !other.state.running() && other.state != CRASHLOOP && s.dependsOnLocked(other, name) {
+			s.startLocked(other, name+" is ready again")
+		}
+	}
+	if ps, ok := sv.service.(probedService); ok {
+		if _, liveness := ps.probes(); len(liveness) > 0 {
+			go s.watch(sv, run, liveness, sv.probe)
+		}
+	}
+	if rv, ok := sv.service.(runningVersionService); ok {
+		go CheckRunningVersion(run.ctx, sv.service, rv, s.log)
+	}
+}
+
+// Check the liveness probes of a ready service until it stops. It is degraded
+// while they fail and, if they keep failing, it is restarted as if it had
+// crashed, since a hung process never exits on its own.
+func (s *Supervisor) watch(sv *supervised, run *serviceRun, probes []Probe, pc ProbeConfig) {
+	ticker := time.NewTicker(pc.interval)
+	defer ticker.Stop()
+	failures := 0
+	for {
+		select {
+		case <-run.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		err := runProbes(run.ctx, probes, pc.timeout)
+		if run.ctx.Err() != nil {
+			return
+		}
+
+		s.mutex.Lock()
+		if sv.run != run {
+			s.unlock()
+			return
+		}
+		if err == nil {
+			failures = 0
+			s.setDegradedLocked(sv, false, "answering its probes again")
+			s.unlock()
+			continue
+		}
+		failures++
+		if pc.restartAfter > 0 && failures >= pc.restartAfter {
+			reason := fmt.Sprintf("not answering after %v checks: %v", failures, err)
+			run.failed = reason
+			run.cancel()
+			s.transitionLocked(sv, STOPPING, reason)
+			s.pending = append(s.pending, sv.service.fmtLog(ERROR, sv.service.name()+" is "+reason+", restarting it"))
+			s.unlock()
+			return
+		}
+		if pc.degradedAfter > 0 && failures >= pc.degradedAfter {
+			s.setDegradedLocked(sv, true, err.Error())
+		}
+		s.unlock()
+	}
+}
+
+// Mark a running service as degraded, or ready again, without restarting it
+func (s *Supervisor) setDegraded(name string, degraded bool, reason string) error {
+	s.mutex.Lock()
+	defer s.unlock()
+	sv, ok := s.services[name]
+	if !ok {
+		return fmt.Errorf("unknown service %v", name)
+	}
+	s.setDegradedLocked(sv, degraded, reason)
+	return nil
+}
+
+func (s *Supervisor) setDegradedLocked(sv *supervised, degraded bool, reason string) {
+	name := sv.service.name()
+	switch {
+	case degraded && sv.state == READY:
+		s.transitionLocked(sv, DEGRADED, reason)
+		s.pending = append(s.pending, sv.service.fmtLog(WARNING, name+" is degraded: "+reason))
+	case !degraded && sv.state == DEGRADED:
+		s.transitionLocked(sv, READY, reason)
+		s.pending = append(s.pending, sv.service.fmtLog(INFO, name+" recovered: "+reason))
+	}
+}
+
+func (s *Supervisor) stopped(sv *supervised, run *serviceRun, l *Log) {
+	s.mutex.Lock()
+	if sv.run != run {
+		s.unlock()
+		return
+	}
+	run.cancel()
+	sv.run = nil
+	name := sv.service.name()
+
+	reason := "exited"
+	if l != nil {
+		reason = l.desc
+	}
+	if run.failed != "" {
+		// restarted by its probes, so it counts as a crash
+		l = sv.service.fmtLog(ERROR, run.failed)
+		reason = run.failed
+	}
+	if run.requested || !(l == nil || l.logType == FATAL || l.logType == ERROR) {
+		s.transitionLocked(sv, STOPPED, reason)
+		s.pending = append(s.pending, sv.service.fmtLog(INFO, name+" is stopped, it won't accept connections"))
+	} else {
+		s.transitionLocked(sv, CRASHED, reason)
+		s.pending = append(s.pending, sv.service.fmtLog(ERROR, name+" crashed: "+reason))
+	}
+	// nothing can keep running without this service
+	s.stopDependentsLocked(sv, name+" stopped")
+	if !run.requested && sv.wanted && s.ctx.Err() == nil {
+		s.scheduleRestartLocked(sv, l)
+	} else if run.cascaded && sv.wanted && s.ctx.Err() == nil && s.dependenciesReadyLocked(sv) {
+		// its dependencies are back already
+		s.startLocked(sv, "dependencies ready again")
+	}
+	s.unlock()
+	close(run.done)
+}
+
+// The service exited on its own, restart it following its restart policy
+func (s *Supervisor) scheduleRestartLocked(sv *supervised, l *Log) {
+	rc := sv.restart
+	if !rc.mustRestart(l) {
+		return
+	}
+	name := sv.service.name()
+	now := time.Now()
+	recent := sv.restarts[:0]
+	for _, restart := range sv.restarts {
+		if now.Sub(restart) < rc.window {
+			recent = append(recent, restart)
+		}
+	}
+	sv.restarts = recent
+	if len(recent) >= rc.maxRetries {
+		reason := fmt.Sprintf("%v is in a crash loop, restarted %v times in %v. It won't be restarted until started manually",
+			name, len(recent), rc.window)
+		if s.transitionLocked(sv, CRASHLOOP, reason) {
+			s.pending = append(s.pending, sv.service.fmtLog(FATAL, reason))
+		}
+		return
+	}
+
+	delay := rc.delay(len(recent))
+	sv.restarts = append(sv.restarts, now)
+	attempt := len(sv.restarts)
+	sv.retry = time.AfterFunc(delay, func() {
+		s.mutex.Lock()
+		defer s.unlock()
+		if !sv.state.running() && sv.state != CRASHLOOP && sv.wanted && s.ctx.Err() == nil {
+			s.startLocked(sv, fmt.Sprintf("automatic restart %v of %v", attempt, rc.maxRetries))
+		}
+	})
+	s.pending = append(s.pending, sv.service.fmtLog(WARNING, fmt.Sprintf("restarting %v in %v (attempt %v of %v)",
+		name, delay, attempt, rc.maxRetries)))
+}
+
+// Stop a service after stopping everything that depends on it
+func (s *Supervisor) stop(name string) error {
+	s.mutex.Lock()
+	defer s.unlock()
+	sv, ok := s.services[name]
+	if !ok {
+		return fmt.Errorf("unknown service %v", name)
+	}
+	sv.wanted = false
+	sv.restarts = nil
+	s.stopLocked(sv, "stop requested")
+	return nil
+}
+
+// Stop all services, each one once all the services depending on it have
+// exited. It returns when all of them exited or ctx is done.
+func (s *Supervisor) stopAll(ctx context.Context) error {
+	s.mutex.Lock()
+	names, err := s.sortLocked()
+	if err != nil {
+		// without order, at least stop everything
+		for _, sv := range s.services {
+			sv.wanted = false
+			s.stopLocked(sv, "LNBank is closing")
+		}
+		s.unlock()
+		return err
+	}
+	s.unlock()
+
+	slices.Reverse(names)
+	for _, name := range names {
+		s.mutex.Lock()
+		sv := s.services[name]
+		sv.wanted = false
+		s.stopLocked(sv, "LNBank is closing")
+		var done chan struct{}
+		if sv.run != nil {
+			done = sv.run.done
+		}
+		s.unlock()
+
+		if done != nil {
+			select {
+			case <-done:
+			case <-ctx.Done():
+				return fmt.Errorf("%v did not exit: %w", name, ctx.Err())
+			}
+		}
+	}
+	return nil
+}
+
+func (s *Supervisor) stopLocked(sv *supervised, reason string) {
+	s.stopDependentsLocked(sv, sv.service.name()+" is stopping")
+	if sv.retry != nil {
+		sv.retry.Stop()
+	}
+	if sv.run != nil {
+		sv.run.requested = true
+		sv.run.cancel()
+		if sv.state != STOPPING {
+			s.transitionLocked(sv, STOPPING, reason)
+		}
+	} else if sv.state == CRASHED || sv.state == CRASHLOOP {
+		// nothing to wait for, but it must not be restarted
+		s.transitionLocked(sv, STOPPED, reason)
+	}
+}
+
+func (s *Supervisor) stopDependentsLocked(sv *supervised, reason string) {
+	for _, dependent := range s.dependentsLocked(sv.service.name()) {
+		if dependent.run != nil {
+			dependent.run.cascaded = true
+		}
+		s.stopLocked(dependent, reason)
+	}
+}
+
+func (s *Supervisor) dependenciesReadyLocked(sv *supervised) bool {
+	for _, dep := range sv.service.dependencies() {
+		if s.services[dep].state != READY && s.services[dep].state != DEGRADED {
+			return false
+		}
+	}
+	return true
+}
+
+// Stop a service and start it again. The services depending on it that were
+// running will be started again once it is ready.
+func (s *Supervisor) restart(name string) error {
+	s.mutex.Lock()
+	sv, ok := s.services[name]
+	if !ok {
+		s.unlock()
+		return fmt.Errorf("unknown service %v", name)
+	}
+	var done chan struct{}
+	if sv.run != nil {
+		done = sv.run.done
+		s.stopLocked(sv, "restart requested")
+	}
+	s.unlock()
+
+	if done != nil {
+		select {
+		case <-done:
+		case <-s.ctx.Done():
+			return s.ctx.Err()
+		}
+	}
+	return s.start(name)
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"context"
+	"os/exec"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// A service that is ready as soon as it starts and runs until cancelled
+type fakeService struct {
+	n    string
+	deps []string
+}
+
+func (fs fakeService) start(ctx context.Context, onReady func(), onStop func(*Log), onLog func(*Log)) {
+	onLog(fs.fmtLog(INFO, "starting"))
+	onReady()
+	<-ctx.Done()
+	onStop(fs.fmtLog(INFO, "exit"))
+}
+func (fs fakeService) onLogHook() func(*Log)                  { return func(*Log) {} }
+func (fs fakeService) onReadyHook() func()                    { return func() {} }
+func (fs fakeService) getConfigFile() (string, error)         { return "", nil }
+func (fs fakeService) name() string                           { return fs.n }
+func (fs fakeService) parseLogEntry(line string) (Log, error) { return *fs.fmtLog(INFO, line), nil }
+func (fs fakeService) isReady(string, func(*Log)) bool        { return false }
+func (fs fakeService) dependencies() []string                 { return fs.deps }
+func (fs fakeService) shutdown(*exec.Cmd) error               { return nil }
+func (fs fakeService) install(func(*Log)) error               { return nil }
+func (fs fakeService) fmtLog(lt LogType, desc string) *Log {
+	return &Log{date: time.Now(), desc: desc, logType: lt, service: fs.n}
+}
+
+func newTestSupervisor(t *testing.T, services ...Service) *Supervisor {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	s := NewSupervisor(ctx)
+	for _, service := range services {
+		s.register(service)
+	}
+	return s
+}
+
+func assertState(t *testing.T, s *Supervisor, name string, state ServiceState) {
+	t.Helper()
+	assert.Eventually(t, func() bool {
+		st, _ := s.statusOf(name)
+		return st.state == state
+	}, time.Second*5, time.Millisecond*10, "%v never got %v", name, state)
+}
+
+func TestSupervisorOrder(t *testing.T) {
+	s := newTestSupervisor(t,
+		fakeService{"lndg", []string{"lnd"}},
+		fakeService{"lnbits", []string{"lnd", "tor"}},
+		fakeService{"lnd", []string{"tor"}},
+		fakeService{"tor", nil},
+	)
+	order, err := s.order()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"tor", "lnd", "lnbits", "lndg"}, order)
+
+	s.register(fakeService{"tor", []string{"lndg"}})
+	_, err = s.order()
+	assert.ErrorContains(t, err, "dependency cycle")
+	assert.Error(t, s.start("lnd"))
+
+	s = newTestSupervisor(t, fakeService{"lnd", []string{"tor"}})
+	_, err = s.order()
+	assert.ErrorContains(t, err, "not registered")
+}
+
+func TestSupervisorStart(t *testing.T) {
+	s := newTestSupervisor(t,
+		fakeService{"lnd", []string{"tor"}},
+		fakeService{"tor", nil},
+	)
+	var ready []string
+	s.subscribe(func(t Transition) {
+		if t.state == READY {
+			ready = append(ready, t.name)
+		}
+	})
+	assert.NoError(t, s.start("lnd"))
+	assertState(t, s, "lnd", READY)
+	assertState(t, s, "tor", READY)
+	assert.Equal(t, []string{"tor", "lnd"}, ready)
+	assert.Error(t, s.start("unknown"))
+}
+
+func TestSupervisorCascade(t *testing.T) {
+	s := newTestSupervisor(t,
+		fakeService{"lndg", []string{"lnd"}},
+		fakeService{"lnd", []string{"tor"}},
+		fakeService{"tor", nil},
+	)
+	assert.NoError(t, s.start("lndg"))
+	assertState(t, s, "lndg", READY)
+
+	// stopping tor stops everything depending on it
+	assert.NoError(t, s.stop("tor"))
+	assertState(t, s, "tor", STOPPED)
+	assertState(t, s, "lnd", STOPPED)
+	assertState(t, s, "lndg", STOPPED)
+
+	// and starting it again brings back what was running
+	assert.NoError(t, s.start("tor"))
+	assertState(t, s, "lnd", READY)
+	assertState(t, s, "lndg", READY)
+
+	// stopped services are not brought back
+	assert.NoError(t, s.stop("lndg"))
+	assertState(t, s, "lndg", STOPPED)
+	assert.NoError(t, s.restart("tor"))
+	assertState(t, s, "tor", READY)
+	assertState(t, s, "lnd", READY)
+	time.Sleep(time.Millisecond * 100)
+	st, _ := s.statusOf("lndg")
+	assert.Equal(t, STOPPED, st.state)
+
+	assert.NoError(t, s.stopAll(context.Background()))
+	for _, st := range s.status() {
+		assert.Equal(t, STOPPED, st.state, st.name)
+	}
+}
+
+func TestSupervisorListeners(t *testing.T) {
+	s := newTestSupervisor(t, fakeService{"tor", nil})
+	var mutex sync.Mutex
+	var states []ServiceState
+	s.subscribe(func(tr Transition) {
+		// the supervisor is unlocked by then
+		st, _ := s.statusOf(tr.name)
+		mutex.Lock()
+		states = append(states, tr.state)
+		mutex.Unlock()
+		assert.Equal(t, "tor", st.name)
+	})
+	assert.NoError(t, s.start("tor"))
+	assertState(t, s, "tor", READY)
+	assert.NoError(t, s.stop("tor"))
+	assertState(t, s, "tor", STOPPED)
+	assert.Eventually(t, func() bool {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return len(states) == 5
+	}, time.Second*5, time.Millisecond*10)
+	mutex.Lock()
+	assert.Equal(t, []ServiceState{INSTALLING, STARTING, READY, STOPPING, STOPPED}, states)
+	mutex.Unlock()
+}
+
+func TestSupervisorUpSince(t *testing.T) {
+	s := newTestSupervisor(t, fakeService{"tor", nil})
+	assert.NoError(t, s.start("tor"))
+	assertState(t, s, "tor", READY)
+	ready, _ := s.statusOf("tor")
+	assert.Equal(t, ready.since, ready.upSince)
+
+	// it is still up while degraded and back
+	time.Sleep(time.Millisecond * 10)
+	assert.NoError(t, s.setDegraded("tor", true, "slow"))
+	assert.NoError(t, s.setDegraded("tor", false, "fast again"))
+	st, _ := s.statusOf("tor")
+	assert.Equal(t, READY, st.state)
+	assert.True(t, st.since.After(ready.since))
+	assert.Equal(t, ready.upSince, st.upSince)
+}
+
+func TestSupervisorStopAllOrder(t *testing.T) {
+	s := newTestSupervisor(t,
+		fakeService{"lndg", []string{"lnd"}},
+		fakeService{"lnd", []string{"tor"}},
+		fakeService{"tor", nil},
+	)
+	var stopped []string
+	s.subscribe(func(t Transition) {
+		if t.state == STOPPED {
+			stopped = append(stopped, t.name)
+		}
+	})
+	assert.NoError(t, s.startAll())
+	assertState(t, s, "lndg", READY)
+	assert.NoError(t, s.stopAll(context.Background()))
+	assert.Equal(t, []string{"lndg", "lnd", "tor"}, stopped)
+}
+
+// A service that crashes right after being ready
+type crashingService struct {
+	fakeService
+	starts *atomic.Int32
+}
+
+func (cs crashingService) start(ctx context.Context, onReady func(), onStop func(*Log), onLog func(*Log)) {
+	cs.starts.Add(1)
+	onReady()
+	onStop(cs.fmtLog(FATAL, "crashed"))
+}
+
+func TestSupervisorRestart(t *testing.T) {
+	tor := crashingService{fakeService{"tor", nil}, &atomic.Int32{}}
+	s := newTestSupervisor(t, tor, fakeService{"lnd", []string{"tor"}})
+	assert.NoError(t, s.setRestartConfig("tor", RestartConfig{
+		policy:     RESTART_ON_FAILURE,
+		backoff:    time.Millisecond,
+		maxBackoff: time.Millisecond * 20,
+		maxRetries: 3,
+		window:     time.Minute,
+	}))
+	var logs []*Log
+	var mutex sync.Mutex
+	s.setOnLog(func(l *Log) {
+		mutex.Lock()
+		logs = append(logs, l)
+		mutex.Unlock()
+	})
+
+	assert.NoError(t, s.start("lnd"))
+	assertState(t, s, "tor", CRASHLOOP)
+	assert.Equal(t, int32(4), tor.starts.Load(), "first start and 3 restarts")
+	assertState(t, s, "lnd", STOPPED)
+
+	mutex.Lock()
+	crashloop := slices.IndexFunc(logs, func(l *Log) bool {
+		return l.logType == FATAL && strings.Contains(l.desc, "crash loop")
+	})
+	assert.NotEqual(t, -1, crashloop, "crash loop was not logged")
+	mutex.Unlock()
+
+	// a manual start gives it a new budget
+	assert.NoError(t, s.start("tor"))
+	assertState(t, s, "tor", CRASHLOOP)
+	assert.Equal(t, int32(8), tor.starts.Load())
+
+	// with restarts disabled a crash is final
+	assert.NoError(t, s.setRestartConfig("tor", RestartConfig{policy: RESTART_NEVER}))
+	assert.NoError(t, s.start("tor"))
+	assertState(t, s, "tor", CRASHED)
+	time.Sleep(time.Millisecond * 50)
+	assert.Equal(t, int32(9), tor.starts.Load())
+}
+
+// A service that exits cleanly right after being ready
+type exitingService struct {
+	fakeService
+	starts *atomic.Int32
+}
+
+func (es exitingService) start(ctx context.Context, onReady func(), onStop func(*Log), onLog func(*Log)) {
+	es.starts.Add(1)
+	onReady()
+	onStop(es.fmtLog(INFO, "exit"))
+}
+
+func TestSupervisorRestartAlways(t *testing.T) {
+	tor := exitingService{fakeService{"tor", nil}, &atomic.Int32{}}
+	s := newTestSupervisor(t, tor)
+	assert.NoError(t, s.setRestartConfig("tor", RestartConfig{
+		policy:     RESTART_ALWAYS,
+		backoff:    time.Millisecond,
+		maxBackoff: time.Millisecond * 20,
+		maxRetries: 3,
+		window:     time.Minute,
+	}))
+	var logs []*Log
+	var mutex sync.Mutex
+	s.setOnLog(func(l *Log) {
+		mutex.Lock()
+		logs = append(logs, l)
+		mutex.Unlock()
+	})
+
+	// clean exits loop as crashes do
+	assert.NoError(t, s.start("tor"))
+	assertState(t, s, "tor", CRASHLOOP)
+	assert.Equal(t, int32(4), tor.starts.Load(), "first start and 3 restarts")
+	mutex.Lock()
+	defer mutex.Unlock()
+	assert.True(t, slices.ContainsFunc(logs, func(l *Log) bool {
+		return l.logType == FATAL && strings.Contains(l.desc, "crash loop")
+	}), "crash loop was not logged")
+	assert.False(t, slices.ContainsFunc(logs, func(l *Log) bool {
+		return strings.Contains(l.desc, "cannot go from")
+	}), "crash loop was rejected")
+}
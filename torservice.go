@@ -1,10 +1,12 @@
 package main
 
 import (
+	"bufio"
 	"context"
 	_ "embed"
 	"errors"
 	"fmt"
+	"net"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -38,6 +40,51 @@ func (l TorService) fmtLog(lt LogType, desc string) *Log {
 	return log
 }
 
+// Install the tor executable and create its default configuration
+func (ts TorService) install(onLog func(*Log)) error {
+	TorExePath = filepath.Join(ServiceRootDir, "embed", "tor", "tor")
+	if err := InstallExe(embededTor, TorExePath, onLog); err != nil && err.Error() != "installed" {
+		return err
+	} else if err != nil {
+		onLog(ts.fmtLog(INFO, "tor executable installed under "+TorExePath))
+	}
+
+	TorConfigPath = filepath.Join(ServiceRootDir, "tor")
+	// make sure the log directory exists
+	if err := os.MkdirAll(TorConfigPath, 0755); err != nil {
+		return fmt.Errorf("cannot create tor directory: %w", err)
+	}
+
+	// TODO check that torrc contains the proper path, in case that the user migrated to another computer
+	TorConfigFile = filepath.Join(TorConfigPath, "torrc")
+	if _, err := os.Stat(TorConfigFile); os.IsNotExist(err) {
+		config := fmt.Sprintf("DataDirectory %s/data\n%s", TorConfigPath, defaultTorConfig)
+		if err := os.WriteFile(TorConfigFile, []byte(config), 0644); err != nil {
+			return fmt.Errorf("cannot create tor configuration file: %w", err)
+		}
+	}
+	return nil
+}
+
+// Check the ports of tor and write them into torrc
+func (ts TorService) configurePorts(onLog func(*Log)) error {
+	if err := PreflightPorts(ts.name(), onLog); err != nil {
+		return err
+	}
+	return RenderConfigFile(TorConfigFile, " ", [][2]string{
+		{"SocksPort", AddressOf("Tor", "socks_port")},
+		{"ControlPort", AddressOf("Tor", "control_port")},
+	})
+}
+
+func (ts TorService) binary() (string, []byte) {
+	return TorExePath, embededTor
+}
+
+func (ts TorService) binaryVersion(ctx context.Context) (string, error) {
+	return commandVersion(ctx, TorExePath, "--version")
+}
+
 // Implement the Service interface
 func (ts TorService) start(ctx context.Context, onReady func(), onStop func(*Log), onLog func(*Log)) {
 	if onReady == nil || onStop == nil || onLog == nil {
@@ -48,40 +95,20 @@ func (ts TorService) start(ctx context.Context, onReady func(), onStop func(*Log
 	ts.onLog = onLog
 	ts.ctx = ctx
 
-	TorExePath = filepath.Join(ServiceRootDir, "embed", "tor", "tor")
-	if err := InstallExe(embededTor, TorExePath, onLog); err != nil && err.Error() != "installed" {
-		log := ts.fmtLog(FATAL, err.Error())
-		go onLog(log)
-		go onStop(log)
+	if log, adopted := HandleOrphan(ctx, ts); adopted {
+		onStop(log)
 		return
-	} else if err != nil && err.Error() == "installed" {
-		go onLog(ts.fmtLog(INFO, "tor executable installed under "+TorExePath))
 	}
 
-	TorConfigPath = filepath.Join(ServiceRootDir, "tor")
-	err := os.MkdirAll(TorConfigPath, 0755) // make sure the log directory exists
-	if err != nil {
-		log := ts.fmtLog(FATAL, fmt.Sprintf("Cannot create tor directory %v: ", err))
+	if err := ts.configurePorts(onLog); err != nil {
+		log := ts.fmtLog(FATAL, err.Error())
 		go onLog(log)
 		go onStop(log)
 		return
 	}
 
-	// TODO check that torrc contains the proper path, in case that the user migrated to another computer
-	TorConfigFile = filepath.Join(TorConfigPath, "torrc")
-	if _, err := os.Stat(TorConfigFile); os.IsNotExist(err) {
-		config := fmt.Sprintf("DataDirectory %s/data\n%s", TorConfigPath, defaultTorConfig)
-		err = os.WriteFile(TorConfigFile, []byte(config), 0644)
-		if err != nil {
-			log := ts.fmtLog(FATAL,
-				fmt.Sprintf("Cannot create tor configuration file %v: ", err))
-			go onLog(log)
-			go onStop(log)
-			return
-		}
-	}
-
-	cmd := exec.Command(TorExePath, "-f", TorConfigFile)
+	// the domain of every log goes before its message, as {GENERAL}
+	cmd := exec.Command(TorExePath, "-f", TorConfigFile, "--LogMessageDomains", "1")
 	log := ScanCommand(ctx, ts, cmd)
 
 	onStop(log)
@@ -103,13 +130,56 @@ func (ts TorService) name() string {
 	return "Tor"
 }
 
+func (ts TorService) dependencies() []string {
+	return nil
+}
+
+// Send SIGNAL SHUTDOWN through the control port, authenticating with the cookie
+func (ts TorService) shutdown(cmd *exec.Cmd) error {
+	cookie, err := os.ReadFile(filepath.Join(TorConfigPath, "data", "control_auth_cookie"))
+	if err != nil {
+		return fmt.Errorf("cannot read tor control cookie: %w", err)
+	}
+	conn, err := net.DialTimeout("tcp", AddressOf("Tor", "control_port"), time.Second*5)
+	if err != nil {
+		return fmt.Errorf("cannot connect to tor control port: %w", err)
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(time.Second * 10)); err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(conn, "AUTHENTICATE %X\r\nSIGNAL SHUTDOWN\r\n", cookie)
+	if err != nil {
+		return fmt.Errorf("cannot write to tor control port: %w", err)
+	}
+	reader := bufio.NewReader(conn)
+	for _, command := range []string{"AUTHENTICATE", "SIGNAL SHUTDOWN"} {
+		reply, err := reader.ReadString('\n')
+		if err != nil {
+			return fmt.Errorf("no reply from tor control port to %v: %w", command, err)
+		}
+		if !strings.HasPrefix(reply, "250") {
+			return fmt.Errorf("tor control port refused %v: %v", command, strings.TrimSpace(reply))
+		}
+	}
+	return nil
+}
+
+// The SOCKS proxy must answer before tor is ready, and while it runs
+func (ts TorService) probes() ([]Probe, []Probe) {
+	socks := SocksProbe{func() string { return AddressOf("Tor", "socks_port") }}
+	control := TcpProbe{func() string { return AddressOf("Tor", "control_port") }}
+	return []Probe{socks}, []Probe{socks, control}
+}
+
 func (ts TorService) isReady(text string, onLog func(*Log)) bool {
 	return strings.Contains(text, "Bootstrapped 100%")
 }
 
 func (ts TorService) parseLogEntry(line string) (Log, error) {
 	parts := strings.SplitN(line, " ", 5)
-	if len(parts) < 4 {
+	if len(parts) < 5 {
 		return Log{}, fmt.Errorf("invalid log format")
 	}
 
@@ -135,11 +205,20 @@ func (ts TorService) parseLogEntry(line string) (Log, error) {
 		logtype = NORMAL
 	}
 
+	desc, domain := parts[4], ""
+	if rest, ok := strings.CutPrefix(desc, "{"); ok {
+		if domains, message, ok := strings.Cut(rest, "} "); ok {
+			// the first of the domains, such as {NET,OR}
+			domain, _, _ = strings.Cut(domains, ",")
+			desc = message
+		}
+	}
 	logEntry := Log{
-		date:    t,
-		logType: logtype,
-		desc:    parts[4],
-		service: "Tor",
+		date:      t,
+		logType:   logtype,
+		desc:      desc,
+		service:   "Tor",
+		subsystem: domain,
 	}
 
 	errs := logEntry.Validate()
@@ -31,6 +31,35 @@ func TestTorStart(t *testing.T) {
 			fmt.Println(log)
 		}
 	}
+	if err := ts.install(onLog); err != nil {
+		t.Fatal(err)
+	}
 	ts.start(ctx, onReady, onStop, onLog)
 	assert.True(t, gotReady, "Tor never got ready")
 }
+
+func TestTorParseLogEntry(t *testing.T) {
+	ts := TorService{}
+	l, err := ts.parseLogEntry("May 01 10:00:00.000 [warn] {NET,OR} Could not bind to 127.0.0.1:9050")
+	assert.NoError(t, err)
+	assert.Equal(t, "Tor", l.service)
+	assert.Equal(t, "NET", l.subsystem)
+	assert.Equal(t, "Could not bind to 127.0.0.1:9050", l.desc)
+	assert.Equal(t, CATEGORY_NETWORK, l.category())
+
+	l, err = ts.parseLogEntry("May 01 10:00:00.000 [notice] {GENERAL} Bootstrapped 100% (done): Done")
+	assert.NoError(t, err)
+	assert.Equal(t, "GENERAL", l.subsystem)
+	assert.Equal(t, "Bootstrapped 100% (done): Done", l.desc)
+	assert.Equal(t, CATEGORY_TOR, l.category())
+
+	// without LogMessageDomains
+	l, err = ts.parseLogEntry("May 01 10:00:00.000 [notice] Tor 0.4.8.10 opening log file.")
+	assert.NoError(t, err)
+	assert.Empty(t, l.subsystem)
+	assert.Equal(t, "Tor 0.4.8.10 opening log file.", l.desc)
+
+	// a line with no message is not a log
+	_, err = ts.parseLogEntry("May 01 10:00:00.000 [notice]")
+	assert.Error(t, err)
+}
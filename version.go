@@ -0,0 +1,296 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Services whose binary can tell its version
+type versionedService interface {
+	// the installed binary and the zip embedded in LNBank it comes from
+	binary() (exe string, embedded []byte)
+	binaryVersion(ctx context.Context) (string, error)
+}
+
+// Services that can tell the version they are running once ready, which is
+// not the installed one when an older process was adopted
+type runningVersionService interface {
+	runningVersion(ctx context.Context) (string, error)
+}
+
+// A version of a service seen by LNBank
+type VersionRecord struct {
+	date    time.Time
+	service string
+	version string
+	// of the binary, empty when the version comes from the running service
+	sha256 string
+}
+
+const VersionTable = `
+CREATE TABLE IF NOT EXISTS version (
+    timestamp INTEGER NOT NULL,
+    service VARCHAR(8) NOT NULL COLLATE NOCASE,
+    version TEXT NOT NULL,
+    sha256 TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS version_idx ON version (service COLLATE NOCASE, timestamp);
+`
+
+// How long a command telling a version may take
+const VersionTimeout = time.Second * 10
+
+var (
+	versions      = make(map[string]string)
+	versionsMutex sync.Mutex
+	versionTable  sync.Once
+)
+
+// 0.4.8.12 from "Tor version 0.4.8.12." or 0.18.1-beta from
+// "lnd version 0.18.1-beta commit=v0.18.1-beta"
+var versionPattern = regexp.MustCompile(`\d+(\.\d+)+(-[\w.]*\w)?`)
+
+func parseVersion(output string) (string, error) {
+	version := versionPattern.FindString(output)
+	if version == "" {
+		return "", fmt.Errorf("no version in %q", strings.TrimSpace(output))
+	}
+	return version, nil
+}
+
+// The version printed by a command
+func commandVersion(ctx context.Context, exe string, args ...string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, VersionTimeout)
+	defer cancel()
+	output, err := exec.CommandContext(ctx, exe, args...).Output()
+	if err != nil {
+		return "", fmt.Errorf("%v %v: %w", filepath.Base(exe), strings.Join(args, " "), err)
+	}
+	return parseVersion(string(output))
+}
+
+// Version of a service as shown to the user: the one it runs or has
+// installed, or else the one of its manifest
+func ServiceVersion(name string) string {
+	versionsMutex.Lock()
+	version, ok := versions[name]
+	versionsMutex.Unlock()
+	if ok {
+		return "v" + version
+	}
+	if m, ok := Manifests[name]; ok {
+		return m.Version
+	}
+	return ""
+}
+
+func setServiceVersion(name string, version string) {
+	versionsMutex.Lock()
+	versions[name] = version
+	versionsMutex.Unlock()
+}
+
+// sha256 of a file
+func fileDigest(file string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// sha256 of exe as found in the embedded zip, which is unzipped into
+// ServiceRootDir. Empty if the zip does not have it.
+func embeddedDigest(embedded []byte, exe string) (string, error) {
+	rel, err := filepath.Rel(ServiceRootDir, exe)
+	if err != nil {
+		return "", err
+	}
+	r, err := zip.NewReader(bytes.NewReader(embedded), int64(len(embedded)))
+	if err != nil {
+		return "", err
+	}
+	for _, f := range r.File {
+		if f.Name != filepath.ToSlash(rel) {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return "", err
+		}
+		defer rc.Close()
+		h := sha256.New()
+		if _, err := io.Copy(h, rc); err != nil {
+			return "", err
+		}
+		return hex.EncodeToString(h.Sum(nil)), nil
+	}
+	return "", nil
+}
+
+// Detect the version of the installed binary of a service, record it when it
+// changed and warn when the binary is not the one embedded in LNBank
+func CheckVersion(ctx context.Context, service Service, vs versionedService, onLog func(*Log)) {
+	name := service.name()
+	exe, embedded := vs.binary()
+	version, err := vs.binaryVersion(ctx)
+	if err != nil {
+		onLog(service.fmtLog(WARNING, "cannot tell the version of "+name+": "+err.Error()))
+		return
+	}
+	setServiceVersion(name, version)
+	digest, err := fileDigest(exe)
+	if err != nil {
+		onLog(service.fmtLog(WARNING, "cannot read the binary of "+name+": "+err.Error()))
+	}
+	recordVersion(service, VersionRecord{time.Now(), name, version, digest}, onLog)
+
+	want, err := embeddedDigest(embedded, exe)
+	if err != nil {
+		onLog(service.fmtLog(WARNING, "cannot read the embedded binary of "+name+": "+err.Error()))
+	} else if want != "" && digest != "" && want != digest {
+		onLog(service.fmtLog(WARNING, fmt.Sprintf(
+			"%v %v under %v is not the binary that comes with LNBank", name, version, exe)))
+	}
+}
+
+// Ask a ready service its version, which should be the installed one
+func CheckRunningVersion(ctx context.Context, service Service, rv runningVersionService, onLog func(*Log)) {
+	name := service.name()
+	version, err := rv.runningVersion(ctx)
+	if err != nil {
+		if ctx.Err() == nil {
+			onLog(service.fmtLog(WARNING, "cannot ask "+name+" its version: "+err.Error()))
+		}
+		return
+	}
+	versionsMutex.Lock()
+	installed, ok := versions[name]
+	versions[name] = version
+	versionsMutex.Unlock()
+	if ok && installed != version {
+		onLog(service.fmtLog(WARNING, fmt.Sprintf(
+			"%v is running %v but %v is installed, it will be used once restarted", name, version, installed)))
+	}
+	// only stored, the change was just told
+	if _, _, err := VersionToDb(VersionRecord{time.Now(), name, version, ""}); err != nil {
+		onLog(service.fmtLog(WARNING, "cannot store the version of "+name+": "+err.Error()))
+	}
+}
+
+// Store the version of a binary in the db unless it is the last one of the
+// service, telling how it changed
+func recordVersion(service Service, vr VersionRecord, onLog func(*Log)) {
+	changed, previous, err := VersionToDb(vr)
+	if err != nil {
+		onLog(service.fmtLog(WARNING, "cannot store the version of "+vr.service+": "+err.Error()))
+		return
+	}
+	if !changed {
+		return
+	}
+	if previous == nil {
+		onLog(service.fmtLog(INFO, vr.service+" version "+vr.version))
+	} else if previous.version != vr.version {
+		onLog(service.fmtLog(INFO, vr.service+" version changed from "+previous.version+" to "+vr.version))
+	} else {
+		onLog(service.fmtLog(WARNING, vr.service+" binary changed, with the same version "+vr.version))
+	}
+}
+
+func createVersionTable() error {
+	var err error
+	versionTable.Do(func() {
+		_, err = DB.ExecContext(ServicesContext, VersionTable)
+	})
+	return err
+}
+
+// Store a version unless it is the same as the last one stored for the
+// service, which is returned. The version of a binary is compared with the
+// last binary, a running version with the last version of any kind.
+func VersionToDb(vr VersionRecord) (bool, *VersionRecord, error) {
+	if err := createVersionTable(); err != nil {
+		return false, nil, err
+	}
+	query := "SELECT timestamp, service, version, sha256 FROM version WHERE service=? ORDER BY timestamp DESC, rowid DESC LIMIT 1"
+	if vr.sha256 != "" {
+		query = "SELECT timestamp, service, version, sha256 FROM version WHERE service=? AND sha256 != '' ORDER BY timestamp DESC, rowid DESC LIMIT 1"
+	}
+	var previous VersionRecord
+	var unixdate int64
+	err := DB.QueryRowContext(ServicesContext, query, vr.service).
+		Scan(&unixdate, &previous.service, &previous.version, &previous.sha256)
+	var last *VersionRecord
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+	case err != nil:
+		return false, nil, err
+	default:
+		previous.date = time.Unix(unixdate, 0)
+		last = &previous
+		if previous.version == vr.version && (vr.sha256 == "" || previous.sha256 == vr.sha256) {
+			return false, last, nil
+		}
+	}
+	_, err = DB.ExecContext(ServicesContext,
+		"INSERT INTO version (timestamp, service, version, sha256) VALUES (?, ?, ?, ?)",
+		vr.date.Unix(), vr.service, vr.version, vr.sha256)
+	return err == nil, last, err
+}
+
+// Versions of a service, oldest first
+func QueryVersions(service string) ([]VersionRecord, error) {
+	if err := createVersionTable(); err != nil {
+		return nil, err
+	}
+	rows, err := DB.QueryContext(ServicesContext,
+		"SELECT timestamp, service, version, sha256 FROM version WHERE service=? ORDER BY timestamp, rowid",
+		service)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var records []VersionRecord
+	for rows.Next() {
+		var vr VersionRecord
+		var unixdate int64
+		if err := rows.Scan(&unixdate, &vr.service, &vr.version, &vr.sha256); err != nil {
+			return nil, err
+		}
+		vr.date = time.Unix(unixdate, 0)
+		records = append(records, vr)
+	}
+	return records, rows.Err()
+}
+
+// The version of lnd from its GetInfo RPC
+func getinfoVersion(output []byte) (string, error) {
+	var info struct {
+		Version string `json:"version"`
+	}
+	if err := json.Unmarshal(output, &info); err != nil {
+		return "", err
+	}
+	return parseVersion(info.Version)
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseVersion(t *testing.T) {
+	for output, want := range map[string]string{
+		"Tor version 0.4.8.12.\n":                       "0.4.8.12",
+		"lnd version 0.18.1-beta commit=v0.18.1-beta\n": "0.18.1-beta",
+		"v1.2.3":          "1.2.3",
+		"bitcoind 27.0rc": "27.0",
+	} {
+		version, err := parseVersion(output)
+		assert.NoError(t, err)
+		assert.Equal(t, want, version, output)
+	}
+	_, err := parseVersion("unknown")
+	assert.Error(t, err)
+
+	version, err := getinfoVersion([]byte(`{"version": "0.18.0-beta commit=v0.18.0-beta", "alias": "LNBank"}`))
+	assert.NoError(t, err)
+	assert.Equal(t, "0.18.0-beta", version)
+}
+
+// A service whose binary is a script printing its version
+type versionService struct {
+	scanService
+	exe      string
+	embedded []byte
+	running  string
+}
+
+func (vs versionService) binary() (string, []byte) {
+	return vs.exe, vs.embedded
+}
+
+func (vs versionService) binaryVersion(ctx context.Context) (string, error) {
+	return commandVersion(ctx, vs.exe, "--version")
+}
+
+func (vs versionService) runningVersion(context.Context) (string, error) {
+	return vs.running, nil
+}
+
+func TestCheckVersion(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("needs sh")
+	}
+	root := ServiceRootDir
+	t.Cleanup(func() { ServiceRootDir = root })
+	ServiceRootDir = t.TempDir()
+	exe := filepath.Join(ServiceRootDir, "embed", "test", "test")
+	assert.NoError(t, os.MkdirAll(filepath.Dir(exe), 0755))
+	script := func(version string) []byte {
+		return []byte("#!/bin/sh\necho test version " + version + "\n")
+	}
+	var zipped bytes.Buffer
+	zw := zip.NewWriter(&zipped)
+	f, err := zw.Create("embed/test/test")
+	assert.NoError(t, err)
+	_, err = f.Write(script("1.0.0"))
+	assert.NoError(t, err)
+	assert.NoError(t, zw.Close())
+
+	name := fmt.Sprintf("vertest%v", time.Now().UnixNano())
+	vs := versionService{scanService{fakeService{n: name}, make(chan *Log, 100)}, exe, zipped.Bytes(), "1.0.0"}
+	var logs []string
+	onLog := func(l *Log) { logs = append(logs, l.logType.Name()+" "+l.desc) }
+
+	// the embedded binary
+	assert.NoError(t, os.WriteFile(exe, script("1.0.0"), 0755))
+	CheckVersion(context.Background(), vs, vs, onLog)
+	assert.Equal(t, "v1.0.0", ServiceVersion(name))
+	CheckRunningVersion(context.Background(), vs, vs, onLog)
+	CheckVersion(context.Background(), vs, vs, onLog)
+	if assert.Len(t, logs, 1) {
+		assert.Contains(t, logs[0], "version 1.0.0")
+	}
+
+	// another binary, still running the old one
+	logs = nil
+	assert.NoError(t, os.WriteFile(exe, script("1.1.0"), 0755))
+	CheckVersion(context.Background(), vs, vs, onLog)
+	assert.Equal(t, "v1.1.0", ServiceVersion(name))
+	CheckRunningVersion(context.Background(), vs, vs, onLog)
+	assert.Equal(t, "v1.0.0", ServiceVersion(name))
+	assert.Len(t, logs, 3)
+	assert.Contains(t, strings.Join(logs, "\n"), "changed from 1.0.0 to 1.1.0")
+	assert.Contains(t, strings.Join(logs, "\n"), "is not the binary that comes with LNBank")
+	assert.Contains(t, strings.Join(logs, "\n"), "is running 1.0.0 but 1.1.0 is installed")
+
+	records, err := QueryVersions(name)
+	assert.NoError(t, err)
+	if assert.Len(t, records, 3) {
+		assert.Equal(t, "1.0.0", records[0].version)
+		assert.NotEmpty(t, records[0].sha256)
+		assert.Equal(t, "1.1.0", records[1].version)
+		assert.Equal(t, "1.0.0", records[2].version)
+		assert.Empty(t, records[2].sha256)
+	}
+}